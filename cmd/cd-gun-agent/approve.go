@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/omnorm/cd-gun/internal/api"
+)
+
+// runApprove implements the "approve" command, which allows a running agent to
+// deploy a force-push held by on_force_push: require_approval
+func runApprove(args []string) int {
+	fs := flag.NewFlagSet("approve", flag.ContinueOnError)
+	configPath := fs.String("config", "/etc/cd-gun/config.yaml", "Path to configuration file")
+	listen := fs.String("api", "", "Control API address (default: agent.api.listen from the configuration)")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: cd-gun-agent approve [-config FILE] [-api ADDR] <repository>")
+		return 2
+	}
+
+	address, err := apiAddress(*configPath, *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	forcePush, err := api.NewClient(address).Approve(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Approved force-push of '%s' from %s to %s; it is deployed next\n",
+		fs.Arg(0), forcePush.OldHash, forcePush.NewHash)
+	return 0
+}
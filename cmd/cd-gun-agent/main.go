@@ -11,6 +11,17 @@ import (
 const version = "0.1.1"
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "secrets":
+			os.Exit(runSecrets(os.Args[2:]))
+		case "rollback":
+			os.Exit(runRollback(os.Args[2:]))
+		case "approve":
+			os.Exit(runApprove(os.Args[2:]))
+		}
+	}
+
 	var (
 		configPath  = flag.String("config", "/etc/cd-gun/config.yaml", "Path to configuration file")
 		logLevel    = flag.String("log-level", "info", "Log level (debug, info, warn, error)")
@@ -47,6 +58,9 @@ func printHelp() {
 	fmt.Printf(`CD-Gun - Universal CD/GitOps Agent v%s
 
 Usage: cd-gun-agent [options]
+       cd-gun-agent secrets <keygen|encrypt|decrypt> [options]
+       cd-gun-agent rollback [options] <repository> [commit|previous]
+       cd-gun-agent approve [options] <repository>
 
 Options:
   -config string
@@ -58,6 +72,15 @@ Options:
   -help
         Show this help message and exit
 
+Commands:
+  secrets keygen  -key-file FILE                 Generate a key for the secret store
+  secrets encrypt -key-file FILE -in F -out F    Encrypt a YAML map of secrets
+  secrets decrypt -key-file FILE -in F           Print a decrypted secret store
+  rollback [-api ADDR] REPO [COMMIT]             Redeploy COMMIT (default: previous successful)
+                                                 through the control API of the running agent
+  approve [-api ADDR] REPO                       Deploy a force-push waiting for approval
+                                                 (on_force_push: require_approval)
+
 Signals:
   SIGHUP  - Reload configuration
   SIGUSR1 - Force check all repositories
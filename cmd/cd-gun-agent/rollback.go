@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/omnorm/cd-gun/internal/api"
+	"github.com/omnorm/cd-gun/internal/config"
+)
+
+// runRollback implements the "rollback" command, which asks a running agent to
+// redeploy an earlier commit through the control API
+func runRollback(args []string) int {
+	fs := flag.NewFlagSet("rollback", flag.ContinueOnError)
+	configPath := fs.String("config", "/etc/cd-gun/config.yaml", "Path to configuration file")
+	listen := fs.String("api", "", "Control API address (default: agent.api.listen from the configuration)")
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fmt.Fprintln(os.Stderr, "Usage: cd-gun-agent rollback [-config FILE] [-api ADDR] <repository> [commit|previous]")
+		return 2
+	}
+
+	name := fs.Arg(0)
+	target := "previous"
+	if fs.NArg() == 2 {
+		target = fs.Arg(1)
+	}
+
+	address, err := apiAddress(*configPath, *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	run, err := api.NewClient(address).Rollback(name, target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Rollback of '%s' to %s: %s (run %s)\n", run.Repository, run.NewHash, run.Status, run.ID)
+	if run.Error != "" {
+		fmt.Printf("Error: %s\n", run.Error)
+	}
+
+	if run.Status != "success" {
+		return 1
+	}
+	return 0
+}
+
+// apiAddress returns the control API address to use: listen if set, otherwise
+// agent.api.listen from the configuration. Only the agent section is read, so
+// secret references elsewhere in the file are not resolved.
+func apiAddress(configPath, listen string) (string, error) {
+	if listen != "" {
+		return listen, nil
+	}
+
+	agent, err := config.LoadAgentConfig(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	listen = agent.API.Listen
+	if listen == "" {
+		return "", fmt.Errorf("agent.api.listen is not configured; enable the control API or pass -api")
+	}
+	return listen, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/omnorm/cd-gun/internal/config"
+)
+
+// runSecrets implements the "secrets" command for managing the encrypted secret store
+func runSecrets(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: cd-gun-agent secrets <keygen|encrypt|decrypt> [options]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("secrets "+args[0], flag.ContinueOnError)
+	keyFile := fs.String("key-file", "", "Path to the key file")
+	in := fs.String("in", "", "Input file")
+	out := fs.String("out", "", "Output file")
+
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	if *keyFile == "" {
+		fmt.Fprintln(os.Stderr, "-key-file is required")
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "keygen":
+		err = secretsKeygen(*keyFile)
+	case "encrypt":
+		err = secretsEncrypt(*keyFile, *in, *out)
+	case "decrypt":
+		err = secretsDecrypt(*keyFile, *in)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown secrets command: %s\n", args[0])
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// secretsKeygen writes a new random key, refusing to overwrite an existing one
+func secretsKeygen(keyFile string) error {
+	key, err := config.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, key); err != nil {
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	fmt.Printf("Key written to %s\n", keyFile)
+	return nil
+}
+
+// secretsEncrypt encrypts a plaintext YAML map of secrets into a store
+func secretsEncrypt(keyFile, in, out string) error {
+	if in == "" || out == "" {
+		return fmt.Errorf("-in and -out are required")
+	}
+
+	key, err := config.LoadKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := os.ReadFile(in)
+	if err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+
+	store, err := config.EncryptSecrets(plaintext, key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(out, store, 0600); err != nil {
+		return fmt.Errorf("failed to write store: %w", err)
+	}
+
+	fmt.Printf("Secret store written to %s\n", out)
+	return nil
+}
+
+// secretsDecrypt prints the names and values of a secret store
+func secretsDecrypt(keyFile, in string) error {
+	if in == "" {
+		return fmt.Errorf("-in is required")
+	}
+
+	key, err := config.LoadKeyFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return fmt.Errorf("failed to read store: %w", err)
+	}
+
+	secrets, err := config.DecryptSecrets(data, key)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range secrets {
+		fmt.Printf("%s: %q\n", name, value)
+	}
+	return nil
+}
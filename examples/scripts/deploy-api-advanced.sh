@@ -184,8 +184,6 @@ build_and_push_image() {
     log "Building Docker image: $IMAGE_NAME"
     
     cd "$REPO_PATH"
-    git checkout "$BRANCH"
-    git reset --hard "$NEW_HASH"
     
     docker build \
         --build-arg VERSION="$VERSION" \
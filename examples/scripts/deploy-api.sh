@@ -21,10 +21,8 @@ echo "Repository: $CDGUN_REPO_NAME"
 echo "Branch: $CDGUN_BRANCH"
 echo "Hash: $CDGUN_NEW_HASH"
 
-# Navigate to the repository
+# Navigate to the repository, checked out at $CDGUN_NEW_HASH by the agent
 cd "$CDGUN_REPO_PATH"
-git checkout "$CDGUN_BRANCH"
-git reset --hard "$CDGUN_NEW_HASH"
 
 # Build Docker image
 echo "[$(date)] Building Docker image..."
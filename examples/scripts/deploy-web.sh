@@ -21,10 +21,8 @@ echo "Branch: $CDGUN_BRANCH"
 echo "Changed files: $CDGUN_CHANGED_FILES"
 echo "New hash: $CDGUN_NEW_HASH"
 
-# Navigate to the repository
+# Navigate to the repository, checked out at $CDGUN_NEW_HASH by the agent
 cd "$CDGUN_REPO_PATH"
-git checkout "$CDGUN_BRANCH"
-git reset --hard "$CDGUN_NEW_HASH"
 
 # Install dependencies
 echo "[$(date)] Installing dependencies..."
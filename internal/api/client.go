@@ -0,0 +1,105 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// Client calls the control API of a running agent
+type Client struct {
+	baseURL string
+	http    *http.Client
+}
+
+// NewClient creates a client for an API listen address as configured in
+// agent.api.listen
+func NewClient(listen string) *Client {
+	network, address := ParseListen(listen)
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+
+	baseURL := "http://cd-gun"
+	if network == "tcp" {
+		baseURL = "http://" + address
+	}
+
+	return &Client{
+		baseURL: baseURL,
+		http:    &http.Client{Transport: transport},
+	}
+}
+
+// Rollback asks the agent to redeploy an earlier commit and returns the
+// resulting run
+func (c *Client) Rollback(name, target string) (*state.Run, error) {
+	body, err := json.Marshal(RollbackRequest{Target: target})
+	if err != nil {
+		return nil, err
+	}
+
+	var run state.Run
+	if err := c.do(http.MethodPost, "/v1/repositories/"+url.PathEscape(name)+"/rollback", body, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// Approve asks the agent to deploy a force-push that waits for approval and
+// returns the approved force-push
+func (c *Client) Approve(name string) (*state.ForcePush, error) {
+	var forcePush state.ForcePush
+	if err := c.do(http.MethodPost, "/v1/repositories/"+url.PathEscape(name)+"/approve", nil, &forcePush); err != nil {
+		return nil, err
+	}
+	return &forcePush, nil
+}
+
+// do sends a request and decodes a JSON response into out
+func (c *Client) do(method, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach agent: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
+	}
+
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			return fmt.Errorf("%s", apiErr.Error)
+		}
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/executor"
+	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/metrics"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// Errors returned by a Controller that map to client errors
+var (
+	ErrUnknownRepository = errors.New("unknown repository") // repository not in the configuration
+	ErrInvalidTarget     = errors.New("invalid rollback target")
+	ErrNothingToApprove  = errors.New("no force-push is waiting for approval")
+)
+
+// RepositoryStatus describes a monitored repository
+type RepositoryStatus struct {
+	Name    string                `json:"name"`
+	Paused  bool                  `json:"paused"`
+	Running bool                  `json:"running"` // a deploy or rollback is running
+	Queued  int                   `json:"queued"`  // deploys and rollbacks waiting to run
+	State   state.RepositoryState `json:"state"`
+}
+
+// Controller is the agent functionality exposed by the API
+type Controller interface {
+	Repositories() []RepositoryStatus
+	Repository(name string) (RepositoryStatus, error)
+	ForceCheck(name string) error
+	Pause(name string) error
+	Resume(name string) error
+	Reload() error
+	RecentResults(name string, limit int) []executor.ExecutionResult
+	Runs(name string, limit int) ([]state.Run, error)
+	Run(name, id string) (*state.Run, error)
+	RunLog(name, id string) (string, error) // path of the run's output log file
+	Rollback(name, target string) (*state.Run, error)
+	Approve(name string) (*state.ForcePush, error) // deploy a force-push held by on_force_push: require_approval
+}
+
+// RollbackRequest is the body of a rollback request
+type RollbackRequest struct {
+	Target string `json:"target"` // commit to redeploy, or "previous" (default)
+}
+
+// Server is the local HTTP status and control API of the agent
+type Server struct {
+	listen   string
+	ctrl     Controller
+	logger   *logger.Logger
+	srv      *http.Server
+	listener net.Listener
+}
+
+// NewServer creates an API server listening on listen, which is either
+// "unix:/path/to/socket" or a loopback "host:port"
+func NewServer(listen string, ctrl Controller, log *logger.Logger) *Server {
+	s := &Server{
+		listen: listen,
+		ctrl:   ctrl,
+		logger: log,
+	}
+
+	s.srv = &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return s
+}
+
+// Handler returns the HTTP handler serving the API
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /v1/repositories", s.handleRepositories)
+	mux.HandleFunc("GET /v1/repositories/{name}", s.handleRepository)
+	mux.HandleFunc("POST /v1/repositories/{name}/check", s.handleAction(s.ctrl.ForceCheck, "check triggered"))
+	mux.HandleFunc("POST /v1/repositories/{name}/pause", s.handleAction(s.ctrl.Pause, "paused"))
+	mux.HandleFunc("POST /v1/repositories/{name}/resume", s.handleAction(s.ctrl.Resume, "resumed"))
+	mux.HandleFunc("POST /v1/repositories/{name}/rollback", s.handleRollback)
+	mux.HandleFunc("POST /v1/repositories/{name}/approve", s.handleApprove)
+	mux.HandleFunc("GET /v1/repositories/{name}/runs", s.handleRuns)
+	mux.HandleFunc("GET /v1/repositories/{name}/runs/{id}", s.handleRun)
+	mux.HandleFunc("GET /v1/repositories/{name}/runs/{id}/log", s.handleRunLog)
+	mux.HandleFunc("GET /v1/results", s.handleResults)
+	mux.HandleFunc("POST /v1/reload", s.handleReload)
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	return mux
+}
+
+// Start starts listening and serving in the background
+func (s *Server) Start() error {
+	network, address := ParseListen(s.listen)
+
+	if network == "unix" {
+		// Remove a stale socket left by a previous run
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.listen, err)
+	}
+
+	if network == "unix" {
+		if err := os.Chmod(address, 0660); err != nil {
+			listener.Close()
+			return fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+	}
+
+	s.listener = listener
+	s.logger.Infof("Control API listening on %s", s.listen)
+
+	go func() {
+		if err := s.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("Control API server error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
+
+// ParseListen splits a listen address into network and address
+func ParseListen(listen string) (string, string) {
+	if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", listen
+}
+
+func (s *Server) handleRepositories(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, s.ctrl.Repositories())
+}
+
+func (s *Server) handleRepository(w http.ResponseWriter, r *http.Request) {
+	status, err := s.ctrl.Repository(r.PathValue("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleAction wraps a per-repository control operation
+func (s *Server) handleAction(op func(name string) error, message string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if err := op(name); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		s.logger.Infof("Control API: repository '%s' %s", name, message)
+		writeJSON(w, http.StatusOK, map[string]string{"repository": name, "status": message})
+	}
+}
+
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request) {
+	var req RollbackRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+	}
+
+	name := r.PathValue("name")
+	s.logger.Infof("Control API: rollback of '%s' to '%s' requested", name, req.Target)
+
+	run, err := s.ctrl.Rollback(name, req.Target)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	forcePush, err := s.ctrl.Approve(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.logger.Infof("Control API: force-push of '%s' to %s approved", name, forcePush.NewHash)
+	writeJSON(w, http.StatusOK, forcePush)
+}
+
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(w, r)
+	if !ok {
+		return
+	}
+
+	runs, err := s.ctrl.Runs(r.PathValue("name"), limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if runs == nil {
+		runs = []state.Run{}
+	}
+	writeJSON(w, http.StatusOK, runs)
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	run, err := s.ctrl.Run(r.PathValue("name"), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, run)
+}
+
+func (s *Server) handleRunLog(w http.ResponseWriter, r *http.Request) {
+	path, err := s.ctrl.RunLog(r.PathValue("name"), r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+func (s *Server) handleResults(w http.ResponseWriter, r *http.Request) {
+	limit, ok := queryLimit(w, r)
+	if !ok {
+		return
+	}
+
+	results := s.ctrl.RecentResults(r.URL.Query().Get("repository"), limit)
+	if results == nil {
+		results = []executor.ExecutionResult{}
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, _ *http.Request) {
+	if err := s.ctrl.Reload(); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	s.logger.Info("Control API: configuration reloaded")
+	writeJSON(w, http.StatusOK, map[string]string{"status": "reloaded"})
+}
+
+// queryLimit parses the limit query parameter, writing an error response if it
+// is invalid
+func queryLimit(w http.ResponseWriter, r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("limit")
+	if v == "" {
+		return 20, true
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+		return 0, false
+	}
+	return n, true
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as a JSON error response
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrUnknownRepository), errors.Is(err, state.ErrRunNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrInvalidTarget):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrNothingToApprove):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
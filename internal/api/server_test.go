@@ -0,0 +1,380 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omnorm/cd-gun/internal/executor"
+	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// fakeController records control calls for a single repository named "app"
+type fakeController struct {
+	paused    bool
+	checks    int
+	reloadErr error
+	results   []executor.ExecutionResult
+	runLog    string
+
+	pendingForcePush bool
+}
+
+func (f *fakeController) lookup(name string) error {
+	if name != "app" {
+		return fmt.Errorf("%w: %s", ErrUnknownRepository, name)
+	}
+	return nil
+}
+
+func (f *fakeController) Repositories() []RepositoryStatus {
+	status, _ := f.Repository("app")
+	return []RepositoryStatus{status}
+}
+
+func (f *fakeController) Repository(name string) (RepositoryStatus, error) {
+	if err := f.lookup(name); err != nil {
+		return RepositoryStatus{}, err
+	}
+	return RepositoryStatus{
+		Name:   name,
+		Paused: f.paused,
+		State:  state.RepositoryState{Name: name, CurrentHash: "abc123"},
+	}, nil
+}
+
+func (f *fakeController) ForceCheck(name string) error {
+	if err := f.lookup(name); err != nil {
+		return err
+	}
+	f.checks++
+	return nil
+}
+
+func (f *fakeController) Pause(name string) error {
+	if err := f.lookup(name); err != nil {
+		return err
+	}
+	f.paused = true
+	return nil
+}
+
+func (f *fakeController) Resume(name string) error {
+	if err := f.lookup(name); err != nil {
+		return err
+	}
+	f.paused = false
+	return nil
+}
+
+func (f *fakeController) Reload() error {
+	return f.reloadErr
+}
+
+func (f *fakeController) Runs(name string, limit int) ([]state.Run, error) {
+	if err := f.lookup(name); err != nil {
+		return nil, err
+	}
+	return []state.Run{{ID: "run-1", Repository: name, Status: "success"}}, nil
+}
+
+func (f *fakeController) Run(name, id string) (*state.Run, error) {
+	if err := f.lookup(name); err != nil {
+		return nil, err
+	}
+	if id != "run-1" {
+		return nil, fmt.Errorf("%w: %s", state.ErrRunNotFound, id)
+	}
+	return &state.Run{ID: id, Repository: name, Status: "success"}, nil
+}
+
+func (f *fakeController) RunLog(name, id string) (string, error) {
+	if err := f.lookup(name); err != nil {
+		return "", err
+	}
+	if id != "run-1" || f.runLog == "" {
+		return "", fmt.Errorf("%w: %s", state.ErrRunNotFound, id)
+	}
+	return f.runLog, nil
+}
+
+func (f *fakeController) Rollback(name, target string) (*state.Run, error) {
+	if err := f.lookup(name); err != nil {
+		return nil, err
+	}
+	if target == "bad" {
+		return nil, fmt.Errorf("%w: unknown commit '%s'", ErrInvalidTarget, target)
+	}
+	if target == "" {
+		target = "previous-hash"
+	}
+	return &state.Run{Repository: name, NewHash: target, Trigger: "rollback", Status: "success"}, nil
+}
+
+func (f *fakeController) Approve(name string) (*state.ForcePush, error) {
+	if err := f.lookup(name); err != nil {
+		return nil, err
+	}
+	if !f.pendingForcePush {
+		return nil, fmt.Errorf("%w: %s", ErrNothingToApprove, name)
+	}
+	f.pendingForcePush = false
+	return &state.ForcePush{OldHash: "old", NewHash: "new", Status: state.ForcePushApproved}, nil
+}
+
+func (f *fakeController) RecentResults(name string, limit int) []executor.ExecutionResult {
+	var results []executor.ExecutionResult
+	for _, r := range f.results {
+		if (name == "" || r.RepositoryName == name) && len(results) < limit {
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+func newTestServer(ctrl Controller) http.Handler {
+	var buf bytes.Buffer
+	return NewServer("127.0.0.1:0", ctrl, logger.NewLogger("debug", &buf)).Handler()
+}
+
+func do(t *testing.T, h http.Handler, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec
+}
+
+func TestServerRepositoryStatus(t *testing.T) {
+	h := newTestServer(&fakeController{})
+
+	rec := do(t, h, http.MethodGet, "/v1/repositories")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+
+	var list []RepositoryStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(list) != 1 || list[0].Name != "app" || list[0].State.CurrentHash != "abc123" {
+		t.Errorf("unexpected repositories: %+v", list)
+	}
+
+	if rec := do(t, h, http.MethodGet, "/v1/repositories/app"); rec.Code != http.StatusOK {
+		t.Errorf("GET app: status = %d, want 200", rec.Code)
+	}
+	if rec := do(t, h, http.MethodGet, "/v1/repositories/missing"); rec.Code != http.StatusNotFound {
+		t.Errorf("GET missing: status = %d, want 404", rec.Code)
+	}
+}
+
+func TestServerControl(t *testing.T) {
+	ctrl := &fakeController{}
+	h := newTestServer(ctrl)
+
+	tests := []struct {
+		method     string
+		target     string
+		wantStatus int
+	}{
+		{http.MethodPost, "/v1/repositories/app/check", http.StatusOK},
+		{http.MethodPost, "/v1/repositories/app/pause", http.StatusOK},
+		{http.MethodPost, "/v1/repositories/missing/pause", http.StatusNotFound},
+		{http.MethodGet, "/v1/repositories/app/check", http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		if rec := do(t, h, tt.method, tt.target); rec.Code != tt.wantStatus {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.target, rec.Code, tt.wantStatus)
+		}
+	}
+
+	if ctrl.checks != 1 {
+		t.Errorf("checks = %d, want 1", ctrl.checks)
+	}
+	if !ctrl.paused {
+		t.Error("expected repository to be paused")
+	}
+
+	do(t, h, http.MethodPost, "/v1/repositories/app/resume")
+	if ctrl.paused {
+		t.Error("expected repository to be resumed")
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	ctrl := &fakeController{}
+	h := newTestServer(ctrl)
+
+	if rec := do(t, h, http.MethodPost, "/v1/reload"); rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+
+	ctrl.reloadErr = errors.New("invalid config")
+	rec := do(t, h, http.MethodPost, "/v1/reload")
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", rec.Code)
+	}
+	if !bytes.Contains(rec.Body.Bytes(), []byte("invalid config")) {
+		t.Errorf("expected error in body, got %s", rec.Body.String())
+	}
+}
+
+func TestServerResults(t *testing.T) {
+	ctrl := &fakeController{results: []executor.ExecutionResult{
+		{RepositoryName: "app", Success: true},
+		{RepositoryName: "other", Success: false},
+		{RepositoryName: "app", Success: false},
+	}}
+	h := newTestServer(ctrl)
+
+	tests := []struct {
+		target    string
+		wantCount int
+		wantCode  int
+	}{
+		{"/v1/results", 3, http.StatusOK},
+		{"/v1/results?repository=app", 2, http.StatusOK},
+		{"/v1/results?limit=1", 1, http.StatusOK},
+		{"/v1/results?limit=abc", 0, http.StatusBadRequest},
+		{"/v1/results?repository=none", 0, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rec := do(t, h, http.MethodGet, tt.target)
+		if rec.Code != tt.wantCode {
+			t.Errorf("%s: status = %d, want %d", tt.target, rec.Code, tt.wantCode)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+
+		var results []executor.ExecutionResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: invalid JSON: %v", tt.target, err)
+		}
+		if len(results) != tt.wantCount {
+			t.Errorf("%s: got %d results, want %d", tt.target, len(results), tt.wantCount)
+		}
+	}
+}
+
+func TestServerRuns(t *testing.T) {
+	h := newTestServer(&fakeController{})
+
+	tests := []struct {
+		target     string
+		wantStatus int
+	}{
+		{"/v1/repositories/app/runs", http.StatusOK},
+		{"/v1/repositories/app/runs?limit=0", http.StatusBadRequest},
+		{"/v1/repositories/missing/runs", http.StatusNotFound},
+		{"/v1/repositories/app/runs/run-1", http.StatusOK},
+		{"/v1/repositories/app/runs/run-2", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		if rec := do(t, h, http.MethodGet, tt.target); rec.Code != tt.wantStatus {
+			t.Errorf("GET %s: status = %d, want %d", tt.target, rec.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestServerRunLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run-1.log")
+	if err := os.WriteFile(path, []byte("==> [app/deploy] shell step started\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newTestServer(&fakeController{runLog: path})
+
+	rec := do(t, h, http.MethodGet, "/v1/repositories/app/runs/run-1/log")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Content-Type = %q, want text/plain", rec.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rec.Body.String(), "shell step started") {
+		t.Errorf("body = %q, want the log file", rec.Body.String())
+	}
+
+	if rec := do(t, h, http.MethodGet, "/v1/repositories/app/runs/run-2/log"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown run: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
+
+func TestServerRollback(t *testing.T) {
+	h := newTestServer(&fakeController{})
+
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		wantStatus int
+		wantHash   string
+	}{
+		{"previous by default", "/v1/repositories/app/rollback", "", http.StatusOK, "previous-hash"},
+		{"explicit commit", "/v1/repositories/app/rollback", `{"target":"abc123"}`, http.StatusOK, "abc123"},
+		{"unknown commit", "/v1/repositories/app/rollback", `{"target":"bad"}`, http.StatusBadRequest, ""},
+		{"invalid body", "/v1/repositories/app/rollback", `{`, http.StatusBadRequest, ""},
+		{"unknown repository", "/v1/repositories/missing/rollback", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body)))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantHash == "" {
+				return
+			}
+
+			var run state.Run
+			if err := json.Unmarshal(rec.Body.Bytes(), &run); err != nil {
+				t.Fatalf("invalid JSON: %v", err)
+			}
+			if run.NewHash != tt.wantHash {
+				t.Errorf("NewHash = %q, want %q", run.NewHash, tt.wantHash)
+			}
+		})
+	}
+}
+
+func TestServerApprove(t *testing.T) {
+	h := newTestServer(&fakeController{pendingForcePush: true})
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+	}{
+		{"pending force-push", "/v1/repositories/app/approve", http.StatusOK},
+		{"nothing pending", "/v1/repositories/app/approve", http.StatusConflict},
+		{"unknown repository", "/v1/repositories/missing/approve", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.target, nil))
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+}
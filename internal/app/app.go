@@ -1,35 +1,62 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"reflect"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/omnorm/cd-gun/internal/api"
 	"github.com/omnorm/cd-gun/internal/config"
 	"github.com/omnorm/cd-gun/internal/executor"
+	"github.com/omnorm/cd-gun/internal/hooks"
 	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/metrics"
 	"github.com/omnorm/cd-gun/internal/monitor"
 	"github.com/omnorm/cd-gun/internal/state"
 )
 
 // App is the main application structure
 type App struct {
-	config     *config.Manager
-	configChan chan config.Config
-	logger     *logger.Logger
-	stateStore *state.Store //nolint:unused // Used in handleMonitorEvent and Stop methods
-	monitors   map[string]*monitor.Monitor
-	executor   *executor.Executor
-	mu         sync.RWMutex
-	stopChan   chan struct{}
-	wg         sync.WaitGroup
-	logFile    *os.File // Log file handle (nil if logging to stdout)
+	config       *config.Manager
+	configChan   chan config.Config
+	logger       *logger.Logger
+	stateStore   *state.Store //nolint:unused // Used in handleMonitorEvent and Stop methods
+	monitors     map[string]*monitor.Monitor
+	stopping     map[string]*monitor.Monitor // monitors removed from monitors that have not stopped yet
+	monitorsChan chan struct{}               // monitors were added outside the event loop
+	executor     *executor.Executor
+	pool         *executor.Pool          // runs deploys and rollbacks off the event loop
+	ctx          context.Context         // cancelled on shutdown, stops running actions
+	cancel       context.CancelCauseFunc // cancels ctx
+	mu           sync.RWMutex
+	stopChan     chan struct{}
+	reloadChan   chan chan error      // reload requests from the control API
+	rollbackChan chan rollbackRequest // rollback requests from the control API
+	wg           sync.WaitGroup       // event loop
+	monitorWG    sync.WaitGroup       // monitor goroutines, waited for by Stop
+	logFile      *os.File             // Log file handle (nil if logging to stdout)
+	apiServer    *api.Server
+	metricsSrv   *metrics.Server
+	hooksSrv     *hooks.Receiver
+	resultsMu    sync.Mutex
+	results      []executor.ExecutionResult // recent action results, oldest first
 }
 
+// stopMargin is how long Stop takes at most beyond the stop grace period before
+// it saves state, whether or not monitors and killed actions have finished.
+// TimeoutStopSec in deployments/cd-gun.service must leave room for it.
+const stopMargin = 15 * time.Second
+
+// errStopping is the cause of actions cancelled by an agent shutdown
+var errStopping = errors.New("agent is stopping")
+
 // NewApp creates a new application instance
 func NewApp(configPath string, logLevel string) (*App, error) {
 	// Load config first to get log file path
@@ -56,6 +83,7 @@ func NewApp(configPath string, logLevel string) (*App, error) {
 		effectiveLogLevel = cfg.Agent.LogLevel
 	}
 	log := logger.NewLogger(effectiveLogLevel, logOut)
+	log.SetRedactor(configMgr.Redact)
 
 	// Create state store
 	stateStore, err := state.NewStore(cfg.Agent.StateDir)
@@ -65,16 +93,24 @@ func NewApp(configPath string, logLevel string) (*App, error) {
 		}
 		return nil, fmt.Errorf("failed to create state store: %w", err)
 	}
+	stateStore.SetHistoryOptions(historyOptions(configMgr))
 
 	app := &App{
-		config:     configMgr,
-		configChan: make(chan config.Config, 1),
-		logger:     log,
-		stateStore: stateStore,
-		monitors:   make(map[string]*monitor.Monitor),
-		stopChan:   make(chan struct{}),
-		logFile:    logOut,
+		config:       configMgr,
+		configChan:   make(chan config.Config, 1),
+		logger:       log,
+		stateStore:   stateStore,
+		monitors:     make(map[string]*monitor.Monitor),
+		stopping:     make(map[string]*monitor.Monitor),
+		monitorsChan: make(chan struct{}, 1),
+		stopChan:     make(chan struct{}),
+		reloadChan:   make(chan chan error),
+		rollbackChan: make(chan rollbackRequest),
+		pool:         executor.NewPool(cfg.Agent.MaxConcurrentActions),
+		logFile:      logOut,
 	}
+	app.ctx, app.cancel = context.WithCancelCause(context.Background())
+	app.markInterruptedRuns()
 
 	// Create executor
 	app.executor, err = executor.NewExecutor(log)
@@ -84,6 +120,7 @@ func NewApp(configPath string, logLevel string) (*App, error) {
 		}
 		return nil, fmt.Errorf("failed to create executor: %w", err)
 	}
+	app.executor.SetRunLogDir(stateStore.RunLogDir())
 
 	// Initialize monitors
 	if err := app.initializeMonitors(); err != nil {
@@ -122,15 +159,53 @@ func (a *App) Start() error {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR1)
 
+	a.run(sigChan)
+	return nil
+}
+
+// run starts the monitors, servers and event loop and returns once the event
+// loop has stopped
+func (a *App) run(sigChan chan os.Signal) {
+	// Before the monitors start, none of them is cloning
+	cfg := a.config.GetConfig()
+	names := make([]string, len(cfg.Repositories))
+	for i, repo := range cfg.Repositories {
+		names[i] = repo.Name
+	}
+	monitor.PruneCache(cfg.Agent.CacheDir, names, a.logger)
+
 	// Start monitors
+	a.mu.RLock()
 	for name, mon := range a.monitors {
-		a.wg.Add(1)
-		go func(name string, mon *monitor.Monitor) {
-			defer a.wg.Done()
-			if err := mon.Start(a.stopChan); err != nil {
-				a.logger.Errorf("Monitor for '%s' error: %v", name, err)
-			}
-		}(name, mon)
+		a.startMonitor(name, mon)
+	}
+	a.mu.RUnlock()
+
+	// Start control API
+	if listen := a.config.GetConfig().Agent.API.Listen; listen != "" {
+		a.apiServer = api.NewServer(listen, a, a.logger)
+		if err := a.apiServer.Start(); err != nil {
+			a.logger.Errorf("Failed to start control API: %v", err)
+			a.apiServer = nil
+		}
+	}
+
+	// Start metrics endpoint
+	if listen := a.config.GetConfig().Agent.Metrics.Listen; listen != "" {
+		a.metricsSrv = metrics.NewServer(listen, a.logger)
+		if err := a.metricsSrv.Start(); err != nil {
+			a.logger.Errorf("Failed to start metrics endpoint: %v", err)
+			a.metricsSrv = nil
+		}
+	}
+
+	// Start push hook receiver
+	if listen := a.config.GetConfig().Agent.PushHooks.Listen; listen != "" {
+		a.hooksSrv = hooks.NewReceiver(listen, a.config, a.pushTrigger, a.logger)
+		if err := a.hooksSrv.Start(); err != nil {
+			a.logger.Errorf("Failed to start push hook receiver: %v", err)
+			a.hooksSrv = nil
+		}
 	}
 
 	// Start main event loop
@@ -142,61 +217,96 @@ func (a *App) Start() error {
 
 	a.logger.Info("CD-Gun agent started successfully")
 
-	// Wait for all goroutines to finish
+	// Stop runs on the event loop, which returns after it
 	a.wg.Wait()
+}
 
-	return nil
+// startMonitor runs a monitor in its own goroutine tracked by the monitor wait group
+func (a *App) startMonitor(name string, mon *monitor.Monitor) {
+	a.monitorWG.Add(1)
+	go func() {
+		defer a.monitorWG.Done()
+		select {
+		case <-a.stopChan:
+			return // restarted by a reload during shutdown
+		default:
+		}
+		if err := mon.Start(a.stopChan); err != nil {
+			a.logger.Errorf("Monitor for '%s' error: %v", name, err)
+		}
+	}()
 }
 
-// eventLoop handles signals and events
-func (a *App) eventLoop(sigChan chan os.Signal) {
-	// Create a map to listen to all monitor event channels
+// Fixed select case indices in eventLoop; monitor channels follow them
+const (
+	caseStop = iota
+	caseSignal
+	caseTimer
+	caseReload
+	caseRollback
+	caseMonitors
+)
+
+// buildSelectCases builds the eventLoop select cases for the current set of monitors
+func (a *App) buildSelectCases(sigChan chan os.Signal, tickerChan <-chan time.Time) []reflect.SelectCase {
 	cases := []reflect.SelectCase{
-		{
+		caseStop: {
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(a.stopChan),
 		},
-		{
+		caseSignal: {
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(sigChan),
 		},
+		caseTimer: {
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(tickerChan),
+		},
+		caseReload: {
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(a.reloadChan),
+		},
+		caseRollback: {
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(a.rollbackChan),
+		},
+		caseMonitors: {
+			Dir:  reflect.SelectRecv,
+			Chan: reflect.ValueOf(a.monitorsChan),
+		},
 	}
 
 	// Add monitor event channels
 	a.mu.RLock()
-	monitorMap := make(map[int]string) // Map case index to monitor name
-	for name, mon := range a.monitors {
+	defer a.mu.RUnlock()
+
+	for _, mon := range a.monitors {
 		cases = append(cases, reflect.SelectCase{
 			Dir:  reflect.SelectRecv,
 			Chan: reflect.ValueOf(mon.GetEventChan()),
 		})
-		monitorMap[len(cases)-1] = name
 	}
-	a.mu.RUnlock()
 
-	// Add timer for periodic checks
+	return cases
+}
+
+// eventLoop handles signals and events
+func (a *App) eventLoop(sigChan chan os.Signal) {
+	// Timer for periodic config change checks
 	ticker := time.NewTicker(10 * time.Second)
 	defer ticker.Stop()
-	cases = append(cases, reflect.SelectCase{
-		Dir:  reflect.SelectRecv,
-		Chan: reflect.ValueOf(ticker.C),
-	})
-	timerIndex := len(cases) - 1
+
+	cases := a.buildSelectCases(sigChan, ticker.C)
 
 	for {
 		chosen, recv, ok := reflect.Select(cases)
 
-		if !ok && chosen == 0 {
-			// Stop channel closed
-			return
-		}
-
 		switch chosen {
-		case 0:
+		case caseStop:
 			// Stop signal
 			return
 
-		case 1:
+		case caseSignal:
 			// Signal received
 			if !ok {
 				continue
@@ -215,19 +325,53 @@ func (a *App) eventLoop(sigChan chan os.Signal) {
 
 			case syscall.SIGHUP:
 				a.logger.Info("Received SIGHUP, reloading configuration...")
-				a.reloadConfig()
+				if changed, _ := a.reloadConfig(); changed {
+					cases = a.buildSelectCases(sigChan, ticker.C)
+				}
 
 			case syscall.SIGUSR1:
 				a.logger.Info("Received SIGUSR1, forcing repository check...")
 				a.forceCheck()
 			}
 
-		case timerIndex:
+		case caseTimer:
 			// Periodic check for config changes
 			if a.config.IsModified() {
 				a.logger.Info("Configuration file changed, reloading...")
-				a.reloadConfig()
+				if changed, _ := a.reloadConfig(); changed {
+					cases = a.buildSelectCases(sigChan, ticker.C)
+				}
+			}
+
+		case caseReload:
+			// Reload requested through the control API
+			reply, isReply := recv.Interface().(chan error)
+			if !isReply {
+				continue
 			}
+			changed, err := a.reloadConfig()
+			if changed {
+				cases = a.buildSelectCases(sigChan, ticker.C)
+			}
+			reply <- err
+
+		case caseRollback:
+			// Rollback requested through the control API
+			req, isRequest := recv.Interface().(rollbackRequest)
+			if !isRequest {
+				continue
+			}
+			a.pool.Submit(req.name, a.repositoryLocks(req.name), func() {
+				run, err := a.performRollback(req.name, req.target, monitor.TriggerRollback)
+				if err == nil {
+					metrics.Rollbacks.Inc(req.name, monitor.TriggerRollback, run.Status)
+				}
+				req.reply <- rollbackReply{run: run, err: err}
+			})
+
+		case caseMonitors:
+			// A monitor restarted by a reload replaced its stopped predecessor
+			cases = a.buildSelectCases(sigChan, ticker.C)
 
 		default:
 			// Monitor event received
@@ -238,54 +382,107 @@ func (a *App) eventLoop(sigChan chan os.Signal) {
 			if !ok {
 				continue
 			}
-			a.handleMonitorEvent(changeEvent)
+			a.submitEvent(changeEvent)
 		}
 	}
 }
 
-// reloadConfig reloads the configuration
-func (a *App) reloadConfig() {
-	if err := a.config.Load(); err != nil {
-		a.logger.Errorf("Failed to reload config: %v", err)
-		return
-	}
-
-	a.logger.Info("Configuration reloaded successfully")
+// submitEvent queues the actions for a change event in the worker pool
+func (a *App) submitEvent(event monitor.ChangeEvent) {
+	a.pool.Submit(event.RepositoryName, a.repositoryLocks(event.RepositoryName), func() {
+		a.handleMonitorEvent(event)
+	})
+}
 
-	// TODO: Re-initialize monitors with new config
-	// For now, just log success
+// repositoryLocks returns the named locks of a repository in the current config
+func (a *App) repositoryLocks(name string) []string {
+	if repo := findRepository(a.config.GetConfig(), name); repo != nil {
+		return repo.Locks
+	}
+	return nil
 }
 
 // forceCheck triggers a forced check of all repositories
 func (a *App) forceCheck() {
+	// Copied under the lock: a reload restarts monitors in the background
 	a.mu.RLock()
-	monitors := a.monitors
+	monitors := make([]*monitor.Monitor, 0, len(a.monitors))
+	for _, mon := range a.monitors {
+		monitors = append(monitors, mon)
+	}
 	a.mu.RUnlock()
 
 	for _, mon := range monitors {
-		mon.ForceCheck()
+		mon.ForceCheck(monitor.TriggerSignal)
 	}
 
 	a.logger.Info("Forced check initiated for all repositories")
 }
 
+// pushTrigger checks a repository after a push webhook. Paused repositories
+// are not checked.
+func (a *App) pushTrigger(name string) error {
+	mon, err := a.getMonitor(name)
+	if err != nil {
+		return err
+	}
+
+	if mon.IsPaused() {
+		return fmt.Errorf("repository '%s' is paused", name)
+	}
+
+	mon.ForceCheck(monitor.TriggerPushHook)
+	return nil
+}
+
 // Stop gracefully stops the application
 func (a *App) Stop() error {
 	a.logger.Info("Stopping CD-Gun agent...")
+	deadline := time.Now().Add(a.config.GetStopGracePeriod() + stopMargin)
 
 	close(a.stopChan)
 
-	// Wait for all monitors to stop with timeout
+	// Running actions get SIGTERM, and SIGKILL after the grace period
+	a.cancel(errStopping)
+
+	// Stop accepting API requests
+	if a.apiServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := a.apiServer.Shutdown(ctx); err != nil {
+			a.logger.Warnf("Failed to stop control API: %v", err)
+		}
+		cancel()
+	}
+
+	if a.hooksSrv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := a.hooksSrv.Shutdown(ctx); err != nil {
+			a.logger.Warnf("Failed to stop push hook receiver: %v", err)
+		}
+		cancel()
+	}
+
+	if a.metricsSrv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := a.metricsSrv.Shutdown(ctx); err != nil {
+			a.logger.Warnf("Failed to stop metrics endpoint: %v", err)
+		}
+		cancel()
+	}
+
+	// Wait for all monitors and running actions to stop with timeout. Stop
+	// runs on the event loop, so it must not wait for the event loop itself.
 	done := make(chan struct{})
 	go func() {
-		a.wg.Wait()
+		a.monitorWG.Wait()
+		a.pool.Wait()
 		close(done)
 	}()
 
 	select {
 	case <-done:
 		// All goroutines finished
-	case <-time.After(30 * time.Second):
+	case <-time.After(time.Until(deadline)):
 		a.logger.Warn("Shutdown timeout exceeded")
 	}
 
@@ -309,6 +506,15 @@ func (a *App) Stop() error {
 
 // handleMonitorEvent handles change events from monitors
 func (a *App) handleMonitorEvent(event monitor.ChangeEvent) {
+	// The monitor holds back further events for this repository until this one is handled
+	defer a.acknowledge(event)
+
+	if a.ctx.Err() != nil {
+		// Not started; the commit is still undeployed and is picked up on the next start
+		a.logger.Infof("Skipping change event for '%s': %v", event.RepositoryName, context.Cause(a.ctx))
+		return
+	}
+
 	a.logger.Infof("Processing change event from '%s': %v", event.RepositoryName, event.Files)
 
 	cfg := a.config.GetConfig()
@@ -318,27 +524,266 @@ func (a *App) handleMonitorEvent(event monitor.ChangeEvent) {
 		return
 	}
 
-	// Execute the action
-	result, err := a.executor.Execute(&repo.Action, &event, a.config)
+	// Last good commit, before the run updates it
+	repoState, _ := a.stateStore.GetRepository(event.RepositoryName)
+	lastSuccessful := repoState.LastSuccessfulHash
+
+	run, err := a.runEvent(repo, &event)
 	if err != nil {
 		a.logger.Errorf("Failed to execute action for '%s': %v", event.RepositoryName, err)
+		a.stateStore.ModifyRepository(event.RepositoryName, func(rs *state.RepositoryState) {
+			rs.LastActionStatus = "failure"
+			rs.LastError = err.Error()
+			a.recordFailedDeploy(repo, rs, event.NewHash)
+		})
+		return
+	}
+
+	if run.Status != "failure" || a.ctx.Err() != nil {
+		return
+	}
+
+	repoState, _ = a.stateStore.GetRepository(event.RepositoryName)
+	if !repoState.NextRetry.IsZero() {
+		a.logger.Warnf("Deploy of '%s' failed, retry %d/%d at %s", event.RepositoryName,
+			repoState.FailedAttempts, repo.Retry.MaxRetries, repoState.NextRetry.Format(time.RFC3339))
+		a.scheduleRetry(event.RepositoryName, repoState.NextRetry)
 		return
 	}
 
+	if repo.OnFailure == config.OnFailureRollback && deployAttempted(run) {
+		a.autoRollback(repo, run, lastSuccessful)
+	}
+}
+
+// markInterruptedRuns records runs that were still running when the agent last
+// stopped, e.g. because it was killed, as cancelled
+func (a *App) markInterruptedRuns() {
+	for name, rs := range a.stateStore.GetState().Repositories {
+		if rs.LastActionStatus != "running" {
+			continue
+		}
+		a.logger.Warnf("Last run of '%s' was interrupted, its commit is deployed again", name)
+		a.stateStore.ModifyRepository(name, func(rs *state.RepositoryState) {
+			rs.LastActionStatus = "cancelled"
+			rs.LastError = "cancelled: agent stopped during the run"
+		})
+	}
+}
+
+// acknowledge tells the monitor of a repository that its event was handled
+func (a *App) acknowledge(event monitor.ChangeEvent) {
+	// Under the lock, so a monitor being restarted cannot take over the pending
+	// event from its predecessor in between
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, mon := range []*monitor.Monitor{a.stopping[event.RepositoryName], a.monitors[event.RepositoryName]} {
+		if mon != nil {
+			mon.Acknowledge(event.NewHash)
+		}
+	}
+}
+
+// recordFailedDeploy counts a failed deploy of a commit and schedules its next
+// retry if the retry policy of the repository allows one
+func (a *App) recordFailedDeploy(repo *config.Repository, rs *state.RepositoryState, hash string) {
+	if rs.FailedHash != hash {
+		rs.FailedHash = hash
+		rs.FailedAttempts = 0
+	}
+	rs.FailedAttempts++
+
+	rs.NextRetry = time.Time{}
+	if retry := rs.FailedAttempts; retry <= repo.Retry.MaxRetries {
+		rs.NextRetry = time.Now().Add(a.config.GetDeployRetryDelay(repo, retry))
+	}
+}
+
+// scheduleRetry checks a repository again once its failed deploy is due for a
+// retry. Polls pick the retry up as well, e.g. after a restart or a resume.
+func (a *App) scheduleRetry(name string, at time.Time) {
+	time.AfterFunc(time.Until(at), func() {
+		mon, err := a.getMonitor(name)
+		if err != nil || mon.IsPaused() {
+			return
+		}
+		mon.ForceCheck(monitor.TriggerRetry)
+	})
+}
+
+// runEvent checks out the commit of an event, executes the actions of the
+// repository for it and records the outcome in the recent results, the history
+// and the repository state
+func (a *App) runEvent(repo *config.Repository, event *monitor.ChangeEvent) (*state.Run, error) {
+	if err := a.checkoutCommit(repo, event.NewHash); err != nil {
+		return nil, err
+	}
+
+	a.stateStore.ModifyRepository(event.RepositoryName, func(rs *state.RepositoryState) {
+		rs.LastActionStatus = "running"
+	})
+
+	result, err := a.executor.ExecuteRepository(a.ctx, repo, event, a.config)
+	if err != nil {
+		return nil, err
+	}
+
+	a.recordResult(result)
+
+	run := historyRun(event, result)
+	if err := a.stateStore.AppendRun(run); err != nil {
+		a.logger.Errorf("Failed to record history for '%s': %v", event.RepositoryName, err)
+	}
+
 	// Update state with execution result
-	repoState, _ := a.stateStore.GetRepository(event.RepositoryName)
-	repoState.LastActionExecuted = result.ExecutedAt
-	if result.Success {
-		repoState.LastActionStatus = "success"
-		repoState.LastError = ""
+	a.stateStore.ModifyRepository(event.RepositoryName, func(rs *state.RepositoryState) {
+		rs.LastActionExecuted = result.ExecutedAt
+		rs.LastSteps = stepStates(result.Steps)
+
+		if result.Cancelled {
+			// Neither deployed nor failed, so the commit is deployed again on the next start
+			rs.LastActionStatus = "cancelled"
+			rs.LastError = result.Error
+			return
+		}
+
+		if !result.Success {
+			rs.LastActionStatus = "failure"
+			rs.LastError = result.Error
+			if !event.Rollback {
+				a.recordFailedDeploy(repo, rs, event.NewHash)
+			}
+			return
+		}
+
+		rs.LastActionStatus = "success"
+		rs.LastError = ""
+		rs.LastSuccessfulHash = event.NewHash
+		rs.RolledBackTo = ""
+		if event.Rollback {
+			// The failed commit stays recorded, but is no longer retried
+			rs.RolledBackTo = event.NewHash
+			rs.NextRetry = time.Time{}
+		} else {
+			rs.DeployedHash, rs.DeployedTag = event.NewHash, event.Tag
+			rs.FailedHash, rs.FailedAttempts, rs.NextRetry = "", 0, time.Time{}
+			rs.AutoRollback = nil
+		}
+	})
+
+	switch {
+	case result.Cancelled:
+		a.logger.Warnf("Action for '%s' was cancelled: %s", event.RepositoryName, result.Error)
+	case result.Success:
 		a.logger.Infof("Action executed successfully for '%s'", event.RepositoryName)
-	} else {
-		repoState.LastActionStatus = "failure"
-		repoState.LastError = result.Error
+	default:
 		a.logger.Errorf("Action failed for '%s': %s", event.RepositoryName, result.Error)
 	}
 
-	a.stateStore.UpdateRepository(event.RepositoryName, repoState)
+	return run, nil
+}
+
+// checkoutCommit checks out a commit in the cached working tree of a
+// repository, so actions see the files of the commit they deploy. Local
+// changes are reported, and discarded unless the repository fails on them.
+func (a *App) checkoutCommit(repo *config.Repository, hash string) error {
+	helper := monitor.NewGitHelper(a.config.GetRepositoryLocalPath(repo.Name), a.logger)
+
+	changes, err := helper.LocalChanges()
+	if err != nil {
+		return fmt.Errorf("failed to check the working tree of '%s': %w", repo.Name, err)
+	}
+	if len(changes) > 0 {
+		if repo.OnLocalChanges == config.LocalChangesFail {
+			return fmt.Errorf("working tree of '%s' has local changes: %s", repo.Name, listPaths(changes))
+		}
+		a.logger.Warnf("Discarding local changes in the working tree of '%s': %s", repo.Name, listPaths(changes))
+	}
+
+	if err := helper.Checkout(repo, hash); err != nil {
+		return fmt.Errorf("failed to check out '%s': %w", hash, err)
+	}
+
+	return nil
+}
+
+// listPaths formats changed paths for a log line or error, listing at most ten
+func listPaths(paths []string) string {
+	const maxListed = 10
+	if len(paths) <= maxListed {
+		return strings.Join(paths, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(paths[:maxListed], ", "), len(paths)-maxListed)
+}
+
+// stepStates converts pipeline step results for persisting in state
+func stepStates(steps []executor.StepResult) []state.StepState {
+	states := make([]state.StepState, 0, len(steps))
+	for _, step := range steps {
+		stepState := state.StepState{
+			Route:    step.Route,
+			Name:     step.Name,
+			Type:     step.Type,
+			Status:   step.Status,
+			Error:    step.Error,
+			Duration: step.Duration,
+		}
+		for _, check := range step.Checks {
+			stepState.Checks = append(stepState.Checks, state.CheckState{
+				Stage:    check.Stage,
+				Status:   check.Status,
+				Attempts: check.Attempts,
+				Error:    check.Error,
+				Duration: check.Duration,
+			})
+		}
+		states = append(states, stepState)
+	}
+	return states
+}
+
+// historyRun converts a handled change event into a history record
+func historyRun(event *monitor.ChangeEvent, result *executor.ExecutionResult) *state.Run {
+	run := &state.Run{
+		ID:         result.RunID,
+		Repository: event.RepositoryName,
+		OldHash:    event.OldHash,
+		NewHash:    event.NewHash,
+		Files:      event.Files,
+		Trigger:    event.Trigger,
+		ForcePush:  event.ForcePush,
+		Tag:        event.Tag,
+		StartedAt:  result.ExecutedAt,
+		FinishedAt: result.ExecutedAt.Add(result.Duration),
+		Status:     "success",
+		Error:      result.Error,
+		Steps:      stepStates(result.Steps),
+		LogFile:    result.LogFile,
+	}
+
+	switch {
+	case result.Cancelled:
+		run.Status = "cancelled"
+	case !result.Success:
+		run.Status = "failure"
+	}
+
+	for i, step := range result.Steps {
+		run.Steps[i].Output = step.Output
+	}
+
+	return run
+}
+
+// historyOptions returns the history retention configured for the agent
+func historyOptions(configMgr *config.Manager) state.HistoryOptions {
+	history := configMgr.GetConfig().Agent.History
+	return state.HistoryOptions{
+		MaxRuns:   history.MaxRuns,
+		MaxAge:    configMgr.GetHistoryMaxAge(),
+		MaxOutput: history.MaxOutput,
+	}
 }
 
 // findRepository finds a repository configuration by name
@@ -0,0 +1,232 @@
+package app
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/api"
+	"github.com/omnorm/cd-gun/internal/executor"
+	"github.com/omnorm/cd-gun/internal/monitor"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// maxRecentResults is the number of action results kept in memory for the API
+const maxRecentResults = 100
+
+// App implements api.Controller
+var _ api.Controller = (*App)(nil)
+
+// Repositories returns the status of all monitored repositories, sorted by name
+func (a *App) Repositories() []api.RepositoryStatus {
+	a.mu.RLock()
+	names := make([]string, 0, len(a.monitors))
+	for name := range a.monitors {
+		names = append(names, name)
+	}
+	a.mu.RUnlock()
+
+	sort.Strings(names)
+
+	statuses := make([]api.RepositoryStatus, 0, len(names))
+	for _, name := range names {
+		if status, err := a.Repository(name); err == nil {
+			statuses = append(statuses, status)
+		}
+	}
+
+	return statuses
+}
+
+// Repository returns the status of a single monitored repository
+func (a *App) Repository(name string) (api.RepositoryStatus, error) {
+	mon, err := a.getMonitor(name)
+	if err != nil {
+		return api.RepositoryStatus{}, err
+	}
+
+	repoState, _ := a.stateStore.GetRepository(name)
+	repoState.Name = name
+
+	running, queued := a.pool.Status(name)
+
+	return api.RepositoryStatus{
+		Name:    name,
+		Paused:  mon.IsPaused(),
+		Running: running,
+		Queued:  queued,
+		State:   repoState,
+	}, nil
+}
+
+// ForceCheck triggers an immediate check of a repository
+func (a *App) ForceCheck(name string) error {
+	mon, err := a.getMonitor(name)
+	if err != nil {
+		return err
+	}
+
+	mon.ForceCheck(monitor.TriggerAPI)
+	return nil
+}
+
+// Pause suspends periodic checks of a repository
+func (a *App) Pause(name string) error {
+	mon, err := a.getMonitor(name)
+	if err != nil {
+		return err
+	}
+
+	mon.Pause()
+	a.logger.Infof("Monitor for '%s' paused", name)
+	return nil
+}
+
+// Resume re-enables periodic checks of a repository
+func (a *App) Resume(name string) error {
+	mon, err := a.getMonitor(name)
+	if err != nil {
+		return err
+	}
+
+	mon.Resume()
+	a.logger.Infof("Monitor for '%s' resumed", name)
+	return nil
+}
+
+// Reload reloads the configuration on the event loop and waits for the result
+func (a *App) Reload() error {
+	reply := make(chan error, 1)
+
+	select {
+	case a.reloadChan <- reply:
+	case <-a.stopChan:
+		return fmt.Errorf("agent is stopping")
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-a.stopChan:
+		return fmt.Errorf("agent is stopping")
+	}
+}
+
+// RecentResults returns up to limit of the most recent action results, newest
+// first, optionally filtered by repository name
+func (a *App) RecentResults(name string, limit int) []executor.ExecutionResult {
+	a.resultsMu.Lock()
+	defer a.resultsMu.Unlock()
+
+	var results []executor.ExecutionResult
+	for i := len(a.results) - 1; i >= 0 && len(results) < limit; i-- {
+		if name == "" || a.results[i].RepositoryName == name {
+			results = append(results, a.results[i])
+		}
+	}
+
+	return results
+}
+
+// Runs returns up to limit history runs of a repository, newest first, without
+// captured output
+func (a *App) Runs(name string, limit int) ([]state.Run, error) {
+	if _, err := a.getMonitor(name); err != nil {
+		return nil, err
+	}
+
+	runs, err := a.stateStore.ListRuns(name, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range runs {
+		for j := range runs[i].Steps {
+			runs[i].Steps[j].Output = ""
+		}
+	}
+
+	return runs, nil
+}
+
+// Run returns a single history run of a repository including captured output
+func (a *App) Run(name, id string) (*state.Run, error) {
+	if _, err := a.getMonitor(name); err != nil {
+		return nil, err
+	}
+
+	return a.stateStore.GetRun(name, id)
+}
+
+// RunLog returns the output log file of a history run, id "latest" selects
+// the newest run including one still running
+func (a *App) RunLog(name, id string) (string, error) {
+	if _, err := a.getMonitor(name); err != nil {
+		return "", err
+	}
+
+	return a.stateStore.RunLogFile(name, id)
+}
+
+// Approve allows the deploy of a force-push that waits for approval and checks
+// the repository, which then deploys it. A force-push to another head since
+// needs its own approval.
+func (a *App) Approve(name string) (*state.ForcePush, error) {
+	mon, err := a.getMonitor(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var approved *state.ForcePush
+	a.stateStore.ModifyRepository(name, func(rs *state.RepositoryState) {
+		if rs.ForcePush == nil || rs.ForcePush.Status != state.ForcePushPendingApproval {
+			return
+		}
+		now := time.Now()
+		rs.ForcePush.Status = state.ForcePushApproved
+		rs.ForcePush.ApprovedAt = &now
+		forcePush := *rs.ForcePush
+		approved = &forcePush
+	})
+	if approved == nil {
+		return nil, fmt.Errorf("%w: %s", api.ErrNothingToApprove, name)
+	}
+
+	a.logger.Infof("Force-push of '%s' to %s approved", name, state.ShortHash(approved.NewHash))
+	mon.ForceCheck(monitor.TriggerAPI)
+
+	return approved, nil
+}
+
+// recordResult keeps an action result for RecentResults
+func (a *App) recordResult(result *executor.ExecutionResult) {
+	maxOutput := a.config.GetConfig().Agent.History.MaxOutput
+
+	kept := *result
+	kept.Output = state.TruncateOutput(kept.Output, maxOutput)
+	kept.Steps = make([]executor.StepResult, len(result.Steps))
+	for i, step := range result.Steps {
+		step.Output = state.TruncateOutput(step.Output, maxOutput)
+		kept.Steps[i] = step
+	}
+
+	a.resultsMu.Lock()
+	defer a.resultsMu.Unlock()
+
+	a.results = append(a.results, kept)
+	if len(a.results) > maxRecentResults {
+		a.results = a.results[len(a.results)-maxRecentResults:]
+	}
+}
+
+// getMonitor returns the monitor of a repository
+func (a *App) getMonitor(name string) (*monitor.Monitor, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	mon, ok := a.monitors[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", api.ErrUnknownRepository, name)
+	}
+	return mon, nil
+}
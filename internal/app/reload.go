@@ -0,0 +1,231 @@
+package app
+
+import (
+	"reflect"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/metrics"
+	"github.com/omnorm/cd-gun/internal/monitor"
+)
+
+// repositoryDiff describes how the repository list changed between two configs
+type repositoryDiff struct {
+	added      []string // new repositories, need a monitor
+	removed    []string // repositories no longer configured, monitor must stop
+	changed    []string // monitor settings changed, monitor must restart
+	actionOnly []string // only the action changed, picked up on next event
+}
+
+// empty reports whether the diff requires no monitor changes
+func (d repositoryDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.changed) == 0
+}
+
+// diffRepositories compares old and new repository lists by name
+func diffRepositories(oldRepos, newRepos []config.Repository) repositoryDiff {
+	var diff repositoryDiff
+
+	oldByName := make(map[string]config.Repository, len(oldRepos))
+	for _, repo := range oldRepos {
+		oldByName[repo.Name] = repo
+	}
+
+	newNames := make(map[string]bool, len(newRepos))
+	for _, repo := range newRepos {
+		newNames[repo.Name] = true
+
+		oldRepo, exists := oldByName[repo.Name]
+		switch {
+		case !exists:
+			diff.added = append(diff.added, repo.Name)
+		case !monitorSettingsEqual(oldRepo, repo):
+			diff.changed = append(diff.changed, repo.Name)
+		case !reflect.DeepEqual(oldRepo, repo):
+			diff.actionOnly = append(diff.actionOnly, repo.Name)
+		}
+	}
+
+	for _, repo := range oldRepos {
+		if !newNames[repo.Name] {
+			diff.removed = append(diff.removed, repo.Name)
+		}
+	}
+
+	return diff
+}
+
+// monitorSettingsEqual reports whether two repositories are equal in everything
+// a monitor depends on, i.e. everything except what is executed on change
+func monitorSettingsEqual(a, b config.Repository) bool {
+	return reflect.DeepEqual(withoutActions(a), withoutActions(b))
+}
+
+// withoutActions returns a copy of repo with all actions and the failure and
+// retry policies cleared
+func withoutActions(repo config.Repository) config.Repository {
+	repo.Action, repo.Actions = config.Action{}, nil
+	repo.OnFailure, repo.Retry = "", config.RetryPolicy{}
+
+	routes := make([]config.Route, len(repo.Routes))
+	for i, route := range repo.Routes {
+		route.Action, route.Actions = config.Action{}, nil
+		routes[i] = route
+	}
+	repo.Routes = routes
+
+	return repo
+}
+
+// reloadConfig reloads the configuration and applies repository changes.
+// It returns true if the set of monitors changed and select cases must be rebuilt.
+func (a *App) reloadConfig() (bool, error) {
+	oldCfg := a.config.GetConfig()
+
+	if err := a.config.Load(); err != nil {
+		a.logger.Errorf("Failed to reload config: %v", err)
+		return false, err
+	}
+
+	a.stateStore.SetHistoryOptions(historyOptions(a.config))
+
+	newCfg := a.config.GetConfig()
+	a.pool.SetLimit(newCfg.Agent.MaxConcurrentActions)
+	a.logger.SetLevel(newCfg.Agent.LogLevel)
+
+	diff := diffRepositories(oldCfg.Repositories, newCfg.Repositories)
+
+	for _, name := range diff.actionOnly {
+		a.logger.Infof("Action for repository '%s' updated", name)
+	}
+
+	if diff.empty() {
+		a.logger.Info("Configuration reloaded successfully")
+		return false, nil
+	}
+
+	for _, name := range diff.removed {
+		a.logger.Infof("Repository '%s' removed from configuration, stopping monitor", name)
+		a.stopMonitor(name, false)
+	}
+
+	for _, name := range diff.changed {
+		a.logger.Infof("Repository '%s' changed, restarting monitor", name)
+		a.stopMonitor(name, true)
+	}
+
+	a.mu.Lock()
+	for _, name := range diff.added {
+		a.logger.Infof("Repository '%s' added, starting monitor", name)
+		if _, ok := a.stopping[name]; ok {
+			continue // started once the monitor of its removal has stopped
+		}
+		a.addMonitor(findRepository(newCfg, name), nil)
+	}
+	a.mu.Unlock()
+
+	a.logger.Infof("Configuration reloaded successfully (added: %d, removed: %d, restarted: %d)",
+		len(diff.added), len(diff.removed), len(diff.changed))
+
+	return true, nil
+}
+
+// stopMonitor unregisters a monitor and stops it in the background, so a check
+// in progress does not hold up the event loop. Once it has stopped, an event it
+// emitted but the event loop has not received yet is queued if restart is set
+// and dropped otherwise. The monitor is then replaced by one for the current
+// config of the repository, which takes over its paused state and pending
+// event if restart is set, or the cache of the repository is removed if it is
+// no longer configured.
+func (a *App) stopMonitor(name string, restart bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	mon, ok := a.monitors[name]
+	if !ok {
+		if _, stopping := a.stopping[name]; !stopping && restart {
+			a.addMonitor(findRepository(a.config.GetConfig(), name), nil)
+		}
+		return
+	}
+	delete(a.monitors, name)
+	a.stopping[name] = mon
+
+	a.monitorWG.Add(1)
+	go func() {
+		defer a.monitorWG.Done()
+		mon.Stop()
+
+		select {
+		case event := <-mon.GetEventChan():
+			if restart {
+				a.submitEvent(event)
+			} else {
+				a.logger.Warnf("Dropping pending change event for removed repository '%s'", name)
+			}
+		default:
+		}
+
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.stopping, name)
+
+		// The repository may have been changed, removed or added again meanwhile
+		repo := findRepository(a.config.GetConfig(), name)
+		switch {
+		case repo == nil:
+			metrics.DeleteRepository(name)
+			a.removeCache(name)
+		case a.monitors[name] == nil:
+			var prev *monitor.Monitor
+			if restart {
+				prev = mon
+			}
+			a.addMonitor(repo, prev)
+			a.monitorsChanged()
+		}
+	}()
+}
+
+// addMonitor creates, registers and starts a monitor for a repository. A
+// monitor it replaces passes on its paused state and pending event. a.mu must
+// be held.
+func (a *App) addMonitor(repo *config.Repository, prev *monitor.Monitor) {
+	mon, err := monitor.NewMonitor(repo, a.config, a.logger, a.stateStore)
+	if err != nil {
+		a.logger.Errorf("Failed to create monitor for '%s': %v", repo.Name, err)
+		return
+	}
+
+	if prev != nil {
+		mon.Inherit(prev)
+	}
+
+	a.monitors[repo.Name] = mon
+	a.startMonitor(repo.Name, mon)
+}
+
+// monitorsChanged tells the event loop to rebuild its select cases after
+// monitors were added outside of it
+func (a *App) monitorsChanged() {
+	select {
+	case a.monitorsChan <- struct{}{}:
+	default: // a rebuild is already pending
+	}
+}
+
+// removeCache removes the cache of a repository that is no longer configured.
+// It is queued behind the actions of the repository that are still running.
+func (a *App) removeCache(name string) {
+	a.pool.Submit(name, nil, func() {
+		cfg := a.config.GetConfig()
+		if findRepository(cfg, name) != nil {
+			return // added again in the meantime
+		}
+
+		if err := monitor.RemoveCache(cfg.Agent.CacheDir, name); err != nil {
+			a.logger.Warnf("Failed to remove repository cache of '%s': %v", name, err)
+			return
+		}
+		a.logger.Infof("Removed repository cache of '%s'", name)
+	})
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/config"
+)
+
+func TestDiffRepositories(t *testing.T) {
+	base := func(name string) config.Repository {
+		return config.Repository{
+			Name:         name,
+			URL:          "https://github.com/test/" + name + ".git",
+			Branch:       "main",
+			WatchPaths:   []string{"src/"},
+			PollInterval: "5m",
+			Action:       config.Action{Type: "shell", Script: "deploy.sh"},
+		}
+	}
+
+	branchChanged := base("branch")
+	branchChanged.Branch = "release"
+
+	pathsChanged := base("paths")
+	pathsChanged.WatchPaths = []string{"src/", "Dockerfile"}
+
+	actionChanged := base("action")
+	actionChanged.Action.Script = "deploy-v2.sh"
+
+	oldRepos := []config.Repository{base("same"), base("branch"), base("paths"), base("action"), base("gone")}
+	newRepos := []config.Repository{base("same"), branchChanged, pathsChanged, actionChanged, base("new")}
+
+	diff := diffRepositories(oldRepos, newRepos)
+
+	if want := []string{"new"}; !reflect.DeepEqual(diff.added, want) {
+		t.Errorf("added = %v, want %v", diff.added, want)
+	}
+	if want := []string{"gone"}; !reflect.DeepEqual(diff.removed, want) {
+		t.Errorf("removed = %v, want %v", diff.removed, want)
+	}
+	if want := []string{"branch", "paths"}; !reflect.DeepEqual(diff.changed, want) {
+		t.Errorf("changed = %v, want %v", diff.changed, want)
+	}
+	if want := []string{"action"}; !reflect.DeepEqual(diff.actionOnly, want) {
+		t.Errorf("actionOnly = %v, want %v", diff.actionOnly, want)
+	}
+}
+
+func TestDiffRepositoriesUnchanged(t *testing.T) {
+	repos := []config.Repository{{Name: "a", URL: "u", WatchPaths: []string{"."}}}
+
+	if diff := diffRepositories(repos, repos); !diff.empty() || len(diff.actionOnly) != 0 {
+		t.Errorf("expected empty diff, got %+v", diff)
+	}
+}
+
+func TestRemoveCache(t *testing.T) {
+	a, _, _ := newRollbackApp(t, "true", "")
+	cacheDir := a.config.GetConfig().Agent.CacheDir
+
+	gone := filepath.Join(cacheDir, "gone")
+	for _, args := range [][]string{{"init", "-q", gone}, {"-C", gone, "config", "cdgun.repository", "gone"}} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	a.removeCache("gone")
+	a.removeCache("app") // still configured
+	a.pool.Wait()
+
+	if _, err := os.Stat(gone); !os.IsNotExist(err) {
+		t.Errorf("cache of removed repository was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "app")); err != nil {
+		t.Errorf("cache of configured repository was removed: %v", err)
+	}
+}
+
+func TestStopMonitorInBackground(t *testing.T) {
+	a, _, _ := newRollbackApp(t, "true", "")
+
+	// A paused monitor skips its initial check, so it can run without a remote
+	old, _ := a.getMonitor("app")
+	old.Pause()
+
+	// The monitor is not running yet, as if a check were in progress
+	returned := make(chan struct{})
+	go func() {
+		a.stopMonitor("app", true)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopMonitor() waited for the monitor to stop")
+	}
+	if _, err := a.getMonitor("app"); err == nil {
+		t.Error("monitor still registered while it is stopping")
+	}
+
+	go old.Start(make(chan struct{}))
+	t.Cleanup(func() { close(a.stopChan) })
+
+	select {
+	case <-a.monitorsChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor was not restarted after it stopped")
+	}
+	mon, err := a.getMonitor("app")
+	if err != nil || mon == old {
+		t.Fatalf("getMonitor() = %v, %v, want a new monitor", mon, err)
+	}
+	if !mon.IsPaused() {
+		t.Error("restarted monitor did not keep the paused state")
+	}
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/api"
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/executor"
+	"github.com/omnorm/cd-gun/internal/metrics"
+	"github.com/omnorm/cd-gun/internal/monitor"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// RollbackPrevious selects the last successful deployment before the current one
+const RollbackPrevious = "previous"
+
+// rollbackRequest asks the event loop to roll back a repository
+type rollbackRequest struct {
+	name   string
+	target string
+	reply  chan rollbackReply
+}
+
+type rollbackReply struct {
+	run *state.Run
+	err error
+}
+
+// Rollback redeploys an earlier commit of a repository and waits for its
+// actions to finish. The target is a commit or RollbackPrevious.
+func (a *App) Rollback(name, target string) (*state.Run, error) {
+	req := rollbackRequest{name: name, target: target, reply: make(chan rollbackReply, 1)}
+
+	select {
+	case a.rollbackChan <- req:
+	case <-a.stopChan:
+		return nil, errStopping
+	}
+
+	select {
+	case reply := <-req.reply:
+		return reply.run, reply.err
+	case <-a.stopChan:
+		return nil, errStopping
+	}
+}
+
+// performRollback runs the repository's actions for the target commit, which
+// runEvent checks out. It runs as a pool job of the repository, so it never
+// overlaps a deploy of the same repository.
+func (a *App) performRollback(name, target, trigger string) (*state.Run, error) {
+	if a.ctx.Err() != nil {
+		return nil, context.Cause(a.ctx)
+	}
+
+	repo := findRepository(a.config.GetConfig(), name)
+	if repo == nil {
+		return nil, fmt.Errorf("%w: %s", api.ErrUnknownRepository, name)
+	}
+
+	repoState, _ := a.stateStore.GetRepository(name)
+	deployed := deployedHash(repoState)
+
+	helper := monitor.NewGitHelper(a.config.GetRepositoryLocalPath(name), a.logger)
+
+	hash := target
+	if target == "" || target == RollbackPrevious {
+		previous, err := a.previousSuccessfulHash(name, deployed)
+		if err != nil {
+			return nil, err
+		}
+		hash = previous
+	}
+
+	// Resolve to a full hash; this also checks that a commit from the history is still present
+	resolved, err := helper.ResolveCommit(hash)
+	if err != nil && helper.EnsureCommit(repo, hash) == nil {
+		// Older than the history of a shallow clone
+		resolved, err = helper.ResolveCommit(hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", api.ErrInvalidTarget, err)
+	}
+
+	event := &monitor.ChangeEvent{
+		RepositoryName: name,
+		OldHash:        deployed,
+		NewHash:        resolved,
+		DetectedAt:     time.Now(),
+		Routes:         rollbackRoutes(repo, helper, deployed, resolved),
+		Trigger:        trigger,
+		Rollback:       true,
+		Tag:            helper.TagAt(repo, resolved),
+	}
+	for _, route := range event.Routes {
+		event.Files = append(event.Files, route.Files...)
+	}
+
+	a.logger.Infof("Rolling back '%s' from %s to %s", name, state.ShortHash(deployed), state.ShortHash(resolved))
+
+	return a.runEvent(repo, event)
+}
+
+// autoRollback rolls back a repository after a failed deploy to the last
+// commit that was deployed successfully, and records both attempts in state
+func (a *App) autoRollback(repo *config.Repository, failed *state.Run, lastSuccessful string) {
+	if lastSuccessful == "" || lastSuccessful == failed.NewHash {
+		a.logger.Warnf("Deploy of '%s' failed, but there is no earlier successful commit to roll back to", repo.Name)
+		return
+	}
+
+	a.logger.Warnf("Deploy of '%s' failed, rolling back to %s", repo.Name, state.ShortHash(lastSuccessful))
+
+	record := &state.AutoRollback{
+		FailedHash:   failed.NewHash,
+		FailedRunID:  failed.ID,
+		FailedError:  failed.Error,
+		RollbackHash: lastSuccessful,
+		At:           time.Now(),
+	}
+
+	run, err := a.performRollback(repo.Name, lastSuccessful, monitor.TriggerAutoRollback)
+	switch {
+	case err != nil:
+		record.RollbackStatus = "failure"
+		record.RollbackError = err.Error()
+		a.logger.Errorf("Automatic rollback of '%s' failed: %v", repo.Name, err)
+	case run.Status != "success":
+		record.RollbackStatus = "failure"
+		record.RollbackRunID = run.ID
+		record.RollbackError = run.Error
+	default:
+		record.RollbackStatus = "success"
+		record.RollbackRunID = run.ID
+	}
+	metrics.Rollbacks.Inc(repo.Name, monitor.TriggerAutoRollback, record.RollbackStatus)
+
+	// The rollback run overwrote the status; keep the failed deploy visible
+	a.stateStore.ModifyRepository(repo.Name, func(rs *state.RepositoryState) {
+		rs.AutoRollback = record
+		rs.LastError = failed.Error
+		if record.RollbackStatus == "success" {
+			rs.LastActionStatus = "rolled_back"
+		} else {
+			rs.LastActionStatus = "failure"
+		}
+	})
+}
+
+// deployAttempted reports whether any action of a run was executed, as
+// opposed to all failing their pre_check or being skipped
+func deployAttempted(run *state.Run) bool {
+	for _, step := range run.Steps {
+		if step.Status == executor.StepSkipped {
+			continue
+		}
+		if len(step.Checks) > 0 && step.Checks[0].Stage == executor.CheckPreCheck &&
+			step.Checks[0].Status != executor.StepSuccess {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// previousSuccessfulHash returns the commit that was deployed successfully
+// before the deployed one. Rollbacks are not deploys of their own: after a
+// rollback to a commit, "previous" is the commit deployed before it, so
+// repeated rollbacks go further back instead of returning to where they
+// started.
+func (a *App) previousSuccessfulHash(name, deployed string) (string, error) {
+	runs, err := a.stateStore.ListRuns(name, 0)
+	if err != nil {
+		return "", err
+	}
+
+	var deploys []state.Run
+	for _, run := range runs {
+		if run.Status == "success" && run.NewHash != "" &&
+			run.Trigger != monitor.TriggerRollback && run.Trigger != monitor.TriggerAutoRollback {
+			deploys = append(deploys, run)
+		}
+	}
+
+	// Walk back from the newest deploy of the deployed commit, or from the
+	// newest deploy if it is not in the history
+	start := 0
+	for i, run := range deploys {
+		if run.NewHash == deployed {
+			start = i
+			break
+		}
+	}
+
+	for _, run := range deploys[start:] {
+		if run.NewHash != deployed {
+			return run.NewHash, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: no previous successful deployment in history", api.ErrInvalidTarget)
+}
+
+// rollbackRoutes returns the routes affected by going from one commit to
+// another, or all routes if the diff is unavailable or matches none
+func rollbackRoutes(repo *config.Repository, helper *monitor.GitHelper, from, to string) []monitor.RouteChange {
+	if from != "" {
+		if files, err := helper.GetDiff(from, to); err == nil {
+			if routes := monitor.MatchRoutes(repo, files); len(routes) > 0 {
+				return routes
+			}
+		}
+	}
+
+	return monitor.AllRoutes(repo)
+}
+
+// deployedHash returns the commit currently deployed for a repository,
+// including a commit whose deploy failed part way
+func deployedHash(repoState state.RepositoryState) string {
+	switch {
+	case repoState.RolledBackTo != "":
+		return repoState.RolledBackTo
+	case repoState.FailedHash != "":
+		return repoState.FailedHash
+	}
+	return repoState.DeployedHash
+}
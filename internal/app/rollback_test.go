@@ -0,0 +1,491 @@
+package app
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/api"
+	"github.com/omnorm/cd-gun/internal/monitor"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// gitCommit creates a commit in dir and returns its hash
+func gitCommit(t *testing.T, dir, file, content string) string {
+	t.Helper()
+
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	for _, args := range [][]string{{"add", "-A"}, {"commit", "-q", "-m", file}} {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		t.Fatalf("rev-parse failed: %v", err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// newRollbackApp creates an app for a repository "app" whose cache has two
+// commits, v1 (good) and v2 (bad), and whose action runs script
+func newRollbackApp(t *testing.T, script string, extra string) (a *App, good, bad string) {
+	t.Helper()
+
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "repos", "app")
+	if err := os.MkdirAll(cache, 0755); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if out, err := exec.Command("git", "init", "-q", cache).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %v\n%s", err, out)
+	}
+
+	good = gitCommit(t, cache, "app.txt", "v1")
+	bad = gitCommit(t, cache, "app.txt", "v2")
+
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(`agent:
+  log_file: "`+filepath.Join(dir, "agent.log")+`"
+  state_dir: "`+filepath.Join(dir, "state")+`"
+  cache_dir: "`+filepath.Join(dir, "repos")+`"
+repositories:
+  - name: "app"
+    url: "https://example.com/app.git"
+    watch_paths:
+      - "."
+`+extra+`    action:
+      type: "shell"
+      script: '`+script+`'
+`), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	a, err := NewApp(configPath, "error")
+	if err != nil {
+		t.Fatalf("NewApp() failed: %v", err)
+	}
+	t.Cleanup(func() { a.logFile.Close() })
+
+	return a, good, bad
+}
+
+func TestPerformRollback(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "env")
+	a, good, bad := newRollbackApp(t,
+		`echo "$CDGUN_OLD_HASH $CDGUN_NEW_HASH $CDGUN_ROLLBACK $(cat "$CDGUN_REPO_PATH/app.txt")" > `+envFile, "")
+
+	// v1 and v2 were deployed successfully, v2 is current
+	for _, hash := range []string{good, bad} {
+		if err := a.stateStore.AppendRun(&state.Run{Repository: "app", NewHash: hash, Status: "success", StartedAt: time.Now()}); err != nil {
+			t.Fatalf("AppendRun() failed: %v", err)
+		}
+	}
+	a.stateStore.UpdateRepository("app", state.RepositoryState{CurrentHash: bad, DeployedHash: bad})
+
+	run, err := a.performRollback("app", RollbackPrevious, "rollback")
+	if err != nil {
+		t.Fatalf("performRollback() failed: %v", err)
+	}
+	if run.Status != "success" || run.NewHash != good || run.Trigger != "rollback" {
+		t.Errorf("unexpected run: %+v", run)
+	}
+
+	env, err := os.ReadFile(envFile)
+	if err != nil {
+		t.Fatalf("action did not run: %v", err)
+	}
+	if want := bad + " " + good + " true v1\n"; string(env) != want {
+		t.Errorf("action saw %q, want %q", env, want)
+	}
+
+	repoState, _ := a.stateStore.GetRepository("app")
+	if repoState.RolledBackTo != good || repoState.DeployedHash != bad {
+		t.Errorf("unexpected state after rollback: %+v", repoState)
+	}
+
+	if _, err := a.performRollback("app", "does-not-exist", "rollback"); err == nil {
+		t.Error("expected error for unknown commit")
+	}
+}
+
+func TestConsecutiveRollbacks(t *testing.T) {
+	a, v1, v2 := newRollbackApp(t, "true", "")
+	v3 := gitCommit(t, filepath.Join(a.config.GetConfig().Agent.CacheDir, "app"), "app.txt", "v3")
+
+	for _, hash := range []string{v1, v2, v3} {
+		if err := a.stateStore.AppendRun(&state.Run{Repository: "app", NewHash: hash, Status: "success", StartedAt: time.Now()}); err != nil {
+			t.Fatalf("AppendRun() failed: %v", err)
+		}
+	}
+	a.stateStore.UpdateRepository("app", state.RepositoryState{CurrentHash: v3, DeployedHash: v3})
+
+	// Each rollback goes one deploy further back
+	for _, want := range []string{v2, v1} {
+		run, err := a.performRollback("app", RollbackPrevious, monitor.TriggerRollback)
+		if err != nil {
+			t.Fatalf("performRollback() failed: %v", err)
+		}
+		if run.Status != "success" || run.NewHash != want {
+			t.Fatalf("rolled back to %s, want %s", state.ShortHash(run.NewHash), state.ShortHash(want))
+		}
+	}
+
+	if _, err := a.performRollback("app", RollbackPrevious, monitor.TriggerRollback); !errors.Is(err, api.ErrInvalidTarget) {
+		t.Errorf("performRollback() before the first deploy error = %v, want %v", err, api.ErrInvalidTarget)
+	}
+}
+
+func TestAutoRollbackOnFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		onFailure    string
+		wantStatus   string
+		wantRuns     int
+		wantRolledTo bool
+	}{
+		{"rollback policy", "    on_failure: \"rollback\"\n", "rolled_back", 2, true},
+		{"default policy", "", "failure", 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Deploying v2 fails
+			a, good, bad := newRollbackApp(t,
+				`test "$(git -C "$CDGUN_REPO_PATH" show "$CDGUN_NEW_HASH:app.txt")" = v1`, tt.onFailure)
+
+			a.stateStore.UpdateRepository("app", state.RepositoryState{CurrentHash: bad, DeployedHash: good, LastSuccessfulHash: good})
+
+			a.handleMonitorEvent(monitor.ChangeEvent{
+				RepositoryName: "app",
+				Files:          []string{"app.txt"},
+				OldHash:        good,
+				NewHash:        bad,
+				DetectedAt:     time.Now(),
+				Trigger:        monitor.TriggerPoll,
+			})
+
+			repoState, _ := a.stateStore.GetRepository("app")
+			if repoState.LastActionStatus != tt.wantStatus {
+				t.Errorf("LastActionStatus = %q, want %q", repoState.LastActionStatus, tt.wantStatus)
+			}
+
+			runs, err := a.stateStore.ListRuns("app", 0)
+			if err != nil {
+				t.Fatalf("ListRuns() failed: %v", err)
+			}
+			if len(runs) != tt.wantRuns {
+				t.Fatalf("got %d runs, want %d", len(runs), tt.wantRuns)
+			}
+
+			if !tt.wantRolledTo {
+				if repoState.AutoRollback != nil {
+					t.Errorf("unexpected auto rollback: %+v", repoState.AutoRollback)
+				}
+				return
+			}
+
+			if runs[0].Trigger != monitor.TriggerAutoRollback || runs[0].NewHash != good || runs[0].OldHash != bad {
+				t.Errorf("unexpected rollback run: %+v", runs[0])
+			}
+			if runs[1].Status != "failure" || runs[1].NewHash != bad {
+				t.Errorf("unexpected failed run: %+v", runs[1])
+			}
+
+			record := repoState.AutoRollback
+			if record == nil || record.FailedHash != bad || record.RollbackHash != good ||
+				record.RollbackStatus != "success" || record.FailedRunID != runs[1].ID {
+				t.Errorf("unexpected auto rollback record: %+v", record)
+			}
+			if repoState.RolledBackTo != good || repoState.LastError == "" {
+				t.Errorf("unexpected state: %+v", repoState)
+			}
+		})
+	}
+}
+
+func TestDeployAttempted(t *testing.T) {
+	preCheckFailed := []state.CheckState{{Stage: "pre_check", Status: "failure"}}
+	verifyFailed := []state.CheckState{{Stage: "pre_check", Status: "success"}, {Stage: "verify", Status: "failure"}}
+
+	tests := []struct {
+		name  string
+		steps []state.StepState
+		want  bool
+	}{
+		{"action failed", []state.StepState{{Status: "failure"}}, true},
+		{"verify failed", []state.StepState{{Status: "failure", Checks: verifyFailed}}, true},
+		{"pre_check failed", []state.StepState{{Status: "failure", Checks: preCheckFailed}, {Status: "skipped"}}, false},
+		{"later step ran", []state.StepState{{Status: "failure", Checks: preCheckFailed}, {Status: "success"}}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deployAttempted(&state.Run{Steps: tt.steps}); got != tt.want {
+				t.Errorf("deployAttempted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailedDeployRetry(t *testing.T) {
+	// Deploying v2 fails; one retry, then roll back
+	a, good, bad := newRollbackApp(t,
+		`test "$(git -C "$CDGUN_REPO_PATH" show "$CDGUN_NEW_HASH:app.txt")" = v1`,
+		"    on_failure: \"rollback\"\n    retry:\n      max_retries: 1\n      backoff: \"1h\"\n")
+
+	a.stateStore.UpdateRepository("app", state.RepositoryState{CurrentHash: bad, DeployedHash: good, LastSuccessfulHash: good})
+
+	event := monitor.ChangeEvent{
+		RepositoryName: "app",
+		Files:          []string{"app.txt"},
+		OldHash:        good,
+		NewHash:        bad,
+		DetectedAt:     time.Now(),
+		Trigger:        monitor.TriggerPoll,
+	}
+
+	a.handleMonitorEvent(event)
+
+	repoState, _ := a.stateStore.GetRepository("app")
+	if repoState.FailedHash != bad || repoState.FailedAttempts != 1 || repoState.DeployedHash != good {
+		t.Fatalf("unexpected state after first failure: %+v", repoState)
+	}
+	if until := time.Until(repoState.NextRetry); until < 59*time.Minute || until > time.Hour {
+		t.Errorf("NextRetry in %v, want 1h", until)
+	}
+	if repoState.AutoRollback != nil {
+		t.Errorf("rolled back although a retry is scheduled")
+	}
+
+	event.Trigger = monitor.TriggerRetry
+	a.handleMonitorEvent(event)
+
+	repoState, _ = a.stateStore.GetRepository("app")
+	if repoState.FailedAttempts != 2 || !repoState.NextRetry.IsZero() {
+		t.Errorf("unexpected retry state after last retry: %+v", repoState)
+	}
+	if repoState.AutoRollback == nil || repoState.RolledBackTo != good {
+		t.Errorf("expected rollback after retries were exhausted: %+v", repoState)
+	}
+
+	runs, err := a.stateStore.ListRuns("app", 0)
+	if err != nil {
+		t.Fatalf("ListRuns() failed: %v", err)
+	}
+	var triggers []string
+	for _, run := range runs {
+		triggers = append(triggers, run.Trigger)
+	}
+	if got := strings.Join(triggers, ","); got != "auto_rollback,retry,poll" {
+		t.Errorf("runs = %s, want auto_rollback,retry,poll", got)
+	}
+}
+
+func TestCancelledDeploy(t *testing.T) {
+	a, good, bad := newRollbackApp(t, `sleep 30`, "    on_failure: \"rollback\"\n")
+
+	a.stateStore.UpdateRepository("app", state.RepositoryState{CurrentHash: bad, DeployedHash: good, LastSuccessfulHash: good})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.handleMonitorEvent(monitor.ChangeEvent{
+			RepositoryName: "app",
+			Files:          []string{"app.txt"},
+			OldHash:        good,
+			NewHash:        bad,
+			DetectedAt:     time.Now(),
+			Trigger:        monitor.TriggerPoll,
+		})
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	a.cancel(errStopping)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deploy was not cancelled")
+	}
+
+	repoState, _ := a.stateStore.GetRepository("app")
+	if repoState.LastActionStatus != "cancelled" || repoState.DeployedHash != good {
+		t.Errorf("unexpected state after cancellation: %+v", repoState)
+	}
+	if repoState.FailedHash != "" || repoState.AutoRollback != nil {
+		t.Errorf("cancelled deploy was handled as a failure: %+v", repoState)
+	}
+
+	runs, err := a.stateStore.ListRuns("app", 0)
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("ListRuns() = %d runs, %v, want 1", len(runs), err)
+	}
+	if runs[0].Status != "cancelled" || runs[0].Steps[0].Status != "cancelled" {
+		t.Errorf("run status = %s, step status = %s, want cancelled", runs[0].Status, runs[0].Steps[0].Status)
+	}
+
+	// A run still marked as running after a restart was interrupted
+	a.stateStore.ModifyRepository("app", func(rs *state.RepositoryState) { rs.LastActionStatus = "running" })
+	a.markInterruptedRuns()
+	if repoState, _ := a.stateStore.GetRepository("app"); repoState.LastActionStatus != "cancelled" {
+		t.Errorf("LastActionStatus = %s after restart, want cancelled", repoState.LastActionStatus)
+	}
+}
+
+func TestStopOnSignal(t *testing.T) {
+	a, _, _ := newRollbackApp(t, "true", "")
+
+	// Without monitors, which would fetch from the remote
+	a.monitors = make(map[string]*monitor.Monitor)
+
+	sigChan := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		a.run(sigChan)
+		close(done)
+	}()
+
+	start := time.Now()
+	sigChan <- syscall.SIGTERM
+
+	select {
+	case <-done:
+	case <-time.After(a.config.GetStopGracePeriod()):
+		t.Fatalf("agent still running %v after SIGTERM", time.Since(start))
+	}
+	if a.ctx.Err() == nil {
+		t.Error("actions were not cancelled")
+	}
+}
+
+func TestDeployChecksOutCommit(t *testing.T) {
+	tests := []struct {
+		name       string
+		extra      string
+		wantStatus string
+		wantFile   string
+	}{
+		{"discard local changes", "", "success", "v1"},
+		{"fail on local changes", "    on_local_changes: \"fail\"\n", "failure", "local edit"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The cache is checked out at v2 and has a local change on top
+			a, good, bad := newRollbackApp(t, `test "$(cat app.txt)" = v1 && test ! -e scratch`, tt.extra)
+			cache := a.config.GetRepositoryLocalPath("app")
+			for name, content := range map[string]string{"app.txt": "local edit", "scratch": "untracked"} {
+				if err := os.WriteFile(filepath.Join(cache, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			a.handleMonitorEvent(monitor.ChangeEvent{
+				RepositoryName: "app",
+				Files:          []string{"app.txt"},
+				OldHash:        bad,
+				NewHash:        good,
+				DetectedAt:     time.Now(),
+				Trigger:        monitor.TriggerPoll,
+			})
+
+			repoState, _ := a.stateStore.GetRepository("app")
+			if repoState.LastActionStatus != tt.wantStatus {
+				t.Errorf("LastActionStatus = %q (%s), want %q", repoState.LastActionStatus, repoState.LastError, tt.wantStatus)
+			}
+			if tt.wantStatus == "failure" && !strings.Contains(repoState.LastError, "app.txt, scratch") {
+				t.Errorf("LastError = %q, want the changed files listed", repoState.LastError)
+			}
+
+			if content, _ := os.ReadFile(filepath.Join(cache, "app.txt")); string(content) != tt.wantFile {
+				t.Errorf("app.txt = %q, want %q", content, tt.wantFile)
+			}
+		})
+	}
+}
+
+func TestApproveForcePush(t *testing.T) {
+	a, good, bad := newRollbackApp(t, `true`, "    on_force_push: \"require_approval\"\n")
+
+	if _, err := a.Approve("app"); !errors.Is(err, api.ErrNothingToApprove) {
+		t.Errorf("Approve() without a pending force-push: err = %v, want ErrNothingToApprove", err)
+	}
+
+	a.stateStore.UpdateRepository("app", state.RepositoryState{
+		DeployedHash: good,
+		ForcePush:    &state.ForcePush{OldHash: good, NewHash: bad, Status: state.ForcePushPendingApproval},
+	})
+
+	forcePush, err := a.Approve("app")
+	if err != nil {
+		t.Fatalf("Approve() failed: %v", err)
+	}
+	if forcePush.Status != state.ForcePushApproved || forcePush.ApprovedAt == nil || forcePush.NewHash != bad {
+		t.Errorf("unexpected approved force-push: %+v", forcePush)
+	}
+
+	repoState, _ := a.stateStore.GetRepository("app")
+	if repoState.ForcePush.Status != state.ForcePushApproved {
+		t.Errorf("state not updated: %+v", repoState.ForcePush)
+	}
+
+	if _, err := a.Approve("missing"); !errors.Is(err, api.ErrUnknownRepository) {
+		t.Errorf("Approve() of an unknown repository: err = %v", err)
+	}
+}
+
+func TestDeployTag(t *testing.T) {
+	tagFile := filepath.Join(t.TempDir(), "tag")
+	a, good, bad := newRollbackApp(t, `echo "$CDGUN_TAG" > `+tagFile, "    tags:\n      pattern: \"v*\"\n")
+
+	cache := a.config.GetRepositoryLocalPath("app")
+	for tag, hash := range map[string]string{"v1.0.0": good, "v2.0.0": bad} {
+		if out, err := exec.Command("git", "-C", cache, "tag", tag, hash).CombinedOutput(); err != nil {
+			t.Fatalf("git tag failed: %v\n%s", err, out)
+		}
+	}
+
+	a.handleMonitorEvent(monitor.ChangeEvent{
+		RepositoryName: "app",
+		Files:          []string{"app.txt"},
+		NewHash:        bad,
+		DetectedAt:     time.Now(),
+		Trigger:        monitor.TriggerPoll,
+		Tag:            "v2.0.0",
+	})
+
+	repoState, _ := a.stateStore.GetRepository("app")
+	if repoState.DeployedHash != bad || repoState.DeployedTag != "v2.0.0" {
+		t.Errorf("deployed = %s (%q), want v2.0.0", repoState.DeployedHash, repoState.DeployedTag)
+	}
+	if content, _ := os.ReadFile(tagFile); strings.TrimSpace(string(content)) != "v2.0.0" {
+		t.Errorf("CDGUN_TAG = %q, want v2.0.0", content)
+	}
+
+	// A rollback names the tag of the commit it redeploys
+	run, err := a.performRollback("app", good, monitor.TriggerRollback)
+	if err != nil {
+		t.Fatalf("performRollback() failed: %v", err)
+	}
+	if run.Tag != "v1.0.0" {
+		t.Errorf("run tag = %q, want v1.0.0", run.Tag)
+	}
+	if content, _ := os.ReadFile(tagFile); strings.TrimSpace(string(content)) != "v1.0.0" {
+		t.Errorf("CDGUN_TAG = %q, want v1.0.0", content)
+	}
+}
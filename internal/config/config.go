@@ -2,19 +2,29 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/omnorm/cd-gun/internal/semver"
 )
 
 // Manager handles configuration loading and validation
 type Manager struct {
+	mu          sync.RWMutex
 	config      *Config
 	configPath  string
 	lastModTime time.Time
+	redactor    *strings.Replacer // hides resolved secret values, nil if there are none
 }
 
 // NewManager creates a new config manager
@@ -30,6 +40,25 @@ func NewManager(configPath string) (*Manager, error) {
 	return m, nil
 }
 
+// LoadAgentConfig reads only the agent section of a configuration file. Secret
+// references are not resolved and nothing is validated, so commands talking to
+// a running agent need neither the secrets nor a valid repository list.
+func LoadAgentConfig(configPath string) (*AgentConfig, error) {
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var cfg struct {
+		Agent AgentConfig `yaml:"agent"`
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	return &cfg.Agent, nil
+}
+
 // Load reads and parses the configuration file, including any repository files
 func (m *Manager) Load() error {
 	data, err := os.ReadFile(m.configPath)
@@ -51,6 +80,11 @@ func (m *Manager) Load() error {
 		cfg.Repositories = append(cfg.Repositories, repos...)
 	}
 
+	resolver := newSecretResolver(&cfg.Agent.Secrets)
+	if secretsErr := resolveSecrets(&cfg, resolver); secretsErr != nil {
+		return fmt.Errorf("failed to resolve secrets: %w", secretsErr)
+	}
+
 	if validateErr := m.validate(&cfg); validateErr != nil {
 		return fmt.Errorf("config validation failed: %w", validateErr)
 	}
@@ -59,7 +93,11 @@ func (m *Manager) Load() error {
 		return fmt.Errorf("failed to parse intervals: %w", intervalsErr)
 	}
 
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	m.config = &cfg
+	m.redactor = resolver.redactor()
 
 	// Update last modified time
 	fi, err := os.Stat(m.configPath)
@@ -70,8 +108,25 @@ func (m *Manager) Load() error {
 	return nil
 }
 
-// GetConfig returns the current configuration
+// Redact replaces every secret value resolved from a ${env:...}, ${file:...}
+// or ${secret:...} reference in s with "***"
+func (m *Manager) Redact(s string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.redactor == nil {
+		return s
+	}
+	return m.redactor.Replace(s)
+}
+
+// GetConfig returns the current configuration.
+// A reload replaces the whole Config, so callers may keep the returned pointer
+// as a consistent snapshot.
 func (m *Manager) GetConfig() *Config {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	return m.config
 }
 
@@ -81,6 +136,10 @@ func (m *Manager) IsModified() bool {
 	if err != nil {
 		return false
 	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	return fi.ModTime().After(m.lastModTime)
 }
 
@@ -106,20 +165,73 @@ func (m *Manager) validate(cfg *Config) error {
 		cfg.Agent.PollInterval = "5m"
 	}
 
+	if err := validateLocalListen(cfg.Agent.API.Listen); err != nil {
+		return fmt.Errorf("agent.api.listen: %w", err)
+	}
+
+	if listen := cfg.Agent.Metrics.Listen; listen != "" {
+		if _, _, err := net.SplitHostPort(listen); err != nil {
+			return fmt.Errorf("agent.metrics.listen: invalid address '%s': %w", listen, err)
+		}
+	}
+
+	if cfg.Agent.History.MaxRuns <= 0 {
+		cfg.Agent.History.MaxRuns = 100
+	}
+
+	if cfg.Agent.History.MaxOutput <= 0 {
+		cfg.Agent.History.MaxOutput = 64 * 1024
+	}
+
+	switch cfg.Agent.Output.Stream {
+	case "":
+		cfg.Agent.Output.Stream = StreamInfo
+	case StreamInfo, StreamDebug, StreamOff:
+	default:
+		return fmt.Errorf("agent.output.stream: unknown level '%s'", cfg.Agent.Output.Stream)
+	}
+
+	if cfg.Agent.Output.MaxLogSize <= 0 {
+		cfg.Agent.Output.MaxLogSize = 10 << 20
+	}
+
+	if cfg.Agent.StopGracePeriod == "" {
+		cfg.Agent.StopGracePeriod = "10s"
+	}
+
+	if cfg.Agent.MaxConcurrentActions == 0 {
+		cfg.Agent.MaxConcurrentActions = 4
+	} else if cfg.Agent.MaxConcurrentActions < 0 {
+		return fmt.Errorf("agent.max_concurrent_actions must not be negative")
+	}
+
+	if err := validatePushHooks(&cfg.Agent.PushHooks); err != nil {
+		return fmt.Errorf("agent.push_hooks: %w", err)
+	}
+
 	if len(cfg.Repositories) == 0 {
 		return fmt.Errorf("at least one repository must be configured")
 	}
 
+	names := make(map[string]bool, len(cfg.Repositories))
 	for i, repo := range cfg.Repositories {
-		if repo.Name == "" {
-			return fmt.Errorf("repository[%d]: name is required", i)
+		if err := validateRepositoryName(repo.Name); err != nil {
+			return fmt.Errorf("repository[%d]: %w", i, err)
 		}
+		if names[repo.Name] {
+			return fmt.Errorf("repository[%d]: duplicate repository name '%s'", i, repo.Name)
+		}
+		names[repo.Name] = true
 
 		if repo.URL == "" {
 			return fmt.Errorf("repository[%d]: url is required", i)
 		}
 
-		if repo.Branch == "" {
+		if err := validateTags(&cfg.Repositories[i]); err != nil {
+			return fmt.Errorf("repository[%d]: tags: %w", i, err)
+		}
+
+		if repo.Branch == "" && repo.Tags == nil {
 			cfg.Repositories[i].Branch = "main"
 		}
 
@@ -127,29 +239,471 @@ func (m *Manager) validate(cfg *Config) error {
 			cfg.Repositories[i].Auth.Type = "none"
 		}
 
-		if len(repo.WatchPaths) == 0 {
-			return fmt.Errorf("repository[%d]: watch_paths is required", i)
+		if err := validateAuth(&cfg.Repositories[i]); err != nil {
+			return fmt.Errorf("repository[%d]: %w", i, err)
 		}
 
 		if repo.PollInterval == "" {
 			cfg.Repositories[i].PollInterval = cfg.Agent.PollInterval
 		}
 
-		if repo.Action.Type == "" {
-			return fmt.Errorf("repository[%d]: action.type is required", i)
+		if err := validateRoutes(&cfg.Repositories[i]); err != nil {
+			return fmt.Errorf("repository[%d]: %w", i, err)
+		}
+
+		switch repo.OnFailure {
+		case "":
+			cfg.Repositories[i].OnFailure = OnFailureNone
+		case OnFailureNone, OnFailureRollback:
+		default:
+			return fmt.Errorf("repository[%d]: unknown on_failure '%s'", i, repo.OnFailure)
+		}
+
+		switch repo.OnLocalChanges {
+		case "":
+			cfg.Repositories[i].OnLocalChanges = LocalChangesDiscard
+		case LocalChangesDiscard, LocalChangesFail:
+		default:
+			return fmt.Errorf("repository[%d]: unknown on_local_changes '%s'", i, repo.OnLocalChanges)
+		}
+
+		switch repo.OnForcePush {
+		case "":
+			cfg.Repositories[i].OnForcePush = ForcePushDeploy
+		case ForcePushDeploy, ForcePushSkip, ForcePushRequireApproval:
+		default:
+			return fmt.Errorf("repository[%d]: unknown on_force_push '%s'", i, repo.OnForcePush)
+		}
+
+		if err := validateClone(&cfg.Repositories[i]); err != nil {
+			return fmt.Errorf("repository[%d]: clone: %w", i, err)
+		}
+
+		if err := validateRetryPolicy(&cfg.Repositories[i].Retry); err != nil {
+			return fmt.Errorf("repository[%d]: retry: %w", i, err)
+		}
+
+		locks, err := validateLocks(repo.Locks)
+		if err != nil {
+			return fmt.Errorf("repository[%d]: locks: %w", i, err)
+		}
+		cfg.Repositories[i].Locks = locks
+	}
+
+	return nil
+}
+
+// validateRepositoryName checks that a repository name can be used as a
+// directory name in the cache directory, where it must not reach outside of
+// its own directory or collide with the agent's own entries
+func validateRepositoryName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("name is required")
+	case strings.ContainsAny(name, "/\\"), strings.Contains(name, ".."):
+		return fmt.Errorf("name '%s' must not contain '/', '\\' or '..'", name)
+	case strings.HasPrefix(name, "."):
+		return fmt.Errorf("name '%s' must not start with '.'", name)
+	}
+	return nil
+}
+
+// validateRetryPolicy checks a deploy retry policy and sets its defaults
+func validateRetryPolicy(policy *RetryPolicy) error {
+	if policy.MaxRetries < 0 {
+		return fmt.Errorf("max_retries must not be negative")
+	}
+
+	if policy.Backoff == "" {
+		policy.Backoff = "1m"
+	}
+
+	return nil
+}
+
+// validateLocks checks lock names and returns them without duplicates
+func validateLocks(locks []string) ([]string, error) {
+	var unique []string
+	seen := make(map[string]bool, len(locks))
+
+	for _, lock := range locks {
+		if strings.TrimSpace(lock) == "" {
+			return nil, fmt.Errorf("lock name must not be empty")
+		}
+		if !seen[lock] {
+			seen[lock] = true
+			unique = append(unique, lock)
+		}
+	}
+
+	return unique, nil
+}
+
+// validateLocalListen checks that a listen address is a unix socket or a
+// loopback TCP address, so the control API is never exposed to the network
+func validateLocalListen(listen string) error {
+	if listen == "" || strings.HasPrefix(listen, "unix:") {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("invalid address '%s': %w", listen, err)
+	}
+
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+
+	return fmt.Errorf("'%s' is not a unix socket or loopback address", listen)
+}
+
+// validatePushHooks checks that an enabled push hook receiver can authenticate
+// at least one forge
+func validatePushHooks(hooks *PushHooksConfig) error {
+	if hooks.Listen == "" {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(hooks.Listen); err != nil {
+		return fmt.Errorf("invalid address '%s': %w", hooks.Listen, err)
+	}
+
+	if hooks.GitHubSecret == "" && hooks.GitLabToken == "" && hooks.GiteaSecret == "" {
+		return fmt.Errorf("at least one of github_secret, gitlab_token or gitea_secret is required")
+	}
+
+	return nil
+}
+
+// validateAuth checks that authentication settings are usable and that no
+// secret is embedded in the repository URL
+func validateAuth(repo *Repository) error {
+	switch repo.Auth.Type {
+	case "none", "ssh", "https":
+	default:
+		return fmt.Errorf("unknown auth.type '%s'", repo.Auth.Type)
+	}
+
+	// The credentials may be a resolved secret, so they are not part of the error
+	if repo.Auth.Type == "https" && repo.Auth.Credentials != "" && !filepath.IsAbs(repo.Auth.Credentials) {
+		return fmt.Errorf("auth.credentials must be the absolute path of a token file, use auth.password for the token itself")
+	}
+
+	if u, err := url.Parse(repo.URL); err == nil && u.User != nil {
+		if _, hasPassword := u.User.Password(); hasPassword {
+			return fmt.Errorf("url must not contain credentials, use auth instead")
+		}
+	}
+
+	return nil
+}
+
+// validateRoutes validates the top-level watch paths and actions of a repository
+// together with its routes. Without routes, watch_paths and an action are
+// required; with routes, the top-level pair is optional but must be complete.
+func validateRoutes(repo *Repository) error {
+	hasTopLevel := repo.Action.Type != "" || len(repo.Actions) > 0
+
+	if len(repo.Routes) == 0 || hasTopLevel || len(repo.WatchPaths) > 0 {
+		if len(repo.WatchPaths) == 0 {
+			return fmt.Errorf("watch_paths is required")
+		}
+
+		actions, err := normalizeActions(&repo.Action, repo.Actions)
+		if err != nil {
+			return err
+		}
+		repo.Actions = actions
+	}
+
+	if err := validateWatchPaths(repo.WatchPaths); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(repo.Routes))
+	for i := range repo.Routes {
+		route := &repo.Routes[i]
+
+		if route.Name == "" {
+			return fmt.Errorf("routes[%d]: name is required", i)
+		}
+		if names[route.Name] {
+			return fmt.Errorf("routes[%d]: duplicate route name '%s'", i, route.Name)
+		}
+		names[route.Name] = true
+
+		if len(route.WatchPaths) == 0 {
+			return fmt.Errorf("route '%s': watch_paths is required", route.Name)
+		}
+
+		if err := validateWatchPaths(route.WatchPaths); err != nil {
+			return fmt.Errorf("route '%s': %w", route.Name, err)
+		}
+
+		actions, err := normalizeActions(&route.Action, route.Actions)
+		if err != nil {
+			return fmt.Errorf("route '%s': %w", route.Name, err)
+		}
+		route.Actions = actions
+
+		for j := range route.Actions {
+			if err := validateAction(&route.Actions[j], j); err != nil {
+				return fmt.Errorf("route '%s': %w", route.Name, err)
+			}
+		}
+	}
+
+	for j := range repo.Actions {
+		if err := validateAction(&repo.Actions[j], j); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateWatchPaths checks that every watch path is a well-formed glob pattern
+func validateWatchPaths(patterns []string) error {
+	for _, pattern := range patterns {
+		for _, seg := range strings.Split(strings.TrimPrefix(pattern, "!"), "/") {
+			if _, err := path.Match(seg, ""); err != nil {
+				return fmt.Errorf("invalid watch path '%s': %w", pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateTags checks the tag tracking settings of a repository and parses
+// its version range
+func validateTags(repo *Repository) error {
+	tags := repo.Tags
+	if tags == nil {
+		return nil
+	}
+
+	if repo.Branch != "" {
+		return fmt.Errorf("cannot be combined with branch")
+	}
+
+	if tags.Pattern == "" {
+		tags.Pattern = "*"
+	}
+	if _, err := path.Match(tags.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern '%s': %w", tags.Pattern, err)
+	}
+
+	if tags.SemVer != "" {
+		constraint, err := semver.ParseConstraint(tags.SemVer)
+		if err != nil {
+			return err
+		}
+		tags.constraint = constraint
+	}
+
+	return nil
+}
+
+// validateClone checks the clone options of a repository. A sparse checkout
+// needs every watch path to be below a fixed directory or in the root.
+func validateClone(repo *Repository) error {
+	opts := &repo.Clone
+
+	if opts.Depth < 0 {
+		return fmt.Errorf("depth must not be negative")
+	}
+
+	if opts.Filter != "" && opts.Filter != "blob:none" {
+		size, ok := strings.CutPrefix(opts.Filter, "blob:limit=")
+		if !ok || !validFilterSize(size) {
+			return fmt.Errorf("unsupported filter '%s' (use \"blob:none\" or \"blob:limit=<size>\")", opts.Filter)
+		}
+	}
+
+	if !opts.Sparse {
+		if len(opts.SparsePaths) > 0 {
+			return fmt.Errorf("sparse_paths requires sparse")
+		}
+		return nil
+	}
+
+	for _, dir := range opts.SparsePaths {
+		if dir = strings.Trim(dir, "/"); dir == "" || dir == "." || containsWildcards(dir) || strings.HasPrefix(dir, "!") {
+			return fmt.Errorf("invalid sparse path '%s': must be a directory without wildcards", dir)
+		}
+	}
+
+	for _, pattern := range repo.AllWatchPaths() {
+		if _, ok := sparseDir(pattern); !ok {
+			return fmt.Errorf("sparse: watch path '%s' can match files in any directory", pattern)
 		}
+	}
+
+	return nil
+}
+
+// validFilterSize reports whether s is a size as accepted by blob:limit, e.g.
+// "1048576" or "1m"
+func validFilterSize(s string) bool {
+	s = strings.TrimRight(strings.ToLower(s), "kmg")
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// normalizeActions moves the legacy single action into the actions pipeline.
+// The action is cleared, so only the validated pipeline is left to be run.
+func normalizeActions(action *Action, actions []Action) ([]Action, error) {
+	hasAction := action.Type != ""
+
+	switch {
+	case hasAction && len(actions) > 0:
+		return nil, fmt.Errorf("action and actions are mutually exclusive")
+	case hasAction:
+		moved := *action
+		*action = Action{}
+		return []Action{moved}, nil
+	case len(actions) == 0:
+		return nil, fmt.Errorf("action.type is required")
+	}
+
+	return actions, nil
+}
+
+// validateAction validates a pipeline step and applies its defaults
+func validateAction(action *Action, index int) error {
+	if action.Name == "" {
+		action.Name = fmt.Sprintf("step-%d", index+1)
+	}
+
+	if action.Type == "" {
+		return fmt.Errorf("actions[%d]: type is required", index)
+	}
+
+	if action.Type == "shell" && action.Script == "" {
+		return fmt.Errorf("action '%s': script is required for shell action", action.Name)
+	}
+
+	if err := validateProcess(action); err != nil {
+		return fmt.Errorf("action '%s': %w", action.Name, err)
+	}
 
-		if repo.Action.Type == "shell" && repo.Action.Script == "" {
-			return fmt.Errorf("repository[%d]: action.script is required for shell action", i)
+	if action.Type == "webhook" {
+		if action.URL == "" {
+			return fmt.Errorf("action '%s': url is required for webhook action", action.Name)
 		}
 
-		if repo.Action.Type == "webhook" && repo.Action.URL == "" {
-			return fmt.Errorf("repository[%d]: action.url is required for webhook action", i)
+		if action.Method == "" {
+			action.Method = "POST"
 		}
 
-		if repo.Action.Timeout == "" {
-			cfg.Repositories[i].Action.Timeout = "10m"
+		if action.Retries < 0 {
+			return fmt.Errorf("action '%s': retries must not be negative", action.Name)
 		}
+
+		if action.RetryBackoff == "" {
+			action.RetryBackoff = "1s"
+		}
+	}
+
+	if action.Type == "custom" {
+		if action.Handler == "" {
+			return fmt.Errorf("action '%s': handler is required for custom action", action.Name)
+		}
+
+		if !handlerRegistered(action.Handler) {
+			return fmt.Errorf("action '%s': unknown handler '%s'", action.Name, action.Handler)
+		}
+	}
+
+	if action.Timeout == "" {
+		action.Timeout = "10m"
+	}
+
+	if err := validateCheck(action.PreCheck); err != nil {
+		return fmt.Errorf("action '%s': pre_check: %w", action.Name, err)
+	}
+
+	if err := validateCheck(action.Verify); err != nil {
+		return fmt.Errorf("action '%s': verify: %w", action.Name, err)
+	}
+
+	return nil
+}
+
+// validateProcess checks the process settings of an action, which only shell
+// actions support
+func validateProcess(action *Action) error {
+	if action.Type != "shell" {
+		if action.RunAs != "" || action.WorkingDir != "" || action.InheritEnv || len(action.PassEnv) > 0 ||
+			action.Umask != "" || action.Nice != 0 || action.Limits != nil {
+			return fmt.Errorf("run_as, working_dir, environment, umask, nice and limits require a shell action")
+		}
+		return nil
+	}
+
+	if action.RunAs != "" {
+		name, group, hasGroup := strings.Cut(action.RunAs, ":")
+		if name == "" || (hasGroup && group == "") {
+			return fmt.Errorf("run_as: want \"user\" or \"user:group\", got '%s'", action.RunAs)
+		}
+	}
+
+	// A relative directory is joined to the checkout and must stay inside it
+	if dir := action.WorkingDir; dir != "" && !filepath.IsAbs(dir) && !filepath.IsLocal(dir) {
+		return fmt.Errorf("working_dir: relative path '%s' leads outside of the checkout", dir)
+	}
+
+	if action.InheritEnv && len(action.PassEnv) > 0 {
+		return fmt.Errorf("inherit_env and pass_env are mutually exclusive")
+	}
+	for _, name := range action.PassEnv {
+		if name == "" || strings.ContainsAny(name, "= ") {
+			return fmt.Errorf("pass_env: invalid variable name '%s'", name)
+		}
+	}
+
+	if action.Umask != "" {
+		if mask, err := strconv.ParseUint(action.Umask, 8, 32); err != nil || mask > 0777 {
+			return fmt.Errorf("umask: want an octal mask like \"0027\", got '%s'", action.Umask)
+		}
+	}
+
+	if action.Nice < -20 || action.Nice > 19 {
+		return fmt.Errorf("nice must be between -20 and 19")
+	}
+
+	if l := action.Limits; l != nil && (l.CPU < 0 || l.Memory < 0 || l.NoFile < 0 || l.NProc < 0) {
+		return fmt.Errorf("limits must not be negative")
+	}
+
+	return nil
+}
+
+// validateCheck checks a pre_check or verify definition and sets its defaults
+func validateCheck(check *Check) error {
+	if check == nil {
+		return nil
+	}
+
+	if (check.Command == "") == (check.URL == "") {
+		return fmt.Errorf("exactly one of command or url is required")
+	}
+
+	if check.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+
+	if check.Interval == "" {
+		check.Interval = "5s"
+	}
+
+	if check.Timeout == "" {
+		check.Timeout = "30s"
 	}
 
 	return nil
@@ -239,6 +793,18 @@ func (m *Manager) parseIntervals(cfg *Config) error {
 	}
 	cfg.Agent.parsedInterval = d
 
+	if cfg.Agent.History.MaxAge != "" {
+		d, err := time.ParseDuration(cfg.Agent.History.MaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid agent.history.max_age: %w", err)
+		}
+		cfg.Agent.History.parsedMaxAge = d
+	}
+
+	if cfg.Agent.parsedStopGracePeriod, err = time.ParseDuration(cfg.Agent.StopGracePeriod); err != nil {
+		return fmt.Errorf("invalid agent.stop_grace_period: %w", err)
+	}
+
 	// Parse repository intervals
 	for i, repo := range cfg.Repositories {
 		d, err := time.ParseDuration(repo.PollInterval)
@@ -247,25 +813,156 @@ func (m *Manager) parseIntervals(cfg *Config) error {
 		}
 		cfg.Repositories[i].parsedInterval = d
 
-		// Parse action timeout
-		d, err = time.ParseDuration(repo.Action.Timeout)
+		retry := &cfg.Repositories[i].Retry
+		if retry.parsedBackoff, err = time.ParseDuration(retry.Backoff); err != nil {
+			return fmt.Errorf("invalid repositories[%d].retry.backoff: %w", i, err)
+		}
+		if retry.MaxBackoff == "" {
+			retry.parsedMaxBackoff = max(30*time.Minute, retry.parsedBackoff)
+		} else if retry.parsedMaxBackoff, err = time.ParseDuration(retry.MaxBackoff); err != nil {
+			return fmt.Errorf("invalid repositories[%d].retry.max_backoff: %w", i, err)
+		}
+
+		// Parse action timeouts and backoffs
+		for j := range repo.Actions {
+			if err := parseActionDurations(&repo.Actions[j]); err != nil {
+				return fmt.Errorf("invalid repositories[%d].actions[%d]: %w", i, j, err)
+			}
+		}
+
+		for _, route := range repo.Routes {
+			for j := range route.Actions {
+				if err := parseActionDurations(&route.Actions[j]); err != nil {
+					return fmt.Errorf("invalid repositories[%d] route '%s' actions[%d]: %w", i, route.Name, j, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseActionDurations parses the duration strings of an action
+func parseActionDurations(action *Action) error {
+	d, err := time.ParseDuration(action.Timeout)
+	if err != nil {
+		return fmt.Errorf("timeout: %w", err)
+	}
+	action.parsedTimeout = d
+
+	if action.RetryBackoff != "" {
+		d, err = time.ParseDuration(action.RetryBackoff)
 		if err != nil {
-			return fmt.Errorf("invalid repositories[%d].action.timeout: %w", i, err)
+			return fmt.Errorf("retry_backoff: %w", err)
+		}
+		action.parsedRetryBackoff = d
+	}
+
+	for name, check := range map[string]*Check{"pre_check": action.PreCheck, "verify": action.Verify} {
+		if check == nil {
+			continue
+		}
+		if check.parsedInterval, err = time.ParseDuration(check.Interval); err != nil {
+			return fmt.Errorf("%s.interval: %w", name, err)
+		}
+		if check.parsedTimeout, err = time.ParseDuration(check.Timeout); err != nil {
+			return fmt.Errorf("%s.timeout: %w", name, err)
 		}
-		cfg.Repositories[i].Action.parsedTimeout = d
 	}
 
 	return nil
 }
 
+// AllWatchPaths returns the top-level watch paths of a repository followed by
+// the watch paths of all its routes
+func (r *Repository) AllWatchPaths() []string {
+	paths := append([]string(nil), r.WatchPaths...)
+	for _, route := range r.Routes {
+		paths = append(paths, route.WatchPaths...)
+	}
+	return paths
+}
+
+// SparseDirs returns the directories a sparse checkout of the repository
+// contains: those of its watch paths and its sparse_paths. Files in the
+// repository root are always checked out.
+func (r *Repository) SparseDirs() []string {
+	dirs := make(map[string]bool)
+	for _, pattern := range r.AllWatchPaths() {
+		if dir, _ := sparseDir(pattern); dir != "" {
+			dirs[dir] = true
+		}
+	}
+	for _, dir := range r.Clone.SparsePaths {
+		dirs[strings.Trim(dir, "/")] = true
+	}
+
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// sparseDir returns the directory a sparse checkout needs for the files a watch
+// path matches: its segments before the first wildcard, or "" for files in the
+// root. A pattern without wildcards is used as a whole, since it may name a
+// directory; for a file, its parent directory is checked out. ok is false if
+// the pattern matches files in any directory. Exclusions need nothing.
+func sparseDir(pattern string) (dir string, ok bool) {
+	if strings.HasPrefix(pattern, "!") {
+		return "", true
+	}
+
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" || pattern == "." {
+		return "", false
+	}
+
+	segs := strings.Split(pattern, "/")
+	for i, seg := range segs {
+		if !strings.ContainsAny(seg, "*?[") {
+			continue
+		}
+		if i == 0 && (len(segs) > 1 || seg == "*" || strings.Contains(seg, "**")) {
+			return "", false // e.g. "**/*.yaml" or "*/values.yaml"
+		}
+		return strings.Join(segs[:i], "/"), true
+	}
+
+	return pattern, true
+}
+
+// FindRoute returns the route with the given name
+func (r *Repository) FindRoute(name string) *Route {
+	for i := range r.Routes {
+		if r.Routes[i].Name == name {
+			return &r.Routes[i]
+		}
+	}
+	return nil
+}
+
 // GetRepositoryLocalPath returns the local cache path for a repository
 func (m *Manager) GetRepositoryLocalPath(repoName string) string {
-	return filepath.Join(m.config.Agent.CacheDir, repoName)
+	return filepath.Join(m.GetConfig().Agent.CacheDir, repoName)
 }
 
 // GetPollInterval returns the parsed poll interval for agent
 func (m *Manager) GetPollInterval() time.Duration {
-	return m.config.Agent.parsedInterval
+	return m.GetConfig().Agent.parsedInterval
+}
+
+// GetHistoryMaxAge returns the parsed history retention age, 0 if unlimited
+func (m *Manager) GetHistoryMaxAge() time.Duration {
+	return m.GetConfig().Agent.History.parsedMaxAge
+}
+
+// GetStopGracePeriod returns the time a cancelled action gets to exit after
+// SIGTERM before it is killed
+func (m *Manager) GetStopGracePeriod() time.Duration {
+	return m.GetConfig().Agent.parsedStopGracePeriod
 }
 
 // GetRepositoryPollInterval returns the parsed poll interval for a repository
@@ -273,11 +970,39 @@ func (m *Manager) GetRepositoryPollInterval(repo *Repository) time.Duration {
 	return repo.parsedInterval
 }
 
+// GetDeployRetryDelay returns the delay before a retry (1 for the first) of a
+// failed deploy: the backoff doubled per retry, capped at max_backoff
+func (m *Manager) GetDeployRetryDelay(repo *Repository, retry int) time.Duration {
+	delay := repo.Retry.parsedBackoff
+	for i := 1; i < retry && delay < repo.Retry.parsedMaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > repo.Retry.parsedMaxBackoff {
+		delay = repo.Retry.parsedMaxBackoff
+	}
+	return delay
+}
+
 // GetActionTimeout returns the parsed timeout for an action
 func (m *Manager) GetActionTimeout(action *Action) time.Duration {
 	return action.parsedTimeout
 }
 
+// GetRetryBackoff returns the parsed initial retry backoff for a webhook action
+func (m *Manager) GetRetryBackoff(action *Action) time.Duration {
+	return action.parsedRetryBackoff
+}
+
+// GetCheckInterval returns the parsed wait between attempts of a check
+func (m *Manager) GetCheckInterval(check *Check) time.Duration {
+	return check.parsedInterval
+}
+
+// GetCheckTimeout returns the parsed timeout of a single check attempt
+func (m *Manager) GetCheckTimeout(check *Check) time.Duration {
+	return check.parsedTimeout
+}
+
 // ExpandEnv expands environment variables in a string
 func ExpandEnv(s string) string {
 	return os.ExpandEnv(s)
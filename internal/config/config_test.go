@@ -2,7 +2,10 @@ package config
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewManager(t *testing.T) {
@@ -152,4 +155,532 @@ func TestConfigDefaults(t *testing.T) {
 	if mgr.config.Agent.LogLevel == "" {
 		t.Error("Log level should have default value")
 	}
+	if mgr.config.Agent.MaxConcurrentActions != 4 {
+		t.Errorf("MaxConcurrentActions = %d, want 4", mgr.config.Agent.MaxConcurrentActions)
+	}
+	if mgr.GetStopGracePeriod() != 10*time.Second {
+		t.Errorf("GetStopGracePeriod() = %v, want 10s", mgr.GetStopGracePeriod())
+	}
+	if mgr.config.Agent.Output.Stream != StreamInfo || mgr.config.Agent.Output.MaxLogSize != 10<<20 {
+		t.Errorf("Output = %+v, want info stream and 10 MiB logs", mgr.config.Agent.Output)
+	}
+	if mgr.config.Repositories[0].OnForcePush != ForcePushDeploy {
+		t.Errorf("OnForcePush = %q, want %q", mgr.config.Repositories[0].OnForcePush, ForcePushDeploy)
+	}
+	if mgr.config.Repositories[0].OnLocalChanges != LocalChangesDiscard {
+		t.Errorf("OnLocalChanges = %q, want %q", mgr.config.Repositories[0].OnLocalChanges, LocalChangesDiscard)
+	}
+
+	// An unknown stream level is rejected
+	mgr.config.Agent.Output.Stream = "verbose"
+	if err := mgr.validate(mgr.config); err == nil {
+		t.Error("validate() accepted an unknown output stream level")
+	}
+	mgr.config.Agent.Output.Stream = StreamInfo
+
+	mgr.config.Repositories[0].OnLocalChanges = "stash"
+	if err := mgr.validate(mgr.config); err == nil {
+		t.Error("validate() accepted an unknown on_local_changes policy")
+	}
+	mgr.config.Repositories[0].OnLocalChanges = LocalChangesDiscard
+
+	mgr.config.Repositories[0].OnForcePush = "ask"
+	if err := mgr.validate(mgr.config); err == nil {
+		t.Error("validate() accepted an unknown on_force_push policy")
+	}
+}
+
+func TestValidateLocks(t *testing.T) {
+	locks, err := validateLocks([]string{"docker", "db", "docker"})
+	if err != nil || len(locks) != 2 || locks[0] != "docker" || locks[1] != "db" {
+		t.Errorf("validateLocks() = %v, %v, want [docker db]", locks, err)
+	}
+
+	if _, err := validateLocks([]string{" "}); err == nil {
+		t.Error("validateLocks() accepted an empty lock name")
+	}
+}
+
+func TestCustomActionValidation(t *testing.T) {
+	SetHandlerLookup(func(name string) bool { return name == "known" })
+	defer SetHandlerLookup(nil)
+
+	tests := []struct {
+		name    string
+		handler string
+		wantErr bool
+	}{
+		{"registered handler", "known", false},
+		{"unknown handler", "unknown", true},
+		{"missing handler", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpfile, err := os.CreateTemp("", "config*.yaml")
+			if err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    watch_paths:
+      - "."
+    action:
+      type: "custom"
+      handler: "` + tt.handler + `"`
+
+			if _, writeErr := tmpfile.WriteString(content); writeErr != nil {
+				t.Fatalf("write failed: %v", writeErr)
+			}
+			tmpfile.Close()
+
+			_, err = NewManager(tmpfile.Name())
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestActionPipelineNormalization(t *testing.T) {
+	tests := []struct {
+		name      string
+		actions   string
+		wantErr   bool
+		wantSteps []string
+	}{
+		{
+			name: "legacy single action",
+			actions: `    action:
+      type: "shell"
+      script: "true"`,
+			wantSteps: []string{"step-1"},
+		},
+		{
+			name: "actions list",
+			actions: `    actions:
+      - name: "migrate"
+        type: "shell"
+        script: "true"
+      - type: "webhook"
+        url: "http://localhost/notify"`,
+			wantSteps: []string{"migrate", "step-2"},
+		},
+		{
+			name: "action and actions together",
+			actions: `    action:
+      type: "shell"
+      script: "true"
+    actions:
+      - type: "shell"
+        script: "true"`,
+			wantErr: true,
+		},
+		{
+			name:    "no action",
+			actions: ``,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpfile, err := os.CreateTemp("", "config*.yaml")
+			if err != nil {
+				t.Fatalf("setup failed: %v", err)
+			}
+			defer os.Remove(tmpfile.Name())
+
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    watch_paths:
+      - "."
+` + tt.actions
+
+			if _, writeErr := tmpfile.WriteString(content); writeErr != nil {
+				t.Fatalf("write failed: %v", writeErr)
+			}
+			tmpfile.Close()
+
+			mgr, err := NewManager(tmpfile.Name())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			repo := mgr.GetConfig().Repositories[0]
+			if repo.Action.Type != "" {
+				t.Errorf("legacy action = %+v, want it moved into actions", repo.Action)
+			}
+
+			actions := repo.Actions
+			if len(actions) != len(tt.wantSteps) {
+				t.Fatalf("got %d actions, want %d", len(actions), len(tt.wantSteps))
+			}
+			for i, action := range actions {
+				if action.Name != tt.wantSteps[i] {
+					t.Errorf("actions[%d].name = %q, want %q", i, action.Name, tt.wantSteps[i])
+				}
+				if mgr.GetActionTimeout(&actions[i]) == 0 {
+					t.Errorf("actions[%d] timeout not parsed", i)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateLocalListen(t *testing.T) {
+	tests := []struct {
+		listen  string
+		wantErr bool
+	}{
+		{"", false},
+		{"unix:/run/cd-gun/api.sock", false},
+		{"127.0.0.1:8787", false},
+		{"localhost:8787", false},
+		{"[::1]:8787", false},
+		{"0.0.0.0:8787", true},
+		{"10.0.0.5:8787", true},
+		{"8787", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.listen, func(t *testing.T) {
+			err := validateLocalListen(tt.listen)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateLocalListen(%q) error = %v, wantErr %v", tt.listen, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		check   string
+		wantErr bool
+	}{
+		{"command", `command: "curl -fsS http://localhost/health"`, false},
+		{"url", `url: "http://localhost/health"`, false},
+		{"both", "command: \"true\"\n          url: \"http://localhost/health\"", true},
+		{"neither", `retries: 3`, true},
+		{"negative retries", "command: \"true\"\n          retries: -1", true},
+		{"invalid interval", "command: \"true\"\n          interval: \"soon\"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    watch_paths:
+      - "."
+    action:
+      type: "shell"
+      script: "true"
+      verify:
+          ` + tt.check + "\n"
+
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			mgr, err := NewManager(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			verify := mgr.GetConfig().Repositories[0].Actions[0].Verify
+			if got := mgr.GetCheckInterval(verify); got != 5*time.Second {
+				t.Errorf("interval = %v, want 5s", got)
+			}
+			if got := mgr.GetCheckTimeout(verify); got != 30*time.Second {
+				t.Errorf("timeout = %v, want 30s", got)
+			}
+		})
+	}
+}
+
+func TestProcessValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		action  string
+		wantErr bool
+	}{
+		{"all settings", "type: \"shell\"\n      script: \"true\"\n      run_as: \"deploy:www-data\"\n      working_dir: \"app\"\n      pass_env: [\"PATH\"]\n      umask: \"0027\"\n      nice: 10\n      limits:\n        nofile: 1024", false},
+		{"absolute working dir", "type: \"shell\"\n      script: \"true\"\n      working_dir: \"/srv/app\"", false},
+		{"working dir outside checkout", "type: \"shell\"\n      script: \"true\"\n      working_dir: \"app/../..\"", true},
+		{"missing user", "type: \"shell\"\n      script: \"true\"\n      run_as: \":www-data\"", true},
+		{"empty group", "type: \"shell\"\n      script: \"true\"\n      run_as: \"deploy:\"", true},
+		{"inherit and pass", "type: \"shell\"\n      script: \"true\"\n      inherit_env: true\n      pass_env: [\"PATH\"]", true},
+		{"invalid umask", "type: \"shell\"\n      script: \"true\"\n      umask: \"0999\"", true},
+		{"nice out of range", "type: \"shell\"\n      script: \"true\"\n      nice: 20", true},
+		{"negative limit", "type: \"shell\"\n      script: \"true\"\n      limits:\n        cpu: -1", true},
+		{"webhook", "type: \"webhook\"\n      url: \"http://localhost/hook\"\n      run_as: \"deploy\"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    watch_paths:
+      - "."
+    action:
+      ` + tt.action + "\n"
+
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			if _, err := NewManager(path); (err != nil) != tt.wantErr {
+				t.Errorf("NewManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCloneValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		watchPaths string
+		clone      string
+		wantErr    bool
+	}{
+		{"all options", `["services/api/", "deploy/*.sh", "*.yaml"]`, "depth: 50\n      filter: \"blob:none\"\n      single_branch: true\n      sparse: true\n      sparse_paths: [\"scripts\"]", false},
+		{"blob limit", `["."]`, "filter: \"blob:limit=1m\"", false},
+		{"negative depth", `["."]`, "depth: -1", true},
+		{"tree filter", `["."]`, "filter: \"tree:0\"", true},
+		{"sparse everything", `["."]`, "sparse: true", true},
+		{"sparse any directory", `["**/*.yaml"]`, "sparse: true", true},
+		{"sparse paths without sparse", `["src/"]`, "sparse_paths: [\"scripts\"]", true},
+		{"sparse path wildcard", `["src/"]`, "sparse: true\n      sparse_paths: [\"scripts/*\"]", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    watch_paths: ` + tt.watchPaths + `
+    clone:
+      ` + tt.clone + `
+    action:
+      type: "shell"
+      script: "true"
+`
+
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			if _, err := NewManager(path); (err != nil) != tt.wantErr {
+				t.Errorf("NewManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTagsValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    string
+		wantErr bool
+	}{
+		{"defaults", "tags: {}", false},
+		{"pattern and range", "tags:\n      pattern: \"v*\"\n      semver: \">=1.0.0 <2.0.0\"\n      prerelease: true", false},
+		{"caret range", "tags:\n      semver: \"^1.4\"", false},
+		{"bad pattern", "tags:\n      pattern: \"v[\"", true},
+		{"bad range", "tags:\n      semver: \">=1.x\"", true},
+		{"with branch", "branch: \"main\"\n    tags: {}", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    watch_paths: ["."]
+    ` + tt.tags + `
+    action:
+      type: "shell"
+      script: "true"
+`
+
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			mgr, err := NewManager(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			repo := mgr.GetConfig().Repositories[0]
+			if repo.Tags == nil || repo.Tags.Pattern == "" {
+				t.Errorf("Tags = %+v, want the pattern defaulted", repo.Tags)
+			}
+			if repo.Branch != "" {
+				t.Errorf("Branch = %q, want none in tag mode", repo.Branch)
+			}
+			if (repo.Tags.Constraint() != nil) != (repo.Tags.SemVer != "") {
+				t.Errorf("Constraint() = %v for semver %q", repo.Tags.Constraint(), repo.Tags.SemVer)
+			}
+		})
+	}
+}
+
+func TestRepositoryNameValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		wantErr bool
+	}{
+		{"valid", []string{"app", "web-frontend_2", "v1.2"}, false},
+		{"empty", []string{""}, true},
+		{"slash", []string{"team/app"}, true},
+		{"parent", []string{".."}, true},
+		{"dots", []string{"app..old"}, true},
+		{"hidden", []string{".quarantine"}, true},
+		{"duplicate", []string{"app", "app"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := "repositories:\n"
+			for _, name := range tt.names {
+				content += `  - name: "` + name + `"
+    url: "https://github.com/test/repo.git"
+    watch_paths: ["."]
+    action:
+      type: "shell"
+      script: "true"
+`
+			}
+
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			if _, err := NewManager(path); (err != nil) != tt.wantErr {
+				t.Errorf("NewManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    string
+		wantErr bool
+	}{
+		{"token file", "type: \"https\"\n      credentials: \"/etc/cd-gun/tokens/api\"", false},
+		{"token", "type: \"https\"\n      password: \"s3cret\"", false},
+		{"relative token file", "type: \"https\"\n      credentials: \"tokens/api\"", true},
+		{"token as credentials", "type: \"https\"\n      credentials: \"ghp_s3cret\"", true},
+		{"unknown type", "type: \"kerberos\"", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    auth:
+      ` + tt.auth + `
+    watch_paths: ["."]
+    action:
+      type: "shell"
+      script: "true"
+`
+
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			_, err := NewManager(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewManager() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && strings.Contains(err.Error(), "s3cret") {
+				t.Errorf("error %q contains the credentials", err)
+			}
+		})
+	}
+}
+
+func TestSparseDirs(t *testing.T) {
+	repo := &Repository{
+		WatchPaths: []string{"services/api/", "charts/*/values.yaml", "*.json", "config/app.yaml", "!services/api/docs/**"},
+		Routes:     []Route{{Name: "web", WatchPaths: []string{"services/web/**"}}},
+		Clone:      CloneOptions{Sparse: true, SparsePaths: []string{"/scripts/", "charts"}},
+	}
+
+	want := []string{"charts", "config/app.yaml", "scripts", "services/api", "services/web"}
+	if got := repo.SparseDirs(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("SparseDirs() = %v, want %v", got, want)
+	}
+}
+
+func TestDeployRetryDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   []time.Duration // delays before retry 1, 2, ...
+	}{
+		{"defaults", "max_retries: 3", []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute}},
+		{"capped", "backoff: \"10s\"\n      max_backoff: \"25s\"", []time.Duration{10 * time.Second, 20 * time.Second, 25 * time.Second}},
+		{"backoff above default cap", "backoff: \"1h\"", []time.Duration{time.Hour, time.Hour}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    watch_paths:
+      - "."
+    retry:
+      ` + tt.policy + `
+    action:
+      type: "shell"
+      script: "true"
+`
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			mgr, err := NewManager(path)
+			if err != nil {
+				t.Fatalf("NewManager() failed: %v", err)
+			}
+
+			repo := &mgr.GetConfig().Repositories[0]
+			for i, want := range tt.want {
+				if got := mgr.GetDeployRetryDelay(repo, i+1); got != want {
+					t.Errorf("retry %d: delay = %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
 }
@@ -0,0 +1,30 @@
+package config
+
+import "sync"
+
+var (
+	handlerLookupMu sync.RWMutex
+	handlerLookup   func(name string) bool
+)
+
+// SetHandlerLookup installs the function used to validate action.handler names
+// of custom actions. The executor package installs it on init so that
+// configuration can be validated without importing the executor.
+func SetHandlerLookup(fn func(name string) bool) {
+	handlerLookupMu.Lock()
+	defer handlerLookupMu.Unlock()
+
+	handlerLookup = fn
+}
+
+// handlerRegistered reports whether a custom action handler is known.
+// Without an installed lookup every name is accepted.
+func handlerRegistered(name string) bool {
+	handlerLookupMu.RLock()
+	defer handlerLookupMu.RUnlock()
+
+	if handlerLookup == nil {
+		return true
+	}
+	return handlerLookup(name)
+}
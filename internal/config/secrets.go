@@ -0,0 +1,326 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretRefPattern matches value references like ${env:NAME}, ${file:/path} and ${secret:NAME}
+var secretRefPattern = regexp.MustCompile(`\$\{(env|file|secret):([^}]+)\}`)
+
+// minRedactLength is the shortest resolved value that is redacted from output;
+// shorter values are too likely to occur by accident to be worth hiding
+const minRedactLength = 4
+
+// secretResolver resolves value references for one configuration load
+type secretResolver struct {
+	storePath string
+	keyFile   string
+	store     map[string]string
+	resolved  map[string]bool
+}
+
+// newSecretResolver creates a resolver using the optional encrypted store
+func newSecretResolver(cfg *SecretsConfig) *secretResolver {
+	return &secretResolver{
+		storePath: cfg.Store,
+		keyFile:   cfg.KeyFile,
+		resolved:  make(map[string]bool),
+	}
+}
+
+// resolve replaces all references in s with their values
+func (r *secretResolver) resolve(s string) (string, error) {
+	var resolveErr error
+
+	out := secretRefPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		m := secretRefPattern.FindStringSubmatch(ref)
+		value, err := r.lookup(m[1], m[2])
+		if err != nil {
+			if resolveErr == nil {
+				resolveErr = fmt.Errorf("failed to resolve %s: %w", ref, err)
+			}
+			return ref
+		}
+
+		r.resolved[value] = true
+		return value
+	})
+
+	return out, resolveErr
+}
+
+// resolveField resolves references in a string field in place
+func (r *secretResolver) resolveField(field *string, name string) error {
+	value, err := r.resolve(*field)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*field = value
+	return nil
+}
+
+// resolveMap resolves references in all values of a map in place
+func (r *secretResolver) resolveMap(values map[string]string, name string) error {
+	for k, v := range values {
+		value, err := r.resolve(v)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %w", name, k, err)
+		}
+		values[k] = value
+	}
+	return nil
+}
+
+// lookup returns the value of a single reference
+func (r *secretResolver) lookup(kind, name string) (string, error) {
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+
+	case "file":
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+
+	case "secret":
+		if r.store == nil {
+			if err := r.loadStore(); err != nil {
+				return "", err
+			}
+		}
+		value, ok := r.store[name]
+		if !ok {
+			return "", fmt.Errorf("secret %s not found in store", name)
+		}
+		return value, nil
+	}
+
+	return "", fmt.Errorf("unknown reference type %s", kind)
+}
+
+// loadStore decrypts the encrypted secret store
+func (r *secretResolver) loadStore() error {
+	if r.storePath == "" || r.keyFile == "" {
+		return fmt.Errorf("agent.secrets.store and agent.secrets.key_file must be configured")
+	}
+
+	key, err := LoadKeyFile(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(r.storePath)
+	if err != nil {
+		return fmt.Errorf("failed to read secret store: %w", err)
+	}
+
+	store, err := DecryptSecrets(data, key)
+	if err != nil {
+		return err
+	}
+
+	r.store = store
+	return nil
+}
+
+// redactor returns a replacer hiding all resolved values, longest first
+func (r *secretResolver) redactor() *strings.Replacer {
+	var values []string
+	for value := range r.resolved {
+		if len(value) >= minRedactLength {
+			values = append(values, value)
+		}
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, "***")
+	}
+
+	return strings.NewReplacer(pairs...)
+}
+
+// resolveSecrets resolves value references in all fields that may carry secrets
+func resolveSecrets(cfg *Config, r *secretResolver) error {
+	hooks := &cfg.Agent.PushHooks
+	for field, name := range map[*string]string{
+		&hooks.GitHubSecret: "agent.push_hooks.github_secret",
+		&hooks.GitLabToken:  "agent.push_hooks.gitlab_token",
+		&hooks.GiteaSecret:  "agent.push_hooks.gitea_secret",
+	} {
+		if err := r.resolveField(field, name); err != nil {
+			return err
+		}
+	}
+
+	for i := range cfg.Repositories {
+		repo := &cfg.Repositories[i]
+
+		for field, name := range map[*string]string{
+			&repo.Auth.Credentials: "auth.credentials",
+			&repo.Auth.Username:    "auth.username",
+			&repo.Auth.Password:    "auth.password",
+		} {
+			if err := r.resolveField(field, name); err != nil {
+				return fmt.Errorf("repository '%s': %w", repo.Name, err)
+			}
+		}
+
+		actions := []*Action{&repo.Action}
+		for j := range repo.Actions {
+			actions = append(actions, &repo.Actions[j])
+		}
+		for j := range repo.Routes {
+			actions = append(actions, &repo.Routes[j].Action)
+			for k := range repo.Routes[j].Actions {
+				actions = append(actions, &repo.Routes[j].Actions[k])
+			}
+		}
+
+		for _, action := range actions {
+			if err := resolveActionSecrets(action, r); err != nil {
+				return fmt.Errorf("repository '%s': %w", repo.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// resolveActionSecrets resolves value references in an action
+func resolveActionSecrets(action *Action, r *secretResolver) error {
+	if err := r.resolveField(&action.URL, "action.url"); err != nil {
+		return err
+	}
+	if err := r.resolveField(&action.Secret, "action.secret"); err != nil {
+		return err
+	}
+	if err := r.resolveMap(action.Headers, "action.headers"); err != nil {
+		return err
+	}
+	if action.PreCheck != nil {
+		if err := r.resolveField(&action.PreCheck.URL, "action.pre_check.url"); err != nil {
+			return err
+		}
+	}
+	if action.Verify != nil {
+		if err := r.resolveField(&action.Verify.URL, "action.verify.url"); err != nil {
+			return err
+		}
+	}
+	return r.resolveMap(action.Env, "action.env")
+}
+
+// LoadKeyFile reads a 32-byte AES-256 key stored as hex or base64
+func LoadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	encoded := strings.TrimSpace(string(data))
+
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key file must contain a 32-byte key encoded as hex or base64")
+	}
+
+	return key, nil
+}
+
+// GenerateKey returns a new random AES-256 key, hex encoded
+func GenerateKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// EncryptSecrets encrypts a YAML map of secret names to values with AES-256-GCM
+func EncryptSecrets(plaintext, key []byte) ([]byte, error) {
+	var secrets map[string]string
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("secrets must be a YAML map of names to values: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// DecryptSecrets decrypts a secret store created by EncryptSecrets
+func DecryptSecrets(data, key []byte) (map[string]string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret store encoding: %w", err)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("secret store is truncated")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret store (wrong key?): %w", err)
+	}
+
+	var secrets map[string]string
+	if err := yaml.Unmarshal(plaintext, &secrets); err != nil {
+		return nil, fmt.Errorf("failed to parse secret store: %w", err)
+	}
+
+	return secrets, nil
+}
+
+// newGCM creates an AES-256-GCM cipher for key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretReferences(t *testing.T) {
+	dir := t.TempDir()
+
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token-value\n"), 0600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() failed: %v", err)
+	}
+	keyFile := filepath.Join(dir, "key")
+	if err := os.WriteFile(keyFile, []byte(key+"\n"), 0600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	keyBytes, err := LoadKeyFile(keyFile)
+	if err != nil {
+		t.Fatalf("LoadKeyFile() failed: %v", err)
+	}
+	store, err := EncryptSecrets([]byte("pagerduty: pd-integration-key\n"), keyBytes)
+	if err != nil {
+		t.Fatalf("EncryptSecrets() failed: %v", err)
+	}
+	if strings.Contains(string(store), "pd-integration-key") {
+		t.Fatal("store contains plaintext")
+	}
+	storeFile := filepath.Join(dir, "secrets.enc")
+	if err := os.WriteFile(storeFile, store, 0600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	t.Setenv("CDGUN_TEST_SLACK", "https://hooks.slack.com/services/T0/B0/XYZ")
+
+	content := `agent:
+  secrets:
+    store: "` + storeFile + `"
+    key_file: "` + keyFile + `"
+repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    auth:
+      type: "https"
+      password: "${file:` + tokenFile + `}"
+    watch_paths:
+      - "."
+    action:
+      type: "shell"
+      script: "true"
+      env:
+        SLACK_WEBHOOK: "${env:CDGUN_TEST_SLACK}"
+        PAGERDUTY_KEY: "${secret:pagerduty}"
+        AUTH_HEADER: "Bearer ${secret:pagerduty}"
+        PLAIN: "unchanged"`
+
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	mgr, err := NewManager(configPath)
+	if err != nil {
+		t.Fatalf("NewManager() failed: %v", err)
+	}
+
+	repo := mgr.GetConfig().Repositories[0]
+	if repo.Auth.Password != "file-token-value" {
+		t.Errorf("auth.password = %q", repo.Auth.Password)
+	}
+
+	env := repo.Actions[0].Env
+	want := map[string]string{
+		"SLACK_WEBHOOK": "https://hooks.slack.com/services/T0/B0/XYZ",
+		"PAGERDUTY_KEY": "pd-integration-key",
+		"AUTH_HEADER":   "Bearer pd-integration-key",
+		"PLAIN":         "unchanged",
+	}
+	for k, v := range want {
+		if env[k] != v {
+			t.Errorf("env[%s] = %q, want %q", k, env[k], v)
+		}
+	}
+
+	redacted := mgr.Redact("curl -H 'Bearer pd-integration-key' with file-token-value")
+	if redacted != "curl -H 'Bearer ***' with ***" {
+		t.Errorf("Redact() = %q", redacted)
+	}
+}
+
+func TestSecretReferenceErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"missing env", "${env:CDGUN_TEST_DOES_NOT_EXIST}"},
+		{"missing file", "${file:/does/not/exist}"},
+		{"secret without store", "${secret:anything}"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			content := `repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    watch_paths:
+      - "."
+    action:
+      type: "shell"
+      script: "true"
+      env:
+        VALUE: "` + tt.value + `"`
+
+			configPath := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+				t.Fatalf("write failed: %v", err)
+			}
+
+			if _, err := NewManager(configPath); err == nil {
+				t.Error("expected error for unresolvable reference")
+			}
+		})
+	}
+}
+
+func TestLoadAgentConfigSkipsSecrets(t *testing.T) {
+	content := `agent:
+  api:
+    listen: "unix:/run/cd-gun/api.sock"
+repositories:
+  - name: "test"
+    url: "https://github.com/test/repo.git"
+    auth:
+      type: "https"
+      password: "${file:/does/not/exist}"
+    watch_paths:
+      - "."
+    action:
+      type: "shell"
+      script: "true"
+`
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	agent, err := LoadAgentConfig(configPath)
+	if err != nil {
+		t.Fatalf("LoadAgentConfig() failed: %v", err)
+	}
+	if agent.API.Listen != "unix:/run/cd-gun/api.sock" {
+		t.Errorf("api.listen = %q, want unix:/run/cd-gun/api.sock", agent.API.Listen)
+	}
+}
+
+func TestDecryptSecretsWrongKey(t *testing.T) {
+	key := make([]byte, 32)
+	store, err := EncryptSecrets([]byte("a: b\n"), key)
+	if err != nil {
+		t.Fatalf("EncryptSecrets() failed: %v", err)
+	}
+
+	wrongKey := make([]byte, 32)
+	wrongKey[0] = 1
+	if _, err := DecryptSecrets(store, wrongKey); err == nil {
+		t.Error("expected decryption with wrong key to fail")
+	}
+}
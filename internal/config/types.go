@@ -1,6 +1,10 @@
 package config
 
-import "time"
+import (
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/semver"
+)
 
 // Config is the main configuration structure for CD-Gun
 type Config struct {
@@ -11,13 +15,69 @@ type Config struct {
 
 // AgentConfig contains agent-specific settings
 type AgentConfig struct {
-	Name           string        `yaml:"name"`
-	LogLevel       string        `yaml:"log_level"`
-	LogFile        string        `yaml:"log_file"` // Optional: path to log file (if not set, logs to stdout)
-	StateDir       string        `yaml:"state_dir"`
-	CacheDir       string        `yaml:"cache_dir"`
-	PollInterval   string        `yaml:"poll_interval"`
-	parsedInterval time.Duration `yaml:"-"`
+	Name           string          `yaml:"name"`
+	LogLevel       string          `yaml:"log_level"`
+	LogFile        string          `yaml:"log_file"` // Optional: path to log file (if not set, logs to stdout)
+	StateDir       string          `yaml:"state_dir"`
+	CacheDir       string          `yaml:"cache_dir"`
+	PollInterval   string          `yaml:"poll_interval"`
+	parsedInterval time.Duration   `yaml:"-"`
+	Secrets        SecretsConfig   `yaml:"secrets"`
+	API            APIConfig       `yaml:"api"`
+	Metrics        MetricsConfig   `yaml:"metrics"`
+	PushHooks      PushHooksConfig `yaml:"push_hooks"`
+	History        HistoryConfig   `yaml:"history"`
+	Output         OutputConfig    `yaml:"output"`
+
+	MaxConcurrentActions int `yaml:"max_concurrent_actions"` // deploys of different repositories running at once (default 4)
+
+	StopGracePeriod       string        `yaml:"stop_grace_period"` // time a cancelled action gets after SIGTERM before SIGKILL (default 10s)
+	parsedStopGracePeriod time.Duration `yaml:"-"`
+}
+
+// OutputConfig configures streaming of action output
+type OutputConfig struct {
+	Stream     string `yaml:"stream"`       // level of output lines in the agent log: info (default), debug or off
+	MaxLogSize int    `yaml:"max_log_size"` // bytes written to the log file of a run (default 10 MiB)
+}
+
+// Output stream levels for OutputConfig.Stream
+const (
+	StreamInfo  = "info"
+	StreamDebug = "debug"
+	StreamOff   = "off"
+)
+
+// HistoryConfig configures retention of the per-repository deployment history
+type HistoryConfig struct {
+	MaxRuns      int           `yaml:"max_runs"` // runs kept per repository (default 100)
+	MaxAge       string        `yaml:"max_age"`  // runs older than this are removed; empty keeps all
+	parsedMaxAge time.Duration `yaml:"-"`
+	MaxOutput    int           `yaml:"max_output"` // bytes of captured output kept per step (default 64 KiB)
+}
+
+// PushHooksConfig configures the receiver for push webhooks sent by Git forges
+type PushHooksConfig struct {
+	Listen       string `yaml:"listen"`        // TCP "host:port"; empty disables the receiver
+	GitHubSecret string `yaml:"github_secret"` // HMAC secret for X-Hub-Signature-256
+	GitLabToken  string `yaml:"gitlab_token"`  // token compared with X-Gitlab-Token
+	GiteaSecret  string `yaml:"gitea_secret"`  // HMAC secret for X-Gitea-Signature
+}
+
+// MetricsConfig configures the Prometheus metrics endpoint
+type MetricsConfig struct {
+	Listen string `yaml:"listen"` // TCP "host:port" serving /metrics; empty disables the endpoint
+}
+
+// APIConfig configures the local HTTP status and control API
+type APIConfig struct {
+	Listen string `yaml:"listen"` // "unix:/path/to/socket" or loopback "host:port"; empty disables the API
+}
+
+// SecretsConfig configures the encrypted secret store used by ${secret:NAME} references
+type SecretsConfig struct {
+	Store   string `yaml:"store"`    // path to the encrypted store
+	KeyFile string `yaml:"key_file"` // path to the AES-256 key (hex or base64)
 }
 
 // Repository represents a git repository to monitor
@@ -25,29 +85,146 @@ type Repository struct {
 	Name           string        `yaml:"name"`
 	URL            string        `yaml:"url"`
 	Branch         string        `yaml:"branch"`
+	Tags           *TagTracking  `yaml:"tags"` // deploy the highest matching tag instead of the head of the branch
 	Auth           Auth          `yaml:"auth"`
-	WatchPaths     []string      `yaml:"watch_paths"`
+	WatchPaths     []string      `yaml:"watch_paths"` // Glob patterns ("**" supported), "!" prefix excludes
+	IgnoreFile     string        `yaml:"ignore_file"` // Optional file in the repository listing patterns to ignore (e.g. .cdgunignore)
 	PollInterval   string        `yaml:"poll_interval"`
 	parsedInterval time.Duration `yaml:"-"`
-	Action         Action        `yaml:"action"`
+	Action         Action        `yaml:"action"`           // Single action (kept for compatibility with older configs)
+	Actions        []Action      `yaml:"actions"`          // Ordered action pipeline; normalized to contain Action if only that is set
+	Routes         []Route       `yaml:"routes"`           // Watch paths mapped to their own actions
+	OnFailure      string        `yaml:"on_failure"`       // "none" (default) or "rollback" to the last successful commit
+	OnLocalChanges string        `yaml:"on_local_changes"` // "discard" (default) or "fail" when the cached working tree was modified
+	OnForcePush    string        `yaml:"on_force_push"`    // "deploy" (default), "skip" or "require_approval" when the branch history is rewritten
+	Retry          RetryPolicy   `yaml:"retry"`            // redeploying a commit whose actions failed
+	Locks          []string      `yaml:"locks"`            // named locks; repositories sharing one never deploy at the same time
+	Clone          CloneOptions  `yaml:"clone"`            // shallow, partial and sparse clones of large repositories
+}
+
+// CloneOptions configures the clone of a repository in the cache. Depth,
+// filter and single_branch only take effect when the repository is cloned.
+type CloneOptions struct {
+	Depth        int      `yaml:"depth"`         // commits of history to fetch, 0 (default) for all
+	Filter       string   `yaml:"filter"`        // partial clone filter: "blob:none" or "blob:limit=<size>"
+	SingleBranch bool     `yaml:"single_branch"` // fetch only the configured branch (implied by depth)
+	Sparse       bool     `yaml:"sparse"`        // check out only the directories of the watch paths
+	SparsePaths  []string `yaml:"sparse_paths"`  // further directories to check out, e.g. with deploy scripts
+}
+
+// TagTracking selects the tag a repository deploys: the highest version among
+// the tags matching the pattern and the version range
+type TagTracking struct {
+	Pattern    string             `yaml:"pattern"`    // glob matched against tag names (default "*")
+	SemVer     string             `yaml:"semver"`     // version range, e.g. ">=1.0.0 <2.0.0"
+	Prerelease bool               `yaml:"prerelease"` // also select pre-release versions such as 2.0.0-rc.1
+	constraint *semver.Constraint `yaml:"-"`
+}
+
+// Constraint returns the parsed version range, nil if any version is allowed
+func (t *TagTracking) Constraint() *semver.Constraint {
+	return t.constraint
+}
+
+// RetryPolicy configures retries of a failed deploy of the same commit
+type RetryPolicy struct {
+	MaxRetries       int           `yaml:"max_retries"` // retries after the first failed run (default 0: no retries)
+	Backoff          string        `yaml:"backoff"`     // delay before the first retry, doubled per retry (default 1m)
+	parsedBackoff    time.Duration `yaml:"-"`
+	MaxBackoff       string        `yaml:"max_backoff"` // upper bound of the delay (default 30m, at least backoff)
+	parsedMaxBackoff time.Duration `yaml:"-"`
+}
+
+// Failure policies for Repository.OnFailure
+const (
+	OnFailureNone     = "none"
+	OnFailureRollback = "rollback"
+)
+
+// Policies for Repository.OnForcePush
+const (
+	ForcePushDeploy          = "deploy"
+	ForcePushSkip            = "skip"
+	ForcePushRequireApproval = "require_approval"
+)
+
+// Policies for Repository.OnLocalChanges
+const (
+	LocalChangesDiscard = "discard"
+	LocalChangesFail    = "fail"
+)
+
+// Route maps a set of watch paths to the actions fired when they change.
+// All routes of a repository share one clone and one fetch.
+type Route struct {
+	Name       string   `yaml:"name"`
+	WatchPaths []string `yaml:"watch_paths"`
+	Action     Action   `yaml:"action"`
+	Actions    []Action `yaml:"actions"`
 }
 
 // Auth contains authentication configuration for a repository
 type Auth struct {
 	Type        string `yaml:"type"`        // ssh, https, none
-	Credentials string `yaml:"credentials"` // path to credentials file or token
+	Credentials string `yaml:"credentials"` // ssh: private key path; https: absolute path to a token file
 	Username    string `yaml:"username"`
-	Password    string `yaml:"password"`
+	Password    string `yaml:"password"`    // https: password or token
+	KnownHosts  string `yaml:"known_hosts"` // ssh: pinned known_hosts file
 }
 
 // Action describes what to do when files change
 type Action struct {
-	Type          string            `yaml:"type"` // shell, webhook, custom
-	Script        string            `yaml:"script"`
-	URL           string            `yaml:"url"`
-	Handler       string            `yaml:"handler"`
-	Timeout       string            `yaml:"timeout"`
-	parsedTimeout time.Duration     `yaml:"-"`
-	Parallel      bool              `yaml:"parallel"`
-	Env           map[string]string `yaml:"env"`
+	Name               string            `yaml:"name"` // step name in a pipeline (default: step-N)
+	Type               string            `yaml:"type"` // shell, webhook, custom
+	Script             string            `yaml:"script"`
+	URL                string            `yaml:"url"`
+	Method             string            `yaml:"method"`        // webhook: HTTP method (default POST)
+	Headers            map[string]string `yaml:"headers"`       // webhook: extra request headers
+	Secret             string            `yaml:"secret"`        // webhook: HMAC-SHA256 signing secret
+	Retries            int               `yaml:"retries"`       // webhook: retries on 5xx/network errors
+	RetryBackoff       string            `yaml:"retry_backoff"` // webhook: initial backoff, doubled per retry
+	parsedRetryBackoff time.Duration     `yaml:"-"`
+	Handler            string            `yaml:"handler"` // custom: name of a registered handler
+	Timeout            string            `yaml:"timeout"`
+	parsedTimeout      time.Duration     `yaml:"-"`
+	Parallel           bool              `yaml:"parallel"`          // run concurrently with adjacent parallel steps
+	ContinueOnError    bool              `yaml:"continue_on_error"` // keep running the pipeline if this step fails
+	Env                map[string]string `yaml:"env"`
+	PreCheck           *Check            `yaml:"pre_check"` // must pass before the action runs
+	Verify             *Check            `yaml:"verify"`    // must pass after the action ran
+
+	// Process settings of shell actions, also used for their command checks
+	RunAs      string   `yaml:"run_as"`      // "user" or "user:group" to run the script as
+	WorkingDir string   `yaml:"working_dir"` // relative to the checkout (default: the checkout)
+	InheritEnv bool     `yaml:"inherit_env"` // pass the agent's whole environment
+	PassEnv    []string `yaml:"pass_env"`    // agent environment variables passed (default: DefaultPassEnv)
+	Umask      string   `yaml:"umask"`       // octal file mode creation mask, e.g. "0027"
+	Nice       int      `yaml:"nice"`        // scheduling priority from -20 (highest) to 19
+	Limits     *Limits  `yaml:"limits"`      // resource limits
+}
+
+// DefaultPassEnv are the agent environment variables passed to shell actions
+// without pass_env or inherit_env
+var DefaultPassEnv = []string{"PATH", "HOME", "USER", "LOGNAME", "LANG", "LC_ALL", "TZ", "TMPDIR"}
+
+// Limits are resource limits of a shell action. Zero leaves a limit as the
+// agent has it.
+type Limits struct {
+	CPU    int   `yaml:"cpu"`    // CPU time in seconds
+	Memory int64 `yaml:"memory"` // virtual memory in bytes
+	NoFile int   `yaml:"nofile"` // open files
+	NProc  int   `yaml:"nproc"`  // processes of the user
+}
+
+// Check is a pre-deploy check or post-deploy verification of an action.
+// Exactly one of Command and URL is set.
+type Check struct {
+	Command        string        `yaml:"command"`       // shell command, passes on exit status 0
+	URL            string        `yaml:"url"`           // HTTP GET, passes on ExpectStatus
+	ExpectStatus   int           `yaml:"expect_status"` // expected HTTP status (default: any 2xx)
+	Retries        int           `yaml:"retries"`       // attempts after the first failed one
+	Interval       string        `yaml:"interval"`      // wait between attempts (default 5s)
+	parsedInterval time.Duration `yaml:"-"`
+	Timeout        string        `yaml:"timeout"` // per attempt (default 30s)
+	parsedTimeout  time.Duration `yaml:"-"`
 }
@@ -0,0 +1,124 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/monitor"
+)
+
+// Check stages reported in CheckResult
+const (
+	CheckPreCheck = "pre_check"
+	CheckVerify   = "verify"
+)
+
+// maxCheckOutput bounds the command output included in a check error
+const maxCheckOutput = 1024
+
+// CheckResult is the outcome of a pre_check or verify of a step
+type CheckResult struct {
+	Stage    string        `json:"stage"`  // pre_check, verify
+	Status   string        `json:"status"` // success, failure
+	Attempts int           `json:"attempts"`
+	Error    string        `json:"error,omitempty"` // error of the last attempt
+	Duration time.Duration `json:"duration"`
+}
+
+// runCheck runs a check until it passes or its retries are exhausted
+func (e *Executor) runCheck(ctx context.Context, stage string, check *config.Check, action *config.Action,
+	event *monitor.ChangeEvent, configMgr *config.Manager) CheckResult {
+
+	result := CheckResult{Stage: stage}
+	startTime := time.Now()
+
+	for attempt := 0; ; attempt++ {
+		result.Attempts = attempt + 1
+
+		var err error
+		if check.URL != "" {
+			err = e.checkHTTP(ctx, check, configMgr)
+		} else {
+			err = e.checkCommand(ctx, check, action, event, configMgr)
+		}
+
+		if err == nil {
+			result.Status = StepSuccess
+			result.Error = ""
+			break
+		}
+
+		result.Status = StepFailure
+		result.Error = configMgr.Redact(err.Error())
+
+		if attempt >= check.Retries || ctx.Err() != nil {
+			break
+		}
+
+		e.logger.Debugf("%s of '%s' for '%s' failed (attempt %d/%d): %v",
+			stage, action.Name, event.RepositoryName, attempt+1, check.Retries+1, result.Error)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(configMgr.GetCheckInterval(check)):
+		}
+	}
+
+	result.Duration = time.Since(startTime)
+	return result
+}
+
+// checkCommand runs a check command with the environment of the action
+func (e *Executor) checkCommand(ctx context.Context, check *config.Check, action *config.Action,
+	event *monitor.ChangeEvent, configMgr *config.Manager) error {
+
+	ctx, cancel := context.WithTimeout(ctx, configMgr.GetCheckTimeout(check))
+	defer cancel()
+
+	proc, err := e.newScriptProcess(action, event, configMgr)
+	if err != nil {
+		return err
+	}
+
+	// Only the redacted tail is kept, however much a retried check writes
+	output := &outputStream{redact: configMgr.Redact, limit: maxCheckOutput}
+	if err := runScript(ctx, proc, check.Command, output, configMgr.GetStopGracePeriod()); err != nil {
+		return fmt.Errorf("command failed: %w, output: %s", err, strings.TrimSpace(output.Close()))
+	}
+
+	return nil
+}
+
+// checkHTTP sends a GET request and compares the response status
+func (e *Executor) checkHTTP(ctx context.Context, check *config.Check, configMgr *config.Manager) error {
+	ctx, cancel := context.WithTimeout(ctx, configMgr.GetCheckTimeout(check))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.URL, nil)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	// The context carries the check timeout, which may exceed the webhook client's
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	resp.Body.Close()
+
+	if check.ExpectStatus != 0 {
+		if resp.StatusCode != check.ExpectStatus {
+			return fmt.Errorf("got status %d, want %d", resp.StatusCode, check.ExpectStatus)
+		}
+		return nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package executor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPreCheckAndVerify(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "deployed")
+
+	tests := []struct {
+		name        string
+		step        string
+		wantStatus  string
+		wantError   string
+		wantRun     bool
+		wantChecks  []string
+		wantAttempt int
+	}{
+		{
+			name: "failed pre_check skips action",
+			step: `      - type: "shell"
+        script: "touch ` + marker + `"
+        pre_check:
+          command: "echo maintenance window closed; exit 1"
+`,
+			wantStatus:  StepFailure,
+			wantError:   "pre_check failed",
+			wantRun:     false,
+			wantChecks:  []string{CheckPreCheck},
+			wantAttempt: 1,
+		},
+		{
+			name: "verify passes after retries",
+			step: `      - type: "shell"
+        script: "touch ` + marker + `"
+        pre_check:
+          command: "true"
+        verify:
+          command: 'n=$(cat ` + marker + `.n 2>/dev/null || echo 0); echo $((n+1)) > ` + marker + `.n; [ $n -ge 2 ]'
+          retries: 3
+          interval: "10ms"
+`,
+			wantStatus:  StepSuccess,
+			wantRun:     true,
+			wantChecks:  []string{CheckPreCheck, CheckVerify},
+			wantAttempt: 3,
+		},
+		{
+			name: "verify fails after retries",
+			step: `      - type: "shell"
+        script: "touch ` + marker + `"
+        verify:
+          command: "false"
+          retries: 1
+          interval: "10ms"
+`,
+			wantStatus:  StepFailure,
+			wantError:   "verify failed",
+			wantRun:     true,
+			wantChecks:  []string{CheckVerify},
+			wantAttempt: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(marker)
+			os.Remove(marker + ".n")
+
+			mgr := newTestManager(t, repoConfig("", "    actions:\n"+tt.step))
+			repo := &mgr.GetConfig().Repositories[0]
+
+			result, err := newTestExecutor(t).ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+			if err != nil {
+				t.Fatalf("ExecuteRepository() failed: %v", err)
+			}
+
+			step := result.Steps[0]
+			if step.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s (error: %s)", step.Status, tt.wantStatus, step.Error)
+			}
+			if !strings.Contains(step.Error, tt.wantError) {
+				t.Errorf("error = %q, want it to contain %q", step.Error, tt.wantError)
+			}
+
+			_, statErr := os.Stat(marker)
+			if ran := statErr == nil; ran != tt.wantRun {
+				t.Errorf("action ran = %v, want %v", ran, tt.wantRun)
+			}
+
+			var stages []string
+			for _, check := range step.Checks {
+				stages = append(stages, check.Stage)
+			}
+			if strings.Join(stages, ",") != strings.Join(tt.wantChecks, ",") {
+				t.Fatalf("checks = %v, want %v", stages, tt.wantChecks)
+			}
+			if last := step.Checks[len(step.Checks)-1]; last.Attempts != tt.wantAttempt {
+				t.Errorf("attempts = %d, want %d", last.Attempts, tt.wantAttempt)
+			}
+		})
+	}
+}
+
+func TestCheckOutputRedacted(t *testing.T) {
+	t.Setenv("CDGUN_TEST_CHECK_TOKEN", "s3cr3t-t0ken-value")
+
+	// Kept as the last 1024 bytes before redaction, the output would start in the token
+	mgr := newTestManager(t, repoConfig("", `    actions:
+      - type: "shell"
+        script: "true"
+        env:
+          TOKEN: "${env:CDGUN_TEST_CHECK_TOKEN}"
+        verify:
+          command: 'head -c 100000 /dev/zero | tr "\\0" x; echo "$TOKEN"; head -c 1010 /dev/zero | tr "\\0" y; exit 1'
+`))
+	repo := &mgr.GetConfig().Repositories[0]
+
+	result, err := newTestExecutor(t).ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+	if err != nil {
+		t.Fatalf("ExecuteRepository() failed: %v", err)
+	}
+
+	check := result.Steps[0].Checks[0]
+	if check.Status != StepFailure || !strings.Contains(check.Error, "bytes truncated") {
+		t.Fatalf("check = %+v, want a failure with the truncated output", check)
+	}
+	if strings.Contains(check.Error, "t0ken") || strings.Contains(check.Error, "value") {
+		t.Errorf("error = %q, leaks part of the token", check.Error)
+	}
+	if len(check.Error) > 2*maxCheckOutput {
+		t.Errorf("error is %d bytes, want the output bounded", len(check.Error))
+	}
+}
+
+func TestVerifyHTTP(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	mgr := newTestManager(t, repoConfig("", `    actions:
+      - type: "shell"
+        script: "true"
+        verify:
+          url: "`+srv.URL+`/health"
+          expect_status: 200
+          retries: 2
+          interval: "10ms"
+`))
+	repo := &mgr.GetConfig().Repositories[0]
+
+	result, err := newTestExecutor(t).ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+	if err != nil {
+		t.Fatalf("ExecuteRepository() failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, got %s", result.Error)
+	}
+	if got := result.Steps[0].Checks[0].Attempts; got != 2 {
+		t.Errorf("attempts = %d, want 2", got)
+	}
+}
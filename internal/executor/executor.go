@@ -3,9 +3,14 @@ package executor
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/omnorm/cd-gun/internal/config"
@@ -14,21 +19,29 @@ import (
 	"github.com/omnorm/cd-gun/internal/state"
 )
 
+// SignatureHeader carries the HMAC-SHA256 signature of webhook payloads
+const SignatureHeader = "X-CDGun-Signature-256"
+
 // Executor executes actions when changes are detected
 type Executor struct {
 	logger     *logger.Logger
 	stateStore *state.Store //nolint:unused // Reserved for future use with action result persistence
 	httpClient *http.Client
+	runLogDir  string // directory of per-run output logs, empty disables them
 }
 
 // ExecutionResult represents the result of executing an action
 type ExecutionResult struct {
-	RepositoryName string
-	Success        bool
-	Output         string
-	Error          string
-	Duration       time.Duration
-	ExecutedAt     time.Time
+	RepositoryName string        `json:"repository"`
+	Success        bool          `json:"success"`
+	Output         string        `json:"output,omitempty"`
+	Error          string        `json:"error,omitempty"`
+	Duration       time.Duration `json:"duration"`
+	ExecutedAt     time.Time     `json:"executed_at"`
+	Steps          []StepResult  `json:"steps,omitempty"`     // per-step results when executing a pipeline
+	Cancelled      bool          `json:"cancelled,omitempty"` // the run was interrupted, e.g. by agent shutdown
+	RunID          string        `json:"run_id,omitempty"`    // history ID of a pipeline run
+	LogFile        string        `json:"log_file,omitempty"`  // full output of a pipeline run
 }
 
 // NewExecutor creates a new executor
@@ -39,10 +52,23 @@ func NewExecutor(log *logger.Logger) (*Executor, error) {
 	}, nil
 }
 
+// SetRunLogDir sets the directory for per-run output logs, see state.RunLogPath
+func (e *Executor) SetRunLogDir(dir string) {
+	e.runLogDir = dir
+}
+
 // Execute executes an action based on a change event
 func (e *Executor) Execute(action *config.Action, event *monitor.ChangeEvent,
 	configMgr *config.Manager) (*ExecutionResult, error) {
 
+	return e.execute(context.Background(), action, event, configMgr, nil)
+}
+
+// execute executes an action until it finishes or ctx is done, streaming
+// shell output to a run log if set
+func (e *Executor) execute(ctx context.Context, action *config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager, log *runLog) (*ExecutionResult, error) {
+
 	result := &ExecutionResult{
 		RepositoryName: event.RepositoryName,
 		ExecutedAt:     time.Now(),
@@ -52,8 +78,9 @@ func (e *Executor) Execute(action *config.Action, event *monitor.ChangeEvent,
 
 	switch action.Type {
 	case "shell":
-		err := e.executeShell(action, event, configMgr)
+		output, err := e.executeShell(ctx, action, event, configMgr, log)
 		result.Duration = time.Since(startTime)
+		result.Output = output
 		if err != nil {
 			result.Success = false
 			result.Error = err.Error()
@@ -64,7 +91,7 @@ func (e *Executor) Execute(action *config.Action, event *monitor.ChangeEvent,
 		}
 
 	case "webhook":
-		err := e.executeWebhook(action, event)
+		err := e.executeWebhook(ctx, action, event, configMgr)
 		result.Duration = time.Since(startTime)
 		if err != nil {
 			result.Success = false
@@ -75,61 +102,174 @@ func (e *Executor) Execute(action *config.Action, event *monitor.ChangeEvent,
 			e.logger.Infof("Webhook action completed successfully for '%s'", event.RepositoryName)
 		}
 
+	case "custom":
+		handlerResult, err := e.executeCustom(ctx, action, event, configMgr)
+		result.Duration = time.Since(startTime)
+		if err == nil && handlerResult == nil {
+			err = fmt.Errorf("handler '%s' returned no result", action.Handler)
+		}
+		if err != nil {
+			result.Success = false
+			result.Error = err.Error()
+			e.logger.Errorf("Custom action '%s' failed for '%s': %v", action.Handler, event.RepositoryName, err)
+			break
+		}
+
+		result.Success = handlerResult.Success
+		result.Output = handlerResult.Output
+		result.Error = handlerResult.Error
+		if result.Success {
+			e.logger.Infof("Custom action '%s' completed successfully for '%s'", action.Handler, event.RepositoryName)
+		} else {
+			e.logger.Errorf("Custom action '%s' failed for '%s': %s", action.Handler, event.RepositoryName, result.Error)
+		}
+
 	default:
 		return nil, fmt.Errorf("unknown action type: %s", action.Type)
 	}
 
+	result.Error = configMgr.Redact(result.Error)
+	result.Output = configMgr.Redact(result.Output)
+
 	return result, nil
 }
 
-// executeShell executes a shell script
-func (e *Executor) executeShell(action *config.Action, event *monitor.ChangeEvent,
-	configMgr *config.Manager) error {
+// executeShell executes a shell script and returns the tail of its combined
+// stdout and stderr. Output lines are streamed while the script runs.
+func (e *Executor) executeShell(ctx context.Context, action *config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager, log *runLog) (string, error) {
 
-	ctx, cancel := context.WithTimeout(context.Background(),
-		configMgr.GetActionTimeout(action))
+	ctx, cancel := context.WithTimeout(ctx, configMgr.GetActionTimeout(action))
 	defer cancel()
 
-	cmd := exec.CommandContext(ctx, "bash", "-c", action.Script)
-
-	// Set environment variables
-	env := e.buildEnvironment(action, event, configMgr)
-	cmd.Env = append(cmd.Env, env...)
+	proc, err := e.newScriptProcess(action, event, configMgr)
+	if err != nil {
+		return "", err
+	}
 
-	// Capture output
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+	// Stdout and stderr interleaved as written; lines are redacted before they
+	// are logged, the returned output is redacted by Close before it is trimmed
+	out := e.newOutputStream(action, event, configMgr, log)
 
 	e.logger.Debugf("Executing shell action for '%s': %s", event.RepositoryName, action.Script)
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("shell command failed: %w\nstdout: %s\nstderr: %s",
-			err, stdout.String(), stderr.String())
+	err = runScript(ctx, proc, action.Script, out, configMgr.GetStopGracePeriod())
+	output := out.Close()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = fmt.Errorf("%w: %v", ctxErr, err)
+		}
+		last := tail(strings.TrimSpace(output), maxCheckOutput)
+		return output, fmt.Errorf("shell command failed: %w, output: %s", err, last)
 	}
 
-	if stderr.Len() > 0 {
-		e.logger.Warnf("Shell action stderr for '%s': %s", event.RepositoryName, stderr.String())
+	return output, nil
+}
+
+// webhookPayload is the JSON body sent by webhook actions
+type webhookPayload struct {
+	Repository string    `json:"repository"`
+	Files      []string  `json:"files"`
+	OldHash    string    `json:"old_hash"`
+	NewHash    string    `json:"new_hash"`
+	Timestamp  time.Time `json:"timestamp"`
+	Rollback   bool      `json:"rollback,omitempty"`
+	ForcePush  bool      `json:"force_push,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+}
+
+// executeWebhook sends the change event as JSON to the configured URL,
+// retrying with exponential backoff on network errors and 5xx responses
+func (e *Executor) executeWebhook(ctx context.Context, action *config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager) error {
+
+	body, err := json.Marshal(webhookPayload{
+		Repository: event.RepositoryName,
+		Files:      event.Files,
+		OldHash:    event.OldHash,
+		NewHash:    event.NewHash,
+		Timestamp:  event.DetectedAt,
+		Rollback:   event.Rollback,
+		ForcePush:  event.ForcePush,
+		Tag:        event.Tag,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
 	}
 
-	return nil
+	if timeout := configMgr.GetActionTimeout(action); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	backoff := configMgr.GetRetryBackoff(action)
+
+	for attempt := 0; ; attempt++ {
+		retryable, sendErr := e.sendWebhook(ctx, action, body)
+		if sendErr == nil {
+			return nil
+		}
+
+		if !retryable || attempt >= action.Retries {
+			return sendErr
+		}
+
+		e.logger.Warnf("Webhook attempt %d/%d for '%s' failed, retrying in %v: %v",
+			attempt+1, action.Retries+1, event.RepositoryName, backoff, sendErr)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (giving up: %v)", sendErr, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
 }
 
-// executeWebhook executes a webhook action
-func (e *Executor) executeWebhook(action *config.Action, event *monitor.ChangeEvent) error {
-	_ = map[string]interface{}{
-		"repository": event.RepositoryName,
-		"files":      event.Files,
-		"old_hash":   event.OldHash,
-		"new_hash":   event.NewHash,
-		"timestamp":  event.DetectedAt,
+// sendWebhook performs a single webhook request and reports whether a failure is retryable
+func (e *Executor) sendWebhook(ctx context.Context, action *config.Action, body []byte) (bool, error) {
+	method := action.Method
+	if method == "" {
+		method = http.MethodPost
 	}
 
-	// TODO: Marshal payload to JSON and send HTTP POST
-	e.logger.Warnf("Webhook action for '%s' not yet implemented: %s",
-		event.RepositoryName, action.URL)
+	req, err := http.NewRequestWithContext(ctx, method, action.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create webhook request: %w", err)
+	}
 
-	return nil
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "cd-gun")
+	for k, v := range action.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if action.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+signPayload(action.Secret, body))
+	}
+
+	resp, err := e.httpClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, fmt.Errorf("webhook returned status %d: %s",
+			resp.StatusCode, strings.TrimSpace(string(respBody)))
+	}
+
+	return false, nil
+}
+
+// signPayload returns the hex-encoded HMAC-SHA256 of body keyed with secret
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
 // buildEnvironment builds environment variables for shell execution
@@ -149,6 +289,16 @@ func (e *Executor) buildEnvironment(action *config.Action, event *monitor.Change
 		fmt.Sprintf("CDGUN_NEW_HASH=%s", event.NewHash),
 	}
 
+	if event.Rollback {
+		env = append(env, "CDGUN_ROLLBACK=true")
+	}
+	if event.ForcePush {
+		env = append(env, "CDGUN_FORCE_PUSH=true")
+	}
+	if event.Tag != "" {
+		env = append(env, "CDGUN_TAG="+event.Tag)
+	}
+
 	// Add custom environment variables from config
 	for k, v := range action.Env {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
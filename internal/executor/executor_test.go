@@ -0,0 +1,258 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/monitor"
+)
+
+// newTestManager writes content to a temporary config file and loads it
+func newTestManager(t *testing.T, content string) *config.Manager {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	mgr, err := config.NewManager(path)
+	if err != nil {
+		t.Fatalf("NewManager() failed: %v", err)
+	}
+	return mgr
+}
+
+// repoConfig returns a config with the given agent settings and a single
+// repository "hook-repo" watching every path; body holds the rest of the
+// repository settings, such as its action or actions
+func repoConfig(agent, body string) string {
+	var config string
+	if agent != "" {
+		config = "agent:\n" + agent
+	}
+	return config + `repositories:
+  - name: "hook-repo"
+    url: "https://github.com/test/repo.git"
+    watch_paths:
+      - "."
+` + body
+}
+
+// syncBuffer collects log output; the steps of a parallel group log concurrently
+// through loggers sharing it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func newTestExecutor(t *testing.T) *Executor {
+	t.Helper()
+
+	ex, err := NewExecutor(logger.NewLogger("debug", &syncBuffer{}))
+	if err != nil {
+		t.Fatalf("NewExecutor() failed: %v", err)
+	}
+	return ex
+}
+
+func testEvent() *monitor.ChangeEvent {
+	return &monitor.ChangeEvent{
+		RepositoryName: "hook-repo",
+		Files:          []string{"src/main.go"},
+		OldHash:        "aaa",
+		NewHash:        "bbb",
+		DetectedAt:     time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestExecuteWebhookPayloadAndSignature(t *testing.T) {
+	var (
+		gotMethod string
+		gotHeader string
+		gotSig    string
+		gotBody   []byte
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotMethod = r.Method
+		gotHeader = r.Header.Get("X-Team")
+		gotSig = r.Header.Get(SignatureHeader)
+		gotBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	mgr := newTestManager(t, repoConfig("", `    action:
+      type: "webhook"
+      url: "`+srv.URL+`"
+      retry_backoff: "10ms"
+      method: "PUT"
+      secret: "s3cret"
+      headers:
+        X-Team: "platform"
+`))
+	repo := mgr.GetConfig().Repositories[0]
+
+	result, err := newTestExecutor(t).Execute(&repo.Actions[0], testEvent(), mgr)
+	if err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, got error: %s", result.Error)
+	}
+
+	if gotMethod != http.MethodPut {
+		t.Errorf("method = %s, want PUT", gotMethod)
+	}
+	if gotHeader != "platform" {
+		t.Errorf("X-Team header = %q, want %q", gotHeader, "platform")
+	}
+	if want := "sha256=" + signPayload("s3cret", gotBody); gotSig != want {
+		t.Errorf("signature = %q, want %q", gotSig, want)
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(gotBody, &payload); err != nil {
+		t.Fatalf("invalid JSON payload: %v", err)
+	}
+	if payload.Repository != "hook-repo" || payload.OldHash != "aaa" || payload.NewHash != "bbb" {
+		t.Errorf("unexpected payload: %+v", payload)
+	}
+	if len(payload.Files) != 1 || payload.Files[0] != "src/main.go" {
+		t.Errorf("unexpected files: %v", payload.Files)
+	}
+}
+
+func TestExecuteWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		retries      string
+		wantSuccess  bool
+		wantRequests int32
+	}{
+		{"success after 5xx", []int{500, 502, 200}, "2", true, 3},
+		{"retries exhausted", []int{503, 503, 503}, "1", false, 2},
+		{"4xx is not retried", []int{400, 200}, "3", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&requests, 1)
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer srv.Close()
+
+			mgr := newTestManager(t, repoConfig("", `    action:
+      type: "webhook"
+      url: "`+srv.URL+`"
+      retry_backoff: "10ms"
+      retries: `+tt.retries+"\n"))
+			repo := mgr.GetConfig().Repositories[0]
+
+			result, err := newTestExecutor(t).Execute(&repo.Actions[0], testEvent(), mgr)
+			if err != nil {
+				t.Fatalf("Execute() failed: %v", err)
+			}
+			if result.Success != tt.wantSuccess {
+				t.Errorf("Success = %v, want %v (error: %s)", result.Success, tt.wantSuccess, result.Error)
+			}
+			if got := atomic.LoadInt32(&requests); got != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+// customConfig returns a config whose action runs the custom handler
+func customConfig(handler string) string {
+	return repoConfig("", `    action:
+      type: "custom"
+      handler: "`+handler+`"
+`)
+}
+
+func TestExecuteCustomHandler(t *testing.T) {
+	var got *HandlerRequest
+	RegisterHandler("test-record", HandlerFunc(func(_ context.Context, req *HandlerRequest) (*ExecutionResult, error) {
+		got = req
+		return &ExecutionResult{Success: true, Output: "recorded"}, nil
+	}))
+
+	mgr := newTestManager(t, customConfig("test-record"))
+	repo := mgr.GetConfig().Repositories[0]
+
+	result, err := newTestExecutor(t).Execute(&repo.Actions[0], testEvent(), mgr)
+	if err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if !result.Success || result.Output != "recorded" {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if result.RepositoryName != "hook-repo" {
+		t.Errorf("RepositoryName = %q, want %q", result.RepositoryName, "hook-repo")
+	}
+
+	if got == nil {
+		t.Fatal("handler was not called")
+	}
+	if got.Repository.Name != "hook-repo" || got.Event.NewHash != "bbb" {
+		t.Errorf("unexpected handler request: %+v", got)
+	}
+}
+
+func TestExecuteCustomHandlerError(t *testing.T) {
+	RegisterHandler("test-fail", HandlerFunc(func(context.Context, *HandlerRequest) (*ExecutionResult, error) {
+		return nil, errors.New("boom")
+	}))
+
+	mgr := newTestManager(t, customConfig("test-fail"))
+	repo := mgr.GetConfig().Repositories[0]
+
+	result, err := newTestExecutor(t).Execute(&repo.Actions[0], testEvent(), mgr)
+	if err != nil {
+		t.Fatalf("Execute() failed: %v", err)
+	}
+	if result.Success || result.Error != "boom" {
+		t.Errorf("expected failure with handler error, got %+v", result)
+	}
+}
+
+func TestUnknownCustomHandlerRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(customConfig("does-not-exist")), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	if _, err := config.NewManager(path); err == nil {
+		t.Error("expected config validation to reject unknown handler")
+	}
+}
@@ -0,0 +1,127 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/monitor"
+)
+
+// ActionHandler executes a custom action selected by action.handler.
+// Handlers are compiled into the agent and registered with RegisterHandler,
+// typically from an init function.
+type ActionHandler interface {
+	Handle(ctx context.Context, req *HandlerRequest) (*ExecutionResult, error)
+}
+
+// HandlerFunc adapts an ordinary function to the ActionHandler interface
+type HandlerFunc func(ctx context.Context, req *HandlerRequest) (*ExecutionResult, error)
+
+// Handle calls f(ctx, req)
+func (f HandlerFunc) Handle(ctx context.Context, req *HandlerRequest) (*ExecutionResult, error) {
+	return f(ctx, req)
+}
+
+// HandlerRequest is passed to custom action handlers
+type HandlerRequest struct {
+	Repository *config.Repository
+	Action     *config.Action
+	Event      *monitor.ChangeEvent
+	RepoPath   string // local cache path of the repository
+	Logger     *logger.Logger
+}
+
+var (
+	handlersMu sync.RWMutex
+	handlers   = make(map[string]ActionHandler)
+)
+
+func init() {
+	config.SetHandlerLookup(func(name string) bool {
+		_, ok := LookupHandler(name)
+		return ok
+	})
+
+	RegisterHandler("log", HandlerFunc(logHandler))
+}
+
+// RegisterHandler makes a custom action handler available under name.
+// It panics if name is empty, the handler is nil or name is already registered.
+func RegisterHandler(name string, handler ActionHandler) {
+	handlersMu.Lock()
+	defer handlersMu.Unlock()
+
+	if name == "" {
+		panic("executor: RegisterHandler with empty name")
+	}
+	if handler == nil {
+		panic("executor: RegisterHandler handler is nil")
+	}
+	if _, dup := handlers[name]; dup {
+		panic("executor: RegisterHandler called twice for handler " + name)
+	}
+
+	handlers[name] = handler
+}
+
+// LookupHandler returns the custom action handler registered under name
+func LookupHandler(name string) (ActionHandler, bool) {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	handler, ok := handlers[name]
+	return handler, ok
+}
+
+// HandlerNames returns the sorted names of all registered handlers
+func HandlerNames() []string {
+	handlersMu.RLock()
+	defer handlersMu.RUnlock()
+
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// executeCustom runs the registered handler for a custom action
+func (e *Executor) executeCustom(ctx context.Context, action *config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager) (*ExecutionResult, error) {
+
+	handler, ok := LookupHandler(action.Handler)
+	if !ok {
+		return nil, fmt.Errorf("unknown action handler: %s", action.Handler)
+	}
+
+	repo := findRepository(configMgr.GetConfig(), event.RepositoryName)
+	if repo == nil {
+		return nil, fmt.Errorf("repository '%s' not found in config", event.RepositoryName)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, configMgr.GetActionTimeout(action))
+	defer cancel()
+
+	return handler.Handle(ctx, &HandlerRequest{
+		Repository: repo,
+		Action:     action,
+		Event:      event,
+		RepoPath:   configMgr.GetRepositoryLocalPath(event.RepositoryName),
+		Logger:     e.logger,
+	})
+}
+
+// logHandler is the built-in "log" handler. It only records the change event,
+// which is useful for dry runs and for testing repository configuration.
+func logHandler(_ context.Context, req *HandlerRequest) (*ExecutionResult, error) {
+	req.Logger.Infof("Change in '%s' (%s -> %s): %v", req.Event.RepositoryName,
+		req.Event.OldHash, req.Event.NewHash, req.Event.Files)
+
+	return &ExecutionResult{Success: true}, nil
+}
@@ -0,0 +1,174 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/monitor"
+)
+
+// scriptProcess describes the process a shell action or command check runs in
+type scriptProcess struct {
+	dir        string              // working directory, empty for the agent's
+	env        []string            // complete environment
+	credential *syscall.Credential // user and groups, nil for the agent's
+	setup      []string            // shell commands run before the script, e.g. umask
+	nice       int
+}
+
+// newScriptProcess prepares the process settings of an action's scripts
+func (e *Executor) newScriptProcess(action *config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager) (*scriptProcess, error) {
+
+	proc := &scriptProcess{nice: action.Nice}
+
+	var runAs *user.User
+	if action.RunAs != "" {
+		var err error
+		if runAs, proc.credential, err = lookupCredential(action.RunAs); err != nil {
+			return nil, fmt.Errorf("run_as: %w", err)
+		}
+	}
+
+	// The checkout is missing only before the first clone, e.g. in dry runs
+	checkout := configMgr.GetRepositoryLocalPath(event.RepositoryName)
+	switch {
+	case action.WorkingDir == "":
+		if info, err := os.Stat(checkout); err == nil && info.IsDir() {
+			proc.dir = checkout
+		}
+	case filepath.IsAbs(action.WorkingDir):
+		proc.dir = action.WorkingDir
+	default:
+		proc.dir = filepath.Join(checkout, action.WorkingDir)
+	}
+
+	// Later entries win: agent environment, then the user, then CDGUN_* and action env
+	proc.env = passedEnvironment(action)
+	if runAs != nil {
+		proc.env = append(proc.env, "HOME="+runAs.HomeDir, "USER="+runAs.Username, "LOGNAME="+runAs.Username)
+	}
+	proc.env = append(proc.env, e.buildEnvironment(action, event, configMgr)...)
+
+	if action.Umask != "" {
+		proc.setup = append(proc.setup, "umask "+action.Umask)
+	}
+	if l := action.Limits; l != nil {
+		for _, limit := range []struct {
+			flag  string
+			value int64
+		}{
+			{"-t", int64(l.CPU)},
+			{"-v", l.Memory / 1024}, // ulimit counts KiB
+			{"-n", int64(l.NoFile)},
+			{"-u", int64(l.NProc)},
+		} {
+			if limit.value > 0 {
+				proc.setup = append(proc.setup, fmt.Sprintf("ulimit %s %d || exit 126", limit.flag, limit.value))
+			}
+		}
+	}
+
+	return proc, nil
+}
+
+// args returns the command line running a script. Settings that have no
+// process attribute are applied by a bash that then execs the script's bash,
+// so the script keeps its line numbers and process group.
+func (p *scriptProcess) args(script string) []string {
+	if len(p.setup) == 0 && p.nice == 0 {
+		return []string{"bash", "-c", script}
+	}
+
+	launch := `exec bash -c "$1"`
+	if p.nice != 0 {
+		launch = fmt.Sprintf(`exec nice -n %d bash -c "$1"`, p.nice)
+	}
+
+	return []string{"bash", "-c", strings.Join(append(p.setup, launch), "\n"), "bash", script}
+}
+
+// passedEnvironment returns the variables of the agent's environment an action
+// receives
+func passedEnvironment(action *config.Action) []string {
+	if action.InheritEnv {
+		return os.Environ()
+	}
+
+	names := action.PassEnv
+	if len(names) == 0 {
+		names = config.DefaultPassEnv
+	}
+
+	var env []string
+	for _, name := range names {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// lookupCredential resolves "user" or "user:group", by name or numeric ID. The
+// group defaults to the user's primary group. Running as the agent's own user
+// and group needs no credential.
+func lookupCredential(runAs string) (*user.User, *syscall.Credential, error) {
+	name, group, _ := strings.Cut(runAs, ":")
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, numErr := strconv.Atoi(name); numErr != nil {
+			return nil, nil, err
+		}
+		if u, err = user.LookupId(name); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	gid := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if _, numErr := strconv.Atoi(group); numErr != nil {
+				return nil, nil, err
+			}
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, nil, err
+			}
+		}
+		gid = g.Gid
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user '%s' has a non-numeric uid", u.Username)
+	}
+	gidNum, err := strconv.ParseUint(gid, 10, 32)
+	if err != nil {
+		return nil, nil, fmt.Errorf("group '%s' is not numeric", gid)
+	}
+
+	if int(uid) == os.Geteuid() && int(gidNum) == os.Getegid() {
+		return u, nil, nil
+	}
+
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gidNum)}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to look up groups of '%s': %w", u.Username, err)
+	}
+	for _, id := range groupIDs {
+		if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+			credential.Groups = append(credential.Groups, uint32(n))
+		}
+	}
+
+	return u, credential, nil
+}
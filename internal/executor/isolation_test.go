@@ -0,0 +1,109 @@
+package executor
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// runIsolated runs a shell action with extra settings in a repository whose
+// checkout exists, and returns its trimmed output
+func runIsolated(t *testing.T, settings, script string) (output, checkout string) {
+	t.Helper()
+
+	cacheDir := t.TempDir()
+	checkout = filepath.Join(cacheDir, "hook-repo")
+	if err := os.MkdirAll(filepath.Join(checkout, "app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mgr := newTestManager(t, repoConfig(`  cache_dir: "`+cacheDir+`"
+`, `    action:
+      type: "shell"
+      script: '`+script+`'
+`+settings))
+	repo := &mgr.GetConfig().Repositories[0]
+
+	result, err := newTestExecutor(t).ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+	if err != nil {
+		t.Fatalf("ExecuteRepository() failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("action failed: %s", result.Error)
+	}
+
+	return strings.TrimSpace(result.Output), checkout
+}
+
+func TestShellEnvironment(t *testing.T) {
+	t.Setenv("CDGUN_TEST_AGENT_VAR", "from-agent")
+	t.Setenv("HOME", "/home/agent")
+
+	script := `echo "${HOME-unset}|${CDGUN_TEST_AGENT_VAR-unset}|${CDGUN_REPO_NAME}"`
+
+	tests := []struct {
+		name     string
+		settings string
+		want     string
+	}{
+		{"default", "", "/home/agent|unset|hook-repo"},
+		{"pass_env", "      pass_env: [\"CDGUN_TEST_AGENT_VAR\"]\n", "unset|from-agent|hook-repo"},
+		{"inherit_env", "      inherit_env: true\n", "/home/agent|from-agent|hook-repo"},
+		{"action env wins", "      inherit_env: true\n      env:\n        HOME: \"/srv\"\n", "/srv|from-agent|hook-repo"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, _ := runIsolated(t, tt.settings, script); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShellWorkingDir(t *testing.T) {
+	got, checkout := runIsolated(t, "", "pwd")
+	if got != checkout {
+		t.Errorf("default working directory = %q, want the checkout %q", got, checkout)
+	}
+
+	got, checkout = runIsolated(t, "      working_dir: \"app\"\n", "pwd")
+	if want := filepath.Join(checkout, "app"); got != want {
+		t.Errorf("working directory = %q, want %q", got, want)
+	}
+}
+
+func TestShellUmaskLimitsAndNice(t *testing.T) {
+	base, err := exec.Command("nice").Output()
+	if err != nil {
+		t.Skipf("nice not available: %v", err)
+	}
+	niceness, _ := strconv.Atoi(strings.TrimSpace(string(base)))
+
+	got, _ := runIsolated(t, `      umask: "0027"
+      nice: 5
+      limits:
+        nofile: 64
+`, `echo "$(umask) $(ulimit -n) $(nice) $LINENO"`)
+
+	want := "0027 64 " + strconv.Itoa(min(niceness+5, 19)) + " 1"
+	if got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestShellRunAs(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("run_as needs root")
+	}
+
+	// The test's temporary directories are private to root
+	got, _ := runIsolated(t, "      run_as: \"nobody\"\n      working_dir: \"/\"\n", `echo "$(id -un) $USER $PWD"`)
+	if got != "nobody nobody /" {
+		t.Errorf("output = %q, want the script to run as nobody", got)
+	}
+}
@@ -0,0 +1,220 @@
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/monitor"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// maxLineLength bounds a line kept back while waiting for its newline
+const maxLineLength = 16 * 1024
+
+// runLog is the output log file of one run, shared by all of its steps
+type runLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	path    string
+	written int
+	limit   int
+	full    bool
+}
+
+// openRunLog creates the log file of a run. Without a run log directory no
+// log is written and nil is returned.
+func (e *Executor) openRunLog(repository, runID string, configMgr *config.Manager) *runLog {
+	if e.runLogDir == "" {
+		return nil
+	}
+
+	path := state.RunLogPath(e.runLogDir, repository, runID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		e.logger.Warnf("Failed to create run log directory for '%s': %v", repository, err)
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		e.logger.Warnf("Failed to create run log for '%s': %v", repository, err)
+		return nil
+	}
+
+	return &runLog{
+		file:  file,
+		path:  path,
+		limit: configMgr.GetConfig().Agent.Output.MaxLogSize,
+	}
+}
+
+// writeLine appends a line to the log until its size limit is reached
+func (l *runLog) writeLine(line string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.full {
+		return
+	}
+
+	if l.written+len(line)+1 > l.limit {
+		l.full = true
+		line = fmt.Sprintf("[cd-gun: log size limit of %d bytes reached, further output is not logged]", l.limit)
+	}
+
+	n, _ := l.file.WriteString(line + "\n")
+	l.written += n
+}
+
+// Close closes the log file
+func (l *runLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// outputStream receives the stdout and stderr of a running step. Complete lines
+// are streamed to the agent log and the run log as they are written; only the
+// tail of the output is kept in memory.
+type outputStream struct {
+	mu      sync.Mutex
+	logLine func(line string) // nil when streaming to the agent log is off
+	redact  func(string) string
+	runLog  *runLog
+	prefix  string // step label of run log lines, steps of a parallel group interleave
+	partial []byte // output after the last newline
+	tail    []byte
+	limit   int // bytes of tail returned, 0 returns all
+	dropped int // bytes dropped from the front of the tail
+}
+
+// newOutputStream creates the output stream of a step
+func (e *Executor) newOutputStream(action *config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager, log *runLog) *outputStream {
+
+	agent := configMgr.GetConfig().Agent
+	prefix := stepPrefix(action, event)
+
+	stream := &outputStream{
+		redact: configMgr.Redact,
+		runLog: log,
+		prefix: prefix,
+		limit:  agent.History.MaxOutput,
+	}
+
+	switch agent.Output.Stream {
+	case config.StreamInfo:
+		stream.logLine = func(line string) { e.logger.Infof("[%s] %s", prefix, line) }
+	case config.StreamDebug:
+		stream.logLine = func(line string) { e.logger.Debugf("[%s] %s", prefix, line) }
+	}
+
+	return stream
+}
+
+// stepPrefix names a step in streamed output lines: repository[/route]/step
+func stepPrefix(action *config.Action, event *monitor.ChangeEvent) string {
+	parts := []string{event.RepositoryName}
+	if len(event.Routes) == 1 && event.Routes[0].Name != monitor.DefaultRoute {
+		parts = append(parts, event.Routes[0].Name)
+	}
+	if action.Name != "" {
+		parts = append(parts, action.Name)
+	}
+	return strings.Join(parts, "/")
+}
+
+func (s *outputStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keep(p)
+
+	s.partial = append(s.partial, p...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.emit(string(s.partial[:i]))
+		s.partial = s.partial[i+1:]
+	}
+
+	if len(s.partial) > maxLineLength {
+		s.emit(string(s.partial))
+		s.partial = nil
+	}
+
+	return len(p), nil
+}
+
+// keep appends output to the tail, dropping the oldest bytes. At least twice
+// the limit is kept, so that a secret cut by the drop is redacted on Close
+// unless it is longer than the limit, and is then trimmed away.
+func (s *outputStream) keep(p []byte) {
+	s.tail = append(s.tail, p...)
+
+	// Compact only once the tail is three times the limit, so writes stay cheap
+	if s.limit > 0 && len(s.tail) > 3*s.limit {
+		drop := len(s.tail) - 2*s.limit
+		s.dropped += drop
+		s.tail = append(s.tail[:0], s.tail[drop:]...)
+	}
+}
+
+// emit streams a complete line
+func (s *outputStream) emit(line string) {
+	line = s.redact(strings.TrimRight(line, "\r"))
+
+	if s.logLine != nil {
+		s.logLine(line)
+	}
+	s.runLog.writeLine("[" + s.prefix + "] " + line)
+}
+
+// Close flushes an unterminated last line and returns the redacted tail of the
+// output. The tail is redacted before it is trimmed, so the trim cannot cut a
+// secret in a way the redactor no longer recognizes.
+func (s *outputStream) Close() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.partial) > 0 {
+		s.emit(string(s.partial))
+		s.partial = nil
+	}
+
+	output := s.redact(string(s.tail))
+	if s.limit <= 0 || s.dropped == 0 && len(output) <= s.limit {
+		return output
+	}
+
+	// Same format as state.TruncateOutput, sized so the history keeps it as is
+	total := s.dropped + len(output)
+	header := fmt.Sprintf("[... %d bytes truncated ...]\n", total)
+	kept := tail(output, max(s.limit-len(header), 0))
+	return fmt.Sprintf("[... %d bytes truncated ...]\n%s", total-len(kept), kept)
+}
+
+// tail returns the last n bytes of s at most, without splitting a UTF-8 character
+func tail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	start := len(s) - n
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	return s[start:]
+}
@@ -0,0 +1,146 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/omnorm/cd-gun/internal/logger"
+)
+
+// outputConfig returns a config with the given output settings whose deploy
+// step prints 50 lines and a last one without a newline
+func outputConfig(output string) string {
+	return repoConfig(`  history:
+    max_output: 64
+  output:
+`+output+"\n", `    actions:
+      - name: "deploy"
+        type: "shell"
+        script: 'seq 1 50; printf "no newline"'
+`)
+}
+
+func TestExecuteRepositoryStreamsOutput(t *testing.T) {
+	tests := []struct {
+		name       string
+		output     string
+		wantLogged bool
+	}{
+		{name: "info", output: `    stream: "info"`, wantLogged: true},
+		{name: "off", output: `    stream: "off"`, wantLogged: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestManager(t, outputConfig(tt.output))
+			repo := &mgr.GetConfig().Repositories[0]
+
+			var buf syncBuffer
+			ex, err := NewExecutor(logger.NewLogger("info", &buf))
+			if err != nil {
+				t.Fatalf("NewExecutor() failed: %v", err)
+			}
+
+			result, err := ex.ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+			if err != nil || !result.Success {
+				t.Fatalf("ExecuteRepository() failed: %v %s", err, result.Error)
+			}
+
+			logged := buf.String()
+			for _, line := range []string{"[hook-repo/deploy] 1\n", "[hook-repo/deploy] 50\n", "[hook-repo/deploy] no newline"} {
+				if strings.Contains(logged, line) != tt.wantLogged {
+					t.Errorf("line %q logged = %v, want %v", line, !tt.wantLogged, tt.wantLogged)
+				}
+			}
+		})
+	}
+}
+
+func TestExecuteRepositoryOutputTail(t *testing.T) {
+	mgr := newTestManager(t, outputConfig(`    stream: "off"`))
+	repo := &mgr.GetConfig().Repositories[0]
+
+	result, err := newTestExecutor(t).ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+	if err != nil || !result.Success {
+		t.Fatalf("ExecuteRepository() failed: %v %s", err, result.Error)
+	}
+
+	output := result.Steps[0].Output
+	if len(output) > 64 {
+		t.Errorf("output is %d bytes, want at most 64", len(output))
+	}
+	if !strings.HasPrefix(output, "[... ") || !strings.HasSuffix(output, "49\n50\nno newline") {
+		t.Errorf("output = %q, want the truncated tail", output)
+	}
+	if result.LogFile != "" {
+		t.Errorf("LogFile = %q without a run log directory", result.LogFile)
+	}
+}
+
+func TestOutputStreamRedactsBeforeTrimming(t *testing.T) {
+	secret := "s3cr3t-t0ken-value"
+	stream := &outputStream{redact: strings.NewReplacer(secret, "***").Replace, limit: 64}
+
+	// Trimmed before redaction, the tail would start inside the secret
+	fmt.Fprintf(stream, "%s%s%s", strings.Repeat("x", 200), secret, strings.Repeat("é", 10))
+
+	output := stream.Close()
+	if strings.Contains(output, "t0ken") || strings.Contains(output, "value") {
+		t.Errorf("output = %q, leaks part of the secret", output)
+	}
+	if !strings.HasPrefix(output, "[... ") || !strings.Contains(output, "***") || len(output) > 64 {
+		t.Errorf("output = %q, want the redacted tail of at most 64 bytes", output)
+	}
+}
+
+func TestTail(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"abc", 5, "abc"},
+		{"abc", 2, "bc"},
+		{"aéb", 2, "b"}, // not half of é
+		{"aéb", 3, "éb"},
+	} {
+		got := tail(tt.s, tt.n)
+		if got != tt.want || !utf8.ValidString(got) {
+			t.Errorf("tail(%q, %d) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestExecuteRepositoryRunLog(t *testing.T) {
+	mgr := newTestManager(t, outputConfig(`    stream: "off"
+    max_log_size: 120`))
+	repo := &mgr.GetConfig().Repositories[0]
+
+	ex := newTestExecutor(t)
+	ex.SetRunLogDir(t.TempDir())
+
+	result, err := ex.ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+	if err != nil || !result.Success {
+		t.Fatalf("ExecuteRepository() failed: %v %s", err, result.Error)
+	}
+	if result.RunID == "" || !strings.HasSuffix(result.LogFile, result.RunID+".log") {
+		t.Fatalf("LogFile = %q, want the log of run %q", result.LogFile, result.RunID)
+	}
+
+	data, err := os.ReadFile(result.LogFile)
+	if err != nil {
+		t.Fatalf("read run log: %v", err)
+	}
+
+	log := string(data)
+	if !strings.HasPrefix(log, "==> [hook-repo/deploy] shell step started\n[hook-repo/deploy] 1\n") {
+		t.Errorf("run log starts with %q", log)
+	}
+	if !strings.Contains(log, "log size limit of 120 bytes reached") || strings.Contains(log, "no newline") {
+		t.Errorf("run log is not capped: %q", log)
+	}
+}
@@ -0,0 +1,298 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/metrics"
+	"github.com/omnorm/cd-gun/internal/monitor"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// Step statuses reported in StepResult
+const (
+	StepSuccess   = "success"
+	StepFailure   = "failure"
+	StepSkipped   = "skipped"
+	StepCancelled = "cancelled"
+)
+
+// StepResult represents the result of a single pipeline step
+type StepResult struct {
+	Route    string        `json:"route,omitempty"` // route name, empty for top-level actions
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Status   string        `json:"status"` // success, failure, skipped, cancelled
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Output   string        `json:"output,omitempty"` // captured output of shell steps
+	Checks   []CheckResult `json:"checks,omitempty"` // pre_check and verify results
+}
+
+// ExecuteRepository runs the action pipelines of a repository for a change event.
+// Each changed route runs its own pipeline with only its matched files; an event
+// without routes runs the top-level actions with all files. Once ctx is done,
+// running steps are stopped and the result is marked as cancelled.
+func (e *Executor) ExecuteRepository(ctx context.Context, repo *config.Repository, event *monitor.ChangeEvent,
+	configMgr *config.Manager) (*ExecutionResult, error) {
+
+	routes := event.Routes
+	if len(routes) == 0 {
+		routes = []monitor.RouteChange{{Name: monitor.DefaultRoute, Files: event.Files}}
+	}
+
+	result := &ExecutionResult{
+		RepositoryName: event.RepositoryName,
+		Success:        true,
+		ExecutedAt:     time.Now(),
+	}
+	result.RunID = state.NewRunID(result.ExecutedAt)
+
+	log := e.openRunLog(repo.Name, result.RunID, configMgr)
+	defer log.Close()
+	if log != nil {
+		result.LogFile = log.path
+	}
+
+	startTime := time.Now()
+
+	for _, change := range routes {
+		actions := repo.Actions
+		if change.Name != monitor.DefaultRoute {
+			route := repo.FindRoute(change.Name)
+			if route == nil {
+				return nil, fmt.Errorf("repository '%s' has no route '%s'", repo.Name, change.Name)
+			}
+			actions = route.Actions
+		}
+
+		if len(actions) == 0 {
+			return nil, fmt.Errorf("repository '%s' has no actions for route '%s'", repo.Name, change.Name)
+		}
+
+		routeEvent := *event
+		routeEvent.Files = change.Files
+		routeEvent.Routes = []monitor.RouteChange{change}
+
+		if change.Name != monitor.DefaultRoute {
+			e.logger.Infof("Running route '%s' for '%s': %v", change.Name, repo.Name, change.Files)
+		}
+
+		steps, err := e.runPipeline(ctx, actions, &routeEvent, configMgr, log)
+		for i := range steps {
+			steps[i].Route = change.Name
+		}
+		result.Steps = append(result.Steps, steps...)
+
+		if err != nil && result.Success {
+			result.Success = false
+			result.Error = err.Error()
+			if change.Name != monitor.DefaultRoute {
+				result.Error = fmt.Sprintf("route '%s': %s", change.Name, result.Error)
+			}
+		}
+	}
+
+	result.Duration = time.Since(startTime)
+	result.Output = combinedOutput(result.Steps)
+
+	if ctx.Err() != nil {
+		result.Success = false
+		result.Cancelled = true
+		result.Error = "cancelled: " + context.Cause(ctx).Error()
+		log.writeLine("==> run " + result.Error)
+	}
+
+	if result.Success {
+		metrics.LastDeploySuccess.SetToCurrentTime(repo.Name)
+	}
+
+	return result, nil
+}
+
+// runPipeline runs an action pipeline. Steps run in order; adjacent steps with
+// parallel set run concurrently. A failed step stops the pipeline unless it has
+// continue_on_error set, and the first such failure is returned as error. Steps
+// not started before ctx is done are skipped.
+func (e *Executor) runPipeline(ctx context.Context, actions []config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager, log *runLog) ([]StepResult, error) {
+
+	var (
+		results []StepResult
+		failErr error
+	)
+
+	for _, group := range stepGroups(actions) {
+		if failErr != nil || ctx.Err() != nil {
+			for _, action := range group {
+				results = append(results, StepResult{
+					Name:   action.Name,
+					Type:   action.Type,
+					Status: StepSkipped,
+				})
+			}
+			continue
+		}
+
+		for i, step := range e.runGroup(ctx, group, event, configMgr, log) {
+			results = append(results, step)
+
+			if step.Status == StepFailure && !group[i].ContinueOnError && failErr == nil {
+				failErr = fmt.Errorf("step '%s' failed: %s", step.Name, step.Error)
+			}
+		}
+	}
+
+	return results, failErr
+}
+
+// runGroup runs a group of steps, concurrently if it has more than one
+func (e *Executor) runGroup(ctx context.Context, group []*config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager, log *runLog) []StepResult {
+
+	steps := make([]StepResult, len(group))
+	if len(group) == 1 {
+		steps[0] = e.runStep(ctx, group[0], event, configMgr, log)
+		return steps
+	}
+
+	var wg sync.WaitGroup
+	for i, action := range group {
+		wg.Add(1)
+		go func(i int, action *config.Action) {
+			defer wg.Done()
+			steps[i] = e.runStep(ctx, action, event, configMgr, log)
+		}(i, action)
+	}
+	wg.Wait()
+
+	return steps
+}
+
+// runStep executes a single pipeline step with its pre_check and verify
+func (e *Executor) runStep(ctx context.Context, action *config.Action, event *monitor.ChangeEvent,
+	configMgr *config.Manager, log *runLog) (step StepResult) {
+
+	e.logger.Infof("Running step '%s' (%s) for '%s'", action.Name, action.Type, event.RepositoryName)
+	log.writeLine(fmt.Sprintf("==> [%s] %s step started", stepPrefix(action, event), action.Type))
+
+	step = StepResult{
+		Name: action.Name,
+		Type: action.Type,
+	}
+
+	startTime := time.Now()
+	defer func() {
+		if ctx.Err() != nil && step.Status != StepSuccess {
+			// Interrupted, not failed: the step may not have run to its end
+			step.Status = StepCancelled
+			step.Error = "cancelled: " + context.Cause(ctx).Error()
+		}
+
+		step.Duration = time.Since(startTime)
+		metrics.ActionExecutions.Inc(event.RepositoryName, action.Type, step.Status)
+		metrics.ActionDuration.ObserveDuration(step.Duration, event.RepositoryName, action.Type)
+		log.writeLine(fmt.Sprintf("==> [%s] %s after %v", stepPrefix(action, event),
+			step.Status, step.Duration.Round(time.Millisecond)))
+	}()
+
+	if action.PreCheck != nil {
+		check := e.runCheck(ctx, CheckPreCheck, action.PreCheck, action, event, configMgr)
+		step.Checks = append(step.Checks, check)
+		log.writeLine(checkLine(action, event, check))
+		if check.Status != StepSuccess {
+			step.Status = StepFailure
+			step.Error = "pre_check failed: " + check.Error
+			e.logger.Errorf("Pre-check of '%s' failed for '%s', action not run: %s",
+				action.Name, event.RepositoryName, check.Error)
+			return step
+		}
+	}
+
+	res, err := e.execute(ctx, action, event, configMgr, log)
+
+	if res != nil {
+		step.Output = res.Output
+	}
+
+	switch {
+	case err != nil:
+		step.Status = StepFailure
+		step.Error = err.Error()
+	case !res.Success:
+		step.Status = StepFailure
+		step.Error = res.Error
+	default:
+		step.Status = StepSuccess
+	}
+
+	if step.Status == StepSuccess && action.Verify != nil {
+		check := e.runCheck(ctx, CheckVerify, action.Verify, action, event, configMgr)
+		step.Checks = append(step.Checks, check)
+		log.writeLine(checkLine(action, event, check))
+		if check.Status != StepSuccess {
+			step.Status = StepFailure
+			step.Error = "verify failed: " + check.Error
+			e.logger.Errorf("Verification of '%s' failed for '%s' after %d attempt(s): %s",
+				action.Name, event.RepositoryName, check.Attempts, check.Error)
+		}
+	}
+
+	return step
+}
+
+// checkLine describes a check result in the run log
+func checkLine(action *config.Action, event *monitor.ChangeEvent, check CheckResult) string {
+	line := fmt.Sprintf("==> [%s] %s %s after %d attempt(s)", stepPrefix(action, event),
+		check.Stage, check.Status, check.Attempts)
+	if check.Error != "" {
+		line += ": " + check.Error
+	}
+	return line
+}
+
+// combinedOutput joins the output of pipeline steps, headed by step name when
+// there is more than one step
+func combinedOutput(steps []StepResult) string {
+	if len(steps) == 1 {
+		return steps[0].Output
+	}
+
+	var b strings.Builder
+	for _, step := range steps {
+		if step.Output == "" {
+			continue
+		}
+		name := step.Name
+		if step.Route != "" {
+			name = step.Route + "/" + name
+		}
+		fmt.Fprintf(&b, "==> %s\n%s", name, step.Output)
+		if !strings.HasSuffix(step.Output, "\n") {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// stepGroups splits a pipeline into groups executed one after another.
+// Adjacent steps with parallel set form a single group.
+func stepGroups(actions []config.Action) [][]*config.Action {
+	var groups [][]*config.Action
+
+	for i := range actions {
+		action := &actions[i]
+		last := len(groups) - 1
+		if action.Parallel && last >= 0 && groups[last][0].Parallel {
+			groups[last] = append(groups[last], action)
+			continue
+		}
+		groups = append(groups, []*config.Action{action})
+	}
+
+	return groups
+}
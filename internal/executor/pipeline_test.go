@@ -0,0 +1,203 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/monitor"
+)
+
+func TestStepGroups(t *testing.T) {
+	actions := []config.Action{
+		{Name: "migrate"},
+		{Name: "restart-api", Parallel: true},
+		{Name: "restart-worker", Parallel: true},
+		{Name: "notify"},
+		{Name: "cleanup", Parallel: true},
+	}
+
+	var got [][]string
+	for _, group := range stepGroups(actions) {
+		var names []string
+		for _, action := range group {
+			names = append(names, action.Name)
+		}
+		got = append(got, names)
+	}
+
+	want := [][]string{{"migrate"}, {"restart-api", "restart-worker"}, {"notify"}, {"cleanup"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stepGroups() = %v, want %v", got, want)
+	}
+}
+
+func TestExecuteRepositoryPipeline(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       string
+		wantSuccess bool
+		wantStatus  []string
+	}{
+		{
+			name: "all steps succeed",
+			steps: `      - type: "shell"
+        script: "true"
+      - type: "shell"
+        script: "true"
+`,
+			wantSuccess: true,
+			wantStatus:  []string{StepSuccess, StepSuccess},
+		},
+		{
+			name: "failure stops pipeline",
+			steps: `      - type: "shell"
+        script: "false"
+      - type: "shell"
+        script: "true"
+`,
+			wantSuccess: false,
+			wantStatus:  []string{StepFailure, StepSkipped},
+		},
+		{
+			name: "continue on error",
+			steps: `      - type: "shell"
+        script: "false"
+        continue_on_error: true
+      - type: "shell"
+        script: "true"
+`,
+			wantSuccess: true,
+			wantStatus:  []string{StepFailure, StepSuccess},
+		},
+		{
+			name: "parallel group failure skips later steps",
+			steps: `      - type: "shell"
+        script: "false"
+        parallel: true
+      - type: "shell"
+        script: "true"
+        parallel: true
+      - type: "shell"
+        script: "true"
+`,
+			wantSuccess: false,
+			wantStatus:  []string{StepFailure, StepSuccess, StepSkipped},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mgr := newTestManager(t, repoConfig("", "    actions:\n"+tt.steps))
+			repo := &mgr.GetConfig().Repositories[0]
+
+			result, err := newTestExecutor(t).ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+			if err != nil {
+				t.Fatalf("ExecuteRepository() failed: %v", err)
+			}
+			if result.Success != tt.wantSuccess {
+				t.Errorf("Success = %v, want %v (error: %s)", result.Success, tt.wantSuccess, result.Error)
+			}
+
+			var status []string
+			for _, step := range result.Steps {
+				status = append(status, step.Status)
+			}
+			if !reflect.DeepEqual(status, tt.wantStatus) {
+				t.Errorf("step status = %v, want %v", status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestExecuteRepositoryRoutes(t *testing.T) {
+	mgr := newTestManager(t, `repositories:
+  - name: "hook-repo"
+    url: "https://github.com/test/repo.git"
+    routes:
+      - name: "api"
+        watch_paths:
+          - "services/api/"
+        action:
+          type: "shell"
+          script: 'test "$CDGUN_CHANGED_FILES" = "services/api/main.go"'
+      - name: "web"
+        watch_paths:
+          - "services/web/"
+        action:
+          type: "shell"
+          script: "false"
+`)
+	repo := &mgr.GetConfig().Repositories[0]
+
+	event := testEvent()
+	event.Routes = []monitor.RouteChange{{Name: "api", Files: []string{"services/api/main.go"}}}
+
+	result, err := newTestExecutor(t).ExecuteRepository(context.Background(), repo, event, mgr)
+	if err != nil {
+		t.Fatalf("ExecuteRepository() failed: %v", err)
+	}
+	if !result.Success {
+		t.Fatalf("expected success, got error: %s", result.Error)
+	}
+	if len(result.Steps) != 1 || result.Steps[0].Route != "api" {
+		t.Errorf("expected only the api route to run, got %+v", result.Steps)
+	}
+}
+
+func TestExecuteRepositoryOutput(t *testing.T) {
+	mgr := newTestManager(t, repoConfig("", `    actions:
+      - name: "build"
+        type: "shell"
+        script: "echo building; echo warning >&2"
+      - name: "deploy"
+        type: "shell"
+        script: "echo deployed"
+`))
+	repo := &mgr.GetConfig().Repositories[0]
+
+	result, err := newTestExecutor(t).ExecuteRepository(context.Background(), repo, testEvent(), mgr)
+	if err != nil {
+		t.Fatalf("ExecuteRepository() failed: %v", err)
+	}
+
+	if got := result.Steps[0].Output; got != "building\nwarning\n" {
+		t.Errorf("build output = %q", got)
+	}
+	if want := "==> build\nbuilding\nwarning\n==> deploy\ndeployed\n"; result.Output != want {
+		t.Errorf("Output = %q, want %q", result.Output, want)
+	}
+}
+
+func TestExecuteRepositoryCancel(t *testing.T) {
+	mgr := newTestManager(t, repoConfig(`  stop_grace_period: "100ms"
+`, `    actions:
+      - type: "shell"
+        script: "sleep 30"
+      - type: "shell"
+        script: "true"
+`))
+	repo := &mgr.GetConfig().Repositories[0]
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(200*time.Millisecond, func() { cancel(errors.New("shutting down")) })
+
+	result, err := newTestExecutor(t).ExecuteRepository(ctx, repo, testEvent(), mgr)
+	if err != nil {
+		t.Fatalf("ExecuteRepository() failed: %v", err)
+	}
+	if !result.Cancelled || result.Success || result.Error != "cancelled: shutting down" {
+		t.Errorf("Cancelled = %v, Success = %v, Error = %q", result.Cancelled, result.Success, result.Error)
+	}
+
+	var status []string
+	for _, step := range result.Steps {
+		status = append(status, step.Status)
+	}
+	if want := []string{StepCancelled, StepSkipped}; !reflect.DeepEqual(status, want) {
+		t.Errorf("step status = %v, want %v", status, want)
+	}
+}
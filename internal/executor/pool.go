@@ -0,0 +1,145 @@
+package executor
+
+import (
+	"sync"
+
+	"github.com/omnorm/cd-gun/internal/metrics"
+)
+
+// Pool runs repository jobs concurrently. At most limit jobs run at a time,
+// jobs of one repository run one at a time in submission order, and jobs that
+// share a named lock never run at the same time.
+type Pool struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	queue   []*poolJob
+	busy    map[string]bool // repositories with a running job
+	held    map[string]bool // named locks held by running jobs
+	wg      sync.WaitGroup
+}
+
+// poolJob is a queued unit of work for a repository
+type poolJob struct {
+	repo  string
+	locks []string
+	run   func()
+}
+
+// NewPool creates a pool running at most limit jobs at a time
+func NewPool(limit int) *Pool {
+	return &Pool{
+		limit: max(limit, 1),
+		busy:  make(map[string]bool),
+		held:  make(map[string]bool),
+	}
+}
+
+// SetLimit changes the number of concurrent jobs. Running jobs are not affected.
+func (p *Pool) SetLimit(limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.limit = max(limit, 1)
+	p.dispatch()
+}
+
+// Submit queues a job for a repository. The job starts once the repository is
+// idle, all of its locks are free and the limit allows it.
+func (p *Pool) Submit(repo string, locks []string, run func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.wg.Add(1)
+	p.queue = append(p.queue, &poolJob{repo: repo, locks: locks, run: run})
+	p.dispatch()
+}
+
+// Status returns whether a job of a repository is running and how many are queued
+func (p *Pool) Status(repo string) (running bool, queued int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, job := range p.queue {
+		if job.repo == repo {
+			queued++
+		}
+	}
+
+	return p.busy[repo], queued
+}
+
+// Wait blocks until all submitted jobs have finished
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
+
+// dispatch starts every queued job that may run now. A job that has to wait
+// reserves its repository and locks, so later jobs cannot overtake it.
+// p.mu must be held.
+func (p *Pool) dispatch() {
+	reserved := make(map[string]bool)
+	reservedRepos := make(map[string]bool)
+
+	var waiting []*poolJob
+	for _, job := range p.queue {
+		if p.running >= p.limit || !p.canStart(job, reserved, reservedRepos) {
+			reservedRepos[job.repo] = true
+			for _, lock := range job.locks {
+				reserved[lock] = true
+			}
+			waiting = append(waiting, job)
+			continue
+		}
+
+		p.start(job)
+	}
+	p.queue = waiting
+
+	metrics.ActionsRunning.Set(float64(p.running))
+	metrics.ActionsQueued.Set(float64(len(p.queue)))
+}
+
+// canStart reports whether a job's repository and locks are free
+func (p *Pool) canStart(job *poolJob, reserved, reservedRepos map[string]bool) bool {
+	if p.busy[job.repo] || reservedRepos[job.repo] {
+		return false
+	}
+
+	for _, lock := range job.locks {
+		if p.held[lock] || reserved[lock] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// start marks a job as running and runs it in its own goroutine. p.mu must be held.
+func (p *Pool) start(job *poolJob) {
+	p.running++
+	p.busy[job.repo] = true
+	for _, lock := range job.locks {
+		p.held[lock] = true
+	}
+
+	go func() {
+		defer p.wg.Done()
+		defer p.finish(job)
+		job.run()
+	}()
+}
+
+// finish releases a job's repository and locks and starts waiting jobs
+func (p *Pool) finish(job *poolJob) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running--
+	delete(p.busy, job.repo)
+	for _, lock := range job.locks {
+		delete(p.held, lock)
+	}
+
+	p.dispatch()
+}
@@ -0,0 +1,121 @@
+package executor
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrency tracks how many jobs of a group run at the same time
+type concurrency struct {
+	current atomic.Int32
+	peak    atomic.Int32
+}
+
+func (c *concurrency) run() {
+	n := c.current.Add(1)
+	for {
+		peak := c.peak.Load()
+		if n <= peak || c.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	c.current.Add(-1)
+}
+
+func TestPoolLimit(t *testing.T) {
+	pool := NewPool(2)
+
+	var all concurrency
+	for i := 0; i < 6; i++ {
+		pool.Submit(fmt.Sprintf("repo-%d", i), nil, all.run)
+	}
+	pool.Wait()
+
+	if peak := all.peak.Load(); peak != 2 {
+		t.Errorf("peak concurrency = %d, want 2", peak)
+	}
+}
+
+func TestPoolRepositoryOrder(t *testing.T) {
+	pool := NewPool(4)
+
+	var (
+		mu    sync.Mutex
+		order []int
+		repo  concurrency
+	)
+	for i := 0; i < 5; i++ {
+		pool.Submit("app", nil, func() {
+			repo.run()
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+
+	if running, queued := pool.Status("app"); !running || queued != 4 {
+		t.Errorf("Status() = %v, %d, want true, 4", running, queued)
+	}
+
+	pool.Wait()
+
+	if peak := repo.peak.Load(); peak != 1 {
+		t.Errorf("peak concurrency of one repository = %d, want 1", peak)
+	}
+	if fmt.Sprint(order) != "[0 1 2 3 4]" {
+		t.Errorf("order = %v, want submission order", order)
+	}
+}
+
+func TestPoolLocks(t *testing.T) {
+	pool := NewPool(4)
+
+	var shared, all concurrency
+	for _, repo := range []string{"a", "b", "c"} {
+		pool.Submit(repo, []string{"db"}, func() {
+			all.run()
+			shared.run()
+		})
+	}
+	pool.Submit("d", []string{"other"}, all.run)
+	pool.Wait()
+
+	if peak := shared.peak.Load(); peak != 1 {
+		t.Errorf("peak concurrency of lock holders = %d, want 1", peak)
+	}
+	if peak := all.peak.Load(); peak < 2 {
+		t.Errorf("peak concurrency = %d, want the unlocked job to run alongside", peak)
+	}
+}
+
+func TestPoolWaitingJobKeepsItsTurn(t *testing.T) {
+	pool := NewPool(4)
+
+	release := make(chan struct{})
+	started := make(chan string, 3)
+
+	// "a" holds "x"; "b" needs "x" and "y"; "c" needs only "y" but must not overtake "b"
+	pool.Submit("a", []string{"x"}, func() { started <- "a"; <-release })
+	pool.Submit("b", []string{"x", "y"}, func() { started <- "b" })
+	pool.Submit("c", []string{"y"}, func() { started <- "c" })
+
+	if got := <-started; got != "a" {
+		t.Fatalf("first job = %s, want a", got)
+	}
+	select {
+	case got := <-started:
+		t.Fatalf("job %s started while its lock was reserved", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	pool.Wait()
+
+	if first, second := <-started, <-started; first != "b" || second != "c" {
+		t.Errorf("order = %s, %s, want b, c", first, second)
+	}
+}
@@ -0,0 +1,55 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// runScript runs a bash script in its own process group until it exits or ctx
+// is done. On cancellation or timeout the whole group gets SIGTERM, and SIGKILL
+// if it is still running after grace, so child processes of the script do not
+// outlive it. Background processes that keep the output open after the script
+// exited are waited for up to grace as well; what is left of a cancelled
+// group when runScript returns gets SIGKILL.
+func runScript(ctx context.Context, proc *scriptProcess, script string, out io.Writer, grace time.Duration) error {
+	args := proc.args(script)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = proc.dir
+	cmd.Env = proc.env
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: proc.credential}
+
+	// Cancel runs before Run returns, which orders the write of kill before the
+	// read below
+	var kill *time.Timer
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		kill = time.AfterFunc(grace, func() {
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = grace
+
+	err := cmd.Run()
+	if kill != nil && kill.Stop() {
+		// Once the group is empty its id may be reused, so the timer must not fire
+		// later. Processes the script left behind still hold the id and are killed now.
+		_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+
+	switch {
+	case errors.Is(err, exec.ErrWaitDelay):
+		// The script itself succeeded, only its output could not be read to the end
+		return nil
+	case errors.Is(err, syscall.EPERM) && proc.credential != nil:
+		return fmt.Errorf("%w (run_as needs the agent to run as root or with CAP_SETUID and CAP_SETGID)", err)
+	}
+	return err
+}
@@ -0,0 +1,77 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processRunning reports whether a process exists and is not a zombie
+func processRunning(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestRunScriptCancel(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{name: "sigterm", script: `sleep 30 & echo $! > "$PIDFILE"; wait`},
+		{name: "sigkill after grace", script: `trap "" TERM; sleep 30 & echo $! > "$PIDFILE"; wait`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidFile := filepath.Join(t.TempDir(), "pid")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			errCh := make(chan error, 1)
+			start := time.Now()
+			go func() {
+				var out bytes.Buffer
+				proc := &scriptProcess{env: []string{"PIDFILE=" + pidFile}}
+				errCh <- runScript(ctx, proc, tt.script, &out, 200*time.Millisecond)
+			}()
+
+			var pid int
+			for pid == 0 && time.Since(start) < 5*time.Second {
+				data, _ := os.ReadFile(pidFile)
+				pid, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+				time.Sleep(10 * time.Millisecond)
+			}
+			if pid == 0 {
+				t.Fatal("script did not start its child process")
+			}
+
+			cancel()
+
+			select {
+			case err := <-errCh:
+				if err == nil {
+					t.Error("runScript() succeeded, want an error")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("runScript() did not return after cancellation")
+			}
+
+			// The child is part of the process group and is stopped with the script
+			deadline := time.Now().Add(2 * time.Second)
+			for processRunning(pid) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if processRunning(pid) {
+				t.Errorf("child process %d still running", pid)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package hooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Supported forges
+const (
+	ForgeGitHub = "github"
+	ForgeGitLab = "gitlab"
+	ForgeGitea  = "gitea"
+)
+
+var (
+	errNotConfigured = errors.New("receiver not configured for this forge")
+	errSignature     = errors.New("invalid signature")
+)
+
+// pushEvent is the forge-independent part of a push webhook
+type pushEvent struct {
+	Ref  string   // full ref, e.g. "refs/heads/main"
+	URLs []string // all URLs the forge reports for the pushed repository
+}
+
+// githubPayload is the push payload of GitHub; Gitea uses the same fields
+type githubPayload struct {
+	Ref        string `json:"ref"`
+	Repository struct {
+		URL      string `json:"url"`
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		GitURL   string `json:"git_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// gitlabPayload is the push payload of GitLab
+type gitlabPayload struct {
+	Ref     string `json:"ref"`
+	Project struct {
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+	Repository struct {
+		URL        string `json:"url"`
+		GitHTTPURL string `json:"git_http_url"`
+		GitSSHURL  string `json:"git_ssh_url"`
+		Homepage   string `json:"homepage"`
+	} `json:"repository"`
+}
+
+// parseGitHubPush parses a GitHub or Gitea push payload
+func parseGitHubPush(body []byte) (*pushEvent, error) {
+	var p githubPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	r := p.Repository
+	return &pushEvent{
+		Ref:  p.Ref,
+		URLs: nonEmpty(r.URL, r.CloneURL, r.SSHURL, r.GitURL, r.HTMLURL),
+	}, nil
+}
+
+// parseGitLabPush parses a GitLab push payload
+func parseGitLabPush(body []byte) (*pushEvent, error) {
+	var p gitlabPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid payload: %w", err)
+	}
+
+	return &pushEvent{
+		Ref: p.Ref,
+		URLs: nonEmpty(p.Project.GitHTTPURL, p.Project.GitSSHURL, p.Project.WebURL,
+			p.Repository.URL, p.Repository.GitHTTPURL, p.Repository.GitSSHURL, p.Repository.Homepage),
+	}, nil
+}
+
+// verifyHMAC checks a hex-encoded HMAC-SHA256 signature of body, with an
+// optional "sha256=" prefix as sent by GitHub
+func verifyHMAC(secret, signature string, body []byte) error {
+	if secret == "" {
+		return errNotConfigured
+	}
+
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || len(got) == 0 {
+		return errSignature
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errSignature
+	}
+
+	return nil
+}
+
+// verifyToken checks a shared token as sent by GitLab
+func verifyToken(token, got string) error {
+	if token == "" {
+		return errNotConfigured
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(got)) != 1 {
+		return errSignature
+	}
+	return nil
+}
+
+// eventType returns the normalized event name of a request and whether it is
+// a push event
+func eventType(forge string, header http.Header) (string, bool) {
+	switch forge {
+	case ForgeGitHub:
+		event := header.Get("X-GitHub-Event")
+		return event, event == "push"
+	case ForgeGitLab:
+		event := header.Get("X-Gitlab-Event")
+		return event, event == "Push Hook" || event == "Tag Push Hook"
+	case ForgeGitea:
+		event := header.Get("X-Gitea-Event")
+		return event, event == "push"
+	}
+	return "", false
+}
+
+// normalizeURL reduces a repository URL to "host/path" so that the HTTPS, SSH
+// and scp-like forms of the same repository compare equal
+func normalizeURL(raw string) string {
+	u := strings.TrimSpace(raw)
+
+	var host, path string
+	if i := strings.Index(u, "://"); i >= 0 {
+		host, path, _ = strings.Cut(u[i+3:], "/")
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+		host, _, _ = strings.Cut(host, ":") // drop port
+	} else {
+		// scp-like syntax: [user@]host:path
+		host, path, _ = strings.Cut(u, ":")
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+	}
+
+	path = strings.Trim(path, "/")
+	path = strings.TrimSuffix(path, ".git")
+
+	return strings.ToLower(host + "/" + path)
+}
+
+func nonEmpty(values ...string) []string {
+	var out []string
+	for _, v := range values {
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
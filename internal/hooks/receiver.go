@@ -0,0 +1,212 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/metrics"
+)
+
+// maxBodySize limits the size of accepted webhook payloads
+const maxBodySize = 10 << 20
+
+// TriggerFunc starts an immediate check of a configured repository
+type TriggerFunc func(name string) error
+
+// Receiver accepts push webhooks from Git forges and triggers checks of the
+// matching repositories
+type Receiver struct {
+	listen    string
+	configMgr *config.Manager
+	trigger   TriggerFunc
+	logger    *logger.Logger
+	srv       *http.Server
+	listener  net.Listener
+}
+
+// NewReceiver creates a push webhook receiver listening on a TCP address.
+// Secrets and repositories are read from configMgr on every request, so
+// reloads apply without a restart.
+func NewReceiver(listen string, configMgr *config.Manager, trigger TriggerFunc, log *logger.Logger) *Receiver {
+	r := &Receiver{
+		listen:    listen,
+		configMgr: configMgr,
+		trigger:   trigger,
+		logger:    log,
+	}
+
+	r.srv = &http.Server{
+		Handler:           r.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return r
+}
+
+// Handler returns the HTTP handler serving the forge endpoints
+func (r *Receiver) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /hooks/github", r.handle(ForgeGitHub))
+	mux.HandleFunc("POST /hooks/gitlab", r.handle(ForgeGitLab))
+	mux.HandleFunc("POST /hooks/gitea", r.handle(ForgeGitea))
+
+	return mux
+}
+
+// Start starts listening and serving in the background
+func (r *Receiver) Start() error {
+	listener, err := net.Listen("tcp", r.listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", r.listen, err)
+	}
+
+	r.listener = listener
+	r.logger.Infof("Push hook receiver listening on %s", r.listen)
+
+	go func() {
+		if err := r.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			r.logger.Errorf("Push hook receiver error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown gracefully stops the receiver
+func (r *Receiver) Shutdown(ctx context.Context) error {
+	if r.listener == nil {
+		return nil
+	}
+	return r.srv.Shutdown(ctx)
+}
+
+// handle returns the handler for one forge
+func (r *Receiver) handle(forge string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxBodySize))
+		if err != nil {
+			r.reply(w, forge, "invalid", http.StatusBadRequest, map[string]string{"error": "failed to read body"})
+			return
+		}
+
+		if err := r.verify(forge, req.Header, body); err != nil {
+			r.logger.Warnf("Rejected %s push hook from %s: %v", forge, req.RemoteAddr, err)
+			status := http.StatusUnauthorized
+			if errors.Is(err, errNotConfigured) {
+				status = http.StatusForbidden
+			}
+			r.reply(w, forge, "unauthorized", status, map[string]string{"error": err.Error()})
+			return
+		}
+
+		event, isPush := eventType(forge, req.Header)
+		if !isPush {
+			r.logger.Debugf("Ignoring %s event '%s'", forge, event)
+			r.reply(w, forge, "ignored", http.StatusOK, map[string]string{"status": "ignored", "event": event})
+			return
+		}
+
+		parse := parseGitHubPush
+		if forge == ForgeGitLab {
+			parse = parseGitLabPush
+		}
+		push, err := parse(body)
+		if err != nil {
+			r.reply(w, forge, "invalid", http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		names := matchRepositories(r.configMgr.GetConfig().Repositories, push)
+		if len(names) == 0 {
+			r.logger.Debugf("No repository matches %s push to %v (%s)", forge, push.URLs, push.Ref)
+			r.reply(w, forge, "ignored", http.StatusOK, map[string]interface{}{"triggered": []string{}})
+			return
+		}
+
+		triggered := []string{}
+		for _, name := range names {
+			if err := r.trigger(name); err != nil {
+				r.logger.Warnf("Push hook for '%s' not triggered: %v", name, err)
+				continue
+			}
+			r.logger.Infof("Push hook from %s triggered check of '%s'", forge, name)
+			triggered = append(triggered, name)
+		}
+
+		r.reply(w, forge, "triggered", http.StatusAccepted, map[string]interface{}{"triggered": triggered})
+	}
+}
+
+// verify authenticates a request with the secret configured for its forge
+func (r *Receiver) verify(forge string, header http.Header, body []byte) error {
+	hooks := r.configMgr.GetConfig().Agent.PushHooks
+
+	switch forge {
+	case ForgeGitHub:
+		return verifyHMAC(hooks.GitHubSecret, header.Get("X-Hub-Signature-256"), body)
+	case ForgeGitLab:
+		return verifyToken(hooks.GitLabToken, header.Get("X-Gitlab-Token"))
+	case ForgeGitea:
+		return verifyHMAC(hooks.GiteaSecret, header.Get("X-Gitea-Signature"), body)
+	}
+	return errNotConfigured
+}
+
+// reply writes a JSON response and counts the request
+func (r *Receiver) reply(w http.ResponseWriter, forge, result string, status int, v interface{}) {
+	metrics.PushHooks.Inc(forge, result)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// matchRepositories returns the names of repositories whose URL and branch
+// match a push event. A pushed tag matches repositories tracking tags whose
+// pattern it matches.
+func matchRepositories(repos []config.Repository, push *pushEvent) []string {
+	branch, isBranch := strings.CutPrefix(push.Ref, "refs/heads/")
+	tag, isTag := strings.CutPrefix(push.Ref, "refs/tags/")
+	if !isBranch && !isTag {
+		return nil
+	}
+
+	urls := make(map[string]bool, len(push.URLs))
+	for _, u := range push.URLs {
+		urls[normalizeURL(u)] = true
+	}
+
+	var names []string
+	for _, repo := range repos {
+		if !urls[normalizeURL(repo.URL)] {
+			continue
+		}
+
+		switch {
+		case isBranch && repo.Tags == nil && repo.Branch == branch:
+		case isTag && repo.Tags != nil && matchTag(repo.Tags.Pattern, tag):
+		default:
+			continue
+		}
+		names = append(names, repo.Name)
+	}
+
+	return names
+}
+
+// matchTag reports whether a tag name matches a tag pattern
+func matchTag(pattern, tag string) bool {
+	ok, _ := path.Match(pattern, tag)
+	return ok
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync/atomic"
 )
 
 // LogLevel represents the severity level of a log message
@@ -20,12 +21,13 @@ const (
 
 // Logger provides logging functionality for cd-gun
 type Logger struct {
-	level    LogLevel
+	level    atomic.Int32 // LogLevel, changed by SetLevel on reload
 	debugLog *log.Logger
 	infoLog  *log.Logger
 	warnLog  *log.Logger
 	errorLog *log.Logger
 	out      io.Writer
+	redact   func(string) string
 }
 
 // NewLogger creates a new logger with the specified level
@@ -34,43 +36,43 @@ func NewLogger(level string, out io.Writer) *Logger {
 		out = os.Stdout
 	}
 
-	lvl := parseLevel(level)
-
-	return &Logger{
-		level:    lvl,
+	l := &Logger{
 		debugLog: log.New(out, "[DEBUG] ", log.LstdFlags|log.Lshortfile),
 		infoLog:  log.New(out, "[INFO] ", log.LstdFlags),
 		warnLog:  log.New(out, "[WARN] ", log.LstdFlags),
 		errorLog: log.New(out, "[ERROR] ", log.LstdFlags|log.Lshortfile),
 		out:      out,
 	}
+	l.SetLevel(level)
+
+	return l
 }
 
 // Debug logs a debug message
 func (l *Logger) Debug(msg string, args ...interface{}) {
-	if l.level <= DebugLevel {
-		l.debugLog.Printf(msg, args...)
+	if l.enabled(DebugLevel) {
+		l.debugLog.Print(l.format(msg, args...))
 	}
 }
 
 // Info logs an info message
 func (l *Logger) Info(msg string, args ...interface{}) {
-	if l.level <= InfoLevel {
-		l.infoLog.Printf(msg, args...)
+	if l.enabled(InfoLevel) {
+		l.infoLog.Print(l.format(msg, args...))
 	}
 }
 
 // Warn logs a warning message
 func (l *Logger) Warn(msg string, args ...interface{}) {
-	if l.level <= WarnLevel {
-		l.warnLog.Printf(msg, args...)
+	if l.enabled(WarnLevel) {
+		l.warnLog.Print(l.format(msg, args...))
 	}
 }
 
 // Error logs an error message
 func (l *Logger) Error(msg string, args ...interface{}) {
-	if l.level <= ErrorLevel {
-		l.errorLog.Printf(msg, args...)
+	if l.enabled(ErrorLevel) {
+		l.errorLog.Print(l.format(msg, args...))
 	}
 }
 
@@ -96,7 +98,12 @@ func (l *Logger) Errorf(format string, args ...interface{}) {
 
 // SetLevel changes the log level
 func (l *Logger) SetLevel(level string) {
-	l.level = parseLevel(level)
+	l.level.Store(int32(parseLevel(level)))
+}
+
+// enabled reports whether messages of a level are logged
+func (l *Logger) enabled(level LogLevel) bool {
+	return LogLevel(l.level.Load()) <= level
 }
 
 // parseLevel converts a string to LogLevel
@@ -117,5 +124,20 @@ func parseLevel(level string) LogLevel {
 
 // Printf is a convenience method that always prints (ignores level)
 func (l *Logger) Printf(format string, args ...interface{}) {
-	fmt.Fprintf(l.out, format, args...)
+	fmt.Fprint(l.out, l.format(format, args...))
+}
+
+// SetRedactor installs a function applied to every message before it is written,
+// used to hide secret values
+func (l *Logger) SetRedactor(redact func(string) string) {
+	l.redact = redact
+}
+
+// format formats a message and applies the redactor
+func (l *Logger) format(format string, args ...interface{}) string {
+	msg := fmt.Sprintf(format, args...)
+	if l.redact != nil {
+		msg = l.redact(msg)
+	}
+	return msg
 }
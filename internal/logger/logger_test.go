@@ -2,6 +2,7 @@ package logger
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -80,3 +81,21 @@ func TestNewLoggerWithNilWriter(t *testing.T) {
 	// Should use os.Stdout as fallback
 	log.Info("test message")
 }
+
+func TestLoggerRedactor(t *testing.T) {
+	var buf bytes.Buffer
+	log := NewLogger("info", &buf)
+	log.SetRedactor(func(s string) string {
+		return strings.ReplaceAll(s, "hunter2", "***")
+	})
+
+	log.Infof("password is %s", "hunter2")
+	log.Printf("again: hunter2\n")
+
+	if strings.Contains(buf.String(), "hunter2") {
+		t.Errorf("secret not redacted: %q", buf.String())
+	}
+	if !strings.Contains(buf.String(), "password is ***") {
+		t.Errorf("unexpected output: %q", buf.String())
+	}
+}
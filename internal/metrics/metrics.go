@@ -0,0 +1,351 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Agent metrics, labeled by repository name where they relate to one
+var (
+	FetchDuration = NewHistogram("cdgun_git_fetch_duration_seconds",
+		"Duration of git fetch operations.",
+		[]float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		"repository")
+	FetchErrors = NewCounter("cdgun_git_fetch_errors_total",
+		"Failed git fetch operations by reason.",
+		"repository", "reason")
+	LastFetchSuccess = NewGauge("cdgun_git_last_fetch_success_timestamp_seconds",
+		"Unix time of the last successful git fetch.",
+		"repository")
+	ChangeEvents = NewCounter("cdgun_change_events_total",
+		"Change events emitted by repository monitors.",
+		"repository")
+	ChangeEventsDropped = NewCounter("cdgun_change_events_dropped_total",
+		"Change events replaced by a newer event before they were handled.",
+		"repository")
+	ActionExecutions = NewCounter("cdgun_action_executions_total",
+		"Executed action steps by type and status.",
+		"repository", "type", "status")
+	ActionDuration = NewHistogram("cdgun_action_duration_seconds",
+		"Duration of action steps.",
+		[]float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600, 1800},
+		"repository", "type")
+	ActionsRunning = NewGauge("cdgun_actions_running",
+		"Repository jobs (deploys and rollbacks) currently running.")
+	ActionsQueued = NewGauge("cdgun_actions_queued",
+		"Repository jobs waiting for their repository, a named lock or a free slot.")
+	LastDeploySuccess = NewGauge("cdgun_last_success_timestamp_seconds",
+		"Unix time of the last change event whose actions all succeeded.",
+		"repository")
+	Rollbacks = NewCounter("cdgun_rollbacks_total",
+		"Rollbacks by trigger (rollback, auto_rollback) and status.",
+		"repository", "trigger", "status")
+	ForcePushes = NewCounter("cdgun_force_pushes_total",
+		"Rewrites of watched branches detected, by force-push policy.",
+		"repository", "policy")
+	PushHooks = NewCounter("cdgun_push_hooks_total",
+		"Push webhooks received from Git forges by result.",
+		"forge", "result")
+)
+
+// registry holds all metrics in registration order
+var (
+	registryMu sync.Mutex
+	registry   []*metric
+)
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// metric is a named metric family with a fixed set of label names
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is a single labeled time series of a metric
+type series struct {
+	labelValues []string
+	value       float64  // counter and gauge value
+	counts      []uint64 // histogram bucket counts (non-cumulative)
+	count       uint64
+	sum         float64
+}
+
+// Counter is a monotonically increasing metric
+type Counter struct{ m *metric }
+
+// Gauge is a metric that can be set to any value
+type Gauge struct{ m *metric }
+
+// Histogram counts observations in buckets
+type Histogram struct{ m *metric }
+
+// NewCounter registers a counter with the given label names
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{register(name, help, kindCounter, labels, nil)}
+}
+
+// NewGauge registers a gauge with the given label names
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{register(name, help, kindGauge, labels, nil)}
+}
+
+// NewHistogram registers a histogram with the given upper bucket bounds and label names
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &Histogram{register(name, help, kindHistogram, labels, sorted)}
+}
+
+func register(name, help, kind string, labels []string, buckets []float64) *metric {
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+
+	return m
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increments the counter by v, which must not be negative
+func (c *Counter) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	c.m.update(labelValues, func(s *series) { s.value += v })
+}
+
+// Value returns the current counter value
+func (c *Counter) Value(labelValues ...string) float64 {
+	return c.m.value(labelValues)
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.m.update(labelValues, func(s *series) { s.value = v })
+}
+
+// SetToCurrentTime sets the gauge to the current Unix time
+func (g *Gauge) SetToCurrentTime(labelValues ...string) {
+	g.Set(float64(time.Now().UnixNano())/1e9, labelValues...)
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value(labelValues ...string) float64 {
+	return g.m.value(labelValues)
+}
+
+// Observe adds an observation to the histogram
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.m.update(labelValues, func(s *series) {
+		for i, bound := range h.m.buckets {
+			if v <= bound {
+				s.counts[i]++
+				break
+			}
+		}
+		s.count++
+		s.sum += v
+	})
+}
+
+// ObserveDuration adds a duration in seconds to the histogram
+func (h *Histogram) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count(labelValues ...string) uint64 {
+	h.m.mu.Lock()
+	defer h.m.mu.Unlock()
+
+	if s, ok := h.m.series[seriesKey(labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (m *metric) update(labelValues []string, fn func(*series)) {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+
+	key := seriesKey(labelValues)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == kindHistogram {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	fn(s)
+}
+
+func (m *metric) value(labelValues []string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s, ok := m.series[seriesKey(labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func seriesKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// DeleteRepository removes all series of a repository, e.g. after it was
+// removed from the configuration
+func DeleteRepository(name string) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for _, m := range registry {
+		if len(m.labels) == 0 || m.labels[0] != "repository" {
+			continue
+		}
+
+		m.mu.Lock()
+		for key, s := range m.series {
+			if s.labelValues[0] == name {
+				delete(m.series, key)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// Write writes all metrics in the Prometheus text exposition format
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	metrics := append([]*metric(nil), registry...)
+	registryMu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (m *metric) write(w *bufio.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.labelValues)
+
+		if m.kind != kindHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, wrapLabels(labels), formatFloat(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range m.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name,
+				wrapLabels(appendLabel(labels, "le", formatFloat(bound))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrapLabels(appendLabel(labels, "le", "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, wrapLabels(labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, wrapLabels(labels), s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	var b strings.Builder
+	for i, name := range names {
+		b.WriteString(appendLabel("", name, values[i]))
+		if i < len(names)-1 {
+			b.WriteByte(',')
+		}
+	}
+	return b.String()
+}
+
+func appendLabel(labels, name, value string) string {
+	label := name + `="` + escapeLabelValue(value) + `"`
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler returns an HTTP handler serving the metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = Write(w)
+	})
+}
@@ -0,0 +1,119 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterAndGaugeExposition(t *testing.T) {
+	c := NewCounter("test_requests_total", "Test requests.", "repository", "status")
+	g := NewGauge("test_last_seconds", "Test gauge.", "repository")
+
+	c.Inc("web", "success")
+	c.Inc("web", "success")
+	c.Inc("api", "failure")
+	g.Set(1.5, "web")
+
+	if got := c.Value("web", "success"); got != 2 {
+		t.Errorf("counter value = %v, want 2", got)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	out := buf.String()
+
+	for _, want := range []string{
+		"# HELP test_requests_total Test requests.\n",
+		"# TYPE test_requests_total counter\n",
+		`test_requests_total{repository="api",status="failure"} 1` + "\n",
+		`test_requests_total{repository="web",status="success"} 2` + "\n",
+		"# TYPE test_last_seconds gauge\n",
+		`test_last_seconds{repository="web"} 1.5` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+
+	// Series are sorted by label values
+	if strings.Index(out, `repository="api"`) > strings.Index(out, `repository="web",status`) {
+		t.Errorf("series not sorted:\n%s", out)
+	}
+}
+
+func TestHistogramExposition(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Test durations.", []float64{1, 0.5}, "repository")
+
+	h.Observe(0.2, "web")
+	h.Observe(0.7, "web")
+	h.Observe(3, "web")
+
+	if got := h.Count("web"); got != 3 {
+		t.Errorf("Count() = %d, want 3", got)
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	want := `# HELP test_duration_seconds Test durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{repository="web",le="0.5"} 1
+test_duration_seconds_bucket{repository="web",le="1"} 2
+test_duration_seconds_bucket{repository="web",le="+Inf"} 3
+test_duration_seconds_sum{repository="web"} 3.9
+test_duration_seconds_count{repository="web"} 3
+`
+	if !strings.Contains(buf.String(), want) {
+		t.Errorf("unexpected histogram output:\n%s", buf.String())
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	c := NewCounter("test_escape_total", "Escaping.", "repository")
+	c.Inc("a\"b\\c\nd")
+
+	var buf bytes.Buffer
+	if err := Write(&buf); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	if want := `test_escape_total{repository="a\"b\\c\nd"} 1`; !strings.Contains(buf.String(), want) {
+		t.Errorf("output missing %q:\n%s", want, buf.String())
+	}
+}
+
+func TestDeleteRepository(t *testing.T) {
+	c := NewCounter("test_delete_total", "Delete.", "repository")
+	c.Inc("keep")
+	c.Inc("gone")
+
+	DeleteRepository("gone")
+
+	if c.Value("gone") != 0 || c.Value("keep") != 1 {
+		t.Errorf("unexpected values after delete: gone=%v keep=%v", c.Value("gone"), c.Value("keep"))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	ChangeEvents.Inc("handler-repo")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+	}
+	if want := `cdgun_change_events_total{repository="handler-repo"} 1`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("body missing %q", want)
+	}
+}
@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/logger"
+)
+
+// Server serves the metrics endpoint at /metrics
+type Server struct {
+	listen   string
+	logger   *logger.Logger
+	srv      *http.Server
+	listener net.Listener
+}
+
+// NewServer creates a metrics server listening on a TCP address
+func NewServer(listen string, log *logger.Logger) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", Handler())
+
+	return &Server{
+		listen: listen,
+		logger: log,
+		srv: &http.Server{
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Start starts listening and serving in the background
+func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.listen, err)
+	}
+
+	s.listener = listener
+	s.logger.Infof("Metrics listening on %s", s.listen)
+
+	go func() {
+		if err := s.srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("Metrics server error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown gracefully stops the server
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.srv.Shutdown(ctx)
+}
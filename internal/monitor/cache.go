@@ -0,0 +1,155 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/logger"
+)
+
+const (
+	// quarantineDir is the directory in the cache directory damaged caches are moved to
+	quarantineDir = ".quarantine"
+
+	// cacheOwnerKey is the git config key naming the repository a cache belongs to
+	cacheOwnerKey = "cdgun.repository"
+)
+
+// clonePath returns the path a cache is cloned to before it is moved into place
+func clonePath(repoPath string) string {
+	return filepath.Join(filepath.Dir(repoPath), "."+filepath.Base(repoPath)+".clone")
+}
+
+// quarantine moves a cache to <cache_dir>/.quarantine/<name>/<time>, replacing
+// an earlier quarantined cache of the repository, and returns its new path
+func quarantine(repoPath string) (string, error) {
+	dir := filepath.Join(filepath.Dir(repoPath), quarantineDir, filepath.Base(repoPath))
+	if err := os.RemoveAll(dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.Rename(repoPath, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// markCache records in the git config of a cache which repository it belongs
+// to, so only caches of the agent are ever removed
+func markCache(repoPath, name string) error {
+	if cacheOwner(repoPath) == name {
+		return nil
+	}
+
+	output, err := exec.Command("git", "-C", repoPath, "config", cacheOwnerKey, name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to mark repository cache: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// cacheOwner returns the repository a cache belongs to, empty if the directory
+// is not a cache of the agent
+func cacheOwner(repoPath string) string {
+	// Read the config file itself, git -C would find the config of a parent repository
+	output, err := exec.Command("git", "config", "--file", filepath.Join(repoPath, ".git", "config"),
+		"--get", cacheOwnerKey).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// samePath reports whether two paths name the same file, following symlinks
+func samePath(a, b string) bool {
+	if resolved, err := filepath.EvalSymlinks(a); err == nil {
+		a = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(b); err == nil {
+		b = resolved
+	}
+	return filepath.Clean(a) == filepath.Clean(b)
+}
+
+// RemoveCache removes the cache of a repository with its incomplete clone and
+// quarantined caches. A directory that is not a cache of the repository is kept.
+func RemoveCache(cacheDir, name string) error {
+	repoPath := filepath.Join(cacheDir, name)
+
+	var errs []error
+	if _, err := os.Stat(repoPath); err == nil {
+		if owner := cacheOwner(repoPath); owner != name {
+			errs = append(errs, fmt.Errorf("'%s' is not a repository cache of the agent, keeping it", repoPath))
+		} else if err := os.RemoveAll(repoPath); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, path := range []string{clonePath(repoPath), filepath.Join(cacheDir, quarantineDir, name)} {
+		if err := os.RemoveAll(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// PruneCache removes everything in the cache directory that does not belong
+// to a configured repository: caches of removed repositories, their quarantined
+// caches, and clones that were interrupted. It must not run while monitors clone.
+func PruneCache(cacheDir string, names []string, log *logger.Logger) {
+	configured := make(map[string]bool, len(names))
+	for _, name := range names {
+		configured[name] = true
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Failed to read cache directory: %v", err)
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(cacheDir, name)
+
+		switch {
+		case !entry.IsDir():
+			continue
+
+		case name == quarantineDir:
+			quarantined, _ := os.ReadDir(path)
+			for _, q := range quarantined {
+				if !configured[q.Name()] {
+					removeCacheEntry(log, filepath.Join(path, q.Name()), "quarantined cache of removed repository")
+				}
+			}
+
+		case strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".clone"):
+			removeCacheEntry(log, path, "incomplete clone")
+
+		case !configured[name] && cacheOwner(path) == name:
+			removeCacheEntry(log, path, "cache of removed repository")
+		}
+	}
+}
+
+// removeCacheEntry removes a directory of the cache directory and logs it
+func removeCacheEntry(log *logger.Logger, path, what string) {
+	if err := os.RemoveAll(path); err != nil {
+		log.Warnf("Failed to remove %s '%s': %v", what, path, err)
+		return
+	}
+	log.Infof("Removed %s '%s'", what, path)
+}
@@ -0,0 +1,96 @@
+package monitor
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/omnorm/cd-gun/internal/logger"
+)
+
+// newTestCache creates a repository in the cache directory, marked as the
+// cache of owner unless owner is empty
+func newTestCache(t *testing.T, cacheDir, name, owner string) string {
+	t.Helper()
+
+	path := filepath.Join(cacheDir, name)
+	if out, err := exec.Command("git", "init", "-q", path).CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %v\n%s", err, out)
+	}
+	if owner != "" {
+		if err := markCache(path, owner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+func TestPruneCache(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	cacheDir := t.TempDir()
+	kept := []string{
+		newTestCache(t, cacheDir, "app", "app"),
+		newTestCache(t, cacheDir, "unmarked", ""),
+		newTestCache(t, cacheDir, "renamed", "other"),
+		filepath.Join(cacheDir, quarantineDir, "app", "20260101T000000Z"),
+	}
+	removed := []string{
+		newTestCache(t, cacheDir, "gone", "gone"),
+		filepath.Join(cacheDir, ".app.clone"),
+		filepath.Join(cacheDir, ".gone.clone"),
+		filepath.Join(cacheDir, quarantineDir, "gone"),
+	}
+	for _, dir := range []string{kept[3], removed[1], removed[2], removed[3]} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	PruneCache(cacheDir, []string{"app"}, logger.NewLogger("info", &bytes.Buffer{}))
+
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("'%s' was removed: %v", path, err)
+		}
+	}
+	for _, path := range removed {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("'%s' was not removed", path)
+		}
+	}
+}
+
+func TestRemoveCache(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	cacheDir := t.TempDir()
+	cache := newTestCache(t, cacheDir, "app", "app")
+	quarantined := filepath.Join(cacheDir, quarantineDir, "app", "20260101T000000Z")
+	if err := os.MkdirAll(quarantined, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveCache(cacheDir, "app"); err != nil {
+		t.Fatalf("RemoveCache() failed: %v", err)
+	}
+	for _, path := range []string{cache, quarantined} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("'%s' was not removed", path)
+		}
+	}
+
+	foreign := newTestCache(t, cacheDir, "data", "")
+	if err := RemoveCache(cacheDir, "data"); err == nil {
+		t.Error("RemoveCache() of a directory the agent did not clone succeeded")
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Errorf("'%s' was removed: %v", foreign, err)
+	}
+}
@@ -0,0 +1,187 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/omnorm/cd-gun/internal/config"
+)
+
+// Errors classifying failed remote git operations. They are wrapped into the
+// returned error and can be tested with errors.Is.
+var (
+	ErrAuthentication = errors.New("authentication failed")
+	ErrHostKey        = errors.New("host key verification failed")
+	ErrNetwork        = errors.New("network error")
+)
+
+// Environment variables passing HTTPS credentials to the credential helper.
+// Secrets are only ever placed in the git process environment, never in its
+// arguments or in the remote URL.
+const (
+	envGitUsername = "CDGUN_GIT_USERNAME"
+	envGitPassword = "CDGUN_GIT_PASSWORD"
+)
+
+// credentialHelper answers git credential requests from the environment
+const credentialHelper = `!f() { test "$1" = get || exit 0; ` +
+	`echo "username=${` + envGitUsername + `}"; echo "password=${` + envGitPassword + `}"; }; f`
+
+// defaultTokenUsername is used for token authentication when no username is configured
+const defaultTokenUsername = "oauth2"
+
+// remoteCommand builds a git command that talks to the remote of a repository,
+// configured with the repository's authentication
+func (g *GitHelper) remoteCommand(repo *config.Repository, args ...string) (*exec.Cmd, error) {
+	var (
+		gitArgs []string
+		env     = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	)
+
+	switch repo.Auth.Type {
+	case "ssh":
+		env = append(env, "GIT_SSH_COMMAND="+sshCommand(&repo.Auth))
+
+	case "https":
+		username, password, err := httpsCredentials(&repo.Auth)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without credentials the repository is accessed anonymously
+		if password != "" {
+			// Reset inherited helpers so no other helper can answer or store credentials
+			gitArgs = append(gitArgs, "-c", "credential.helper=", "-c", "credential.helper="+credentialHelper)
+			env = append(env, envGitUsername+"="+username, envGitPassword+"="+password)
+		}
+	}
+
+	cmd := exec.Command("git", append(gitArgs, args...)...)
+	cmd.Env = env
+
+	return cmd, nil
+}
+
+// sshCommand returns the GIT_SSH_COMMAND for SSH authentication. Host keys are
+// always checked strictly, against the pinned known_hosts file if configured.
+func sshCommand(auth *config.Auth) string {
+	parts := []string{"ssh", "-o", "BatchMode=yes", "-o", "StrictHostKeyChecking=yes"}
+
+	if auth.Credentials != "" {
+		parts = append(parts, "-i", shellQuote(auth.Credentials), "-o", "IdentitiesOnly=yes")
+	}
+
+	if auth.KnownHosts != "" {
+		parts = append(parts, "-o", "UserKnownHostsFile="+shellQuote(auth.KnownHosts))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// httpsCredentials resolves the username and password for HTTPS authentication.
+// Credentials is the absolute path of a file containing a token; a token given
+// directly is the password. A token without a username gets the default one.
+// An empty password means anonymous access.
+func httpsCredentials(auth *config.Auth) (string, string, error) {
+	username, password := auth.Username, auth.Password
+
+	if auth.Credentials != "" {
+		// Validated as absolute at load time; a relative path would depend on
+		// the working directory of the agent
+		if !filepath.IsAbs(auth.Credentials) {
+			return "", "", fmt.Errorf("credentials must be the absolute path of a token file")
+		}
+		data, err := os.ReadFile(auth.Credentials)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read credentials file: %w", err)
+		}
+		password = strings.TrimSpace(string(data))
+	}
+
+	if password != "" && username == "" {
+		username = defaultTokenUsername
+	}
+
+	return username, password, nil
+}
+
+// shellQuote quotes s for use in a POSIX shell command line
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteError wraps a failed remote git operation, classifying it as an
+// authentication, host key or network failure where the output allows
+func remoteError(op string, err error, output []byte) error {
+	out := strings.TrimSpace(string(output))
+
+	if kind := classifyGitOutput(out); kind != nil {
+		return fmt.Errorf("%s failed: %w: %w, output: %s", op, kind, err, out)
+	}
+
+	return fmt.Errorf("%s failed: %w, output: %s", op, err, out)
+}
+
+// fetchErrorReason returns the metrics label for a remote operation error
+func fetchErrorReason(err error) string {
+	switch {
+	case errors.Is(err, ErrAuthentication):
+		return "auth"
+	case errors.Is(err, ErrHostKey):
+		return "host_key"
+	case errors.Is(err, ErrNetwork):
+		return "network"
+	default:
+		return "other"
+	}
+}
+
+// localFailure reports whether a failed git operation may have been caused by
+// the local cache rather than by the remote
+func localFailure(err error) bool {
+	if errors.Is(err, ErrAuthentication) || errors.Is(err, ErrHostKey) || errors.Is(err, ErrNetwork) ||
+		errors.Is(err, ErrNoMatchingTag) {
+		return false
+	}
+	// The branch does not exist on the remote
+	return !strings.Contains(err.Error(), "couldn't find remote ref")
+}
+
+// classifyGitOutput maps well-known git and ssh error messages to error kinds
+func classifyGitOutput(output string) error {
+	lower := strings.ToLower(output)
+
+	switch {
+	case strings.Contains(lower, "host key verification failed"),
+		strings.Contains(lower, "no matching host key"),
+		strings.Contains(lower, "remote host identification has changed"):
+		return ErrHostKey
+
+	case strings.Contains(lower, "authentication failed"),
+		strings.Contains(lower, "permission denied"),
+		strings.Contains(lower, "could not read username"),
+		strings.Contains(lower, "could not read password"),
+		strings.Contains(lower, "terminal prompts disabled"),
+		strings.Contains(lower, "invalid username or password"),
+		strings.Contains(lower, "the requested url returned error: 401"),
+		strings.Contains(lower, "the requested url returned error: 403"):
+		return ErrAuthentication
+
+	case strings.Contains(lower, "could not resolve host"),
+		strings.Contains(lower, "connection refused"),
+		strings.Contains(lower, "connection timed out"),
+		strings.Contains(lower, "operation timed out"),
+		strings.Contains(lower, "network is unreachable"),
+		strings.Contains(lower, "no route to host"),
+		strings.Contains(lower, "failed to connect"),
+		strings.Contains(lower, "connection reset"),
+		strings.Contains(lower, "could not read from remote repository"):
+		return ErrNetwork
+	}
+
+	return nil
+}
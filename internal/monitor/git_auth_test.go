@@ -0,0 +1,177 @@
+package monitor
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/logger"
+)
+
+func TestRemoteCommandHTTPSKeepsSecretsOutOfArgs(t *testing.T) {
+	helper := NewGitHelper(t.TempDir(), logger.NewLogger("info", &bytes.Buffer{}))
+	repo := &config.Repository{
+		URL:  "https://git.example.com/team/app.git",
+		Auth: config.Auth{Type: "https", Password: "tok-123-secret"},
+	}
+
+	cmd, err := helper.remoteCommand(repo, "fetch", "origin", "main")
+	if err != nil {
+		t.Fatalf("remoteCommand() failed: %v", err)
+	}
+
+	if strings.Contains(strings.Join(cmd.Args, " "), "tok-123-secret") {
+		t.Errorf("token leaked into process arguments: %v", cmd.Args)
+	}
+
+	env := strings.Join(cmd.Env, "\n")
+	if !strings.Contains(env, envGitPassword+"=tok-123-secret") {
+		t.Error("token not passed through the environment")
+	}
+	if !strings.Contains(env, envGitUsername+"="+defaultTokenUsername) {
+		t.Error("default token username not set")
+	}
+}
+
+func TestHTTPSCredentialsFromFile(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	username, password, err := httpsCredentials(&config.Auth{Credentials: tokenFile, Username: "deploy"})
+	if err != nil {
+		t.Fatalf("httpsCredentials() failed: %v", err)
+	}
+	if username != "deploy" || password != "file-token" {
+		t.Errorf("got %q/%q, want deploy/file-token", username, password)
+	}
+
+	if _, _, err := httpsCredentials(&config.Auth{Credentials: "/does/not/exist"}); err == nil {
+		t.Error("expected error for missing credentials file")
+	}
+
+	// Neither read from the working directory nor sent as the token
+	if _, _, err := httpsCredentials(&config.Auth{Credentials: "token"}); err == nil {
+		t.Error("expected error for relative credentials path")
+	}
+}
+
+func TestSSHCommand(t *testing.T) {
+	got := sshCommand(&config.Auth{Credentials: "/etc/cd-gun/keys/deploy key", KnownHosts: "/etc/cd-gun/known_hosts"})
+
+	for _, want := range []string{
+		"StrictHostKeyChecking=yes",
+		"-i '/etc/cd-gun/keys/deploy key'",
+		"IdentitiesOnly=yes",
+		"UserKnownHostsFile='/etc/cd-gun/known_hosts'",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("sshCommand() = %q, missing %q", got, want)
+		}
+	}
+}
+
+func TestClassifyGitOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		want   error
+	}{
+		{"fatal: Authentication failed for 'https://git.example.com/app.git/'", ErrAuthentication},
+		{"git@github.com: Permission denied (publickey).", ErrAuthentication},
+		{"fatal: could not read Username for 'https://github.com': terminal prompts disabled", ErrAuthentication},
+		{"Host key verification failed.\nfatal: Could not read from remote repository.", ErrHostKey},
+		{"fatal: unable to access 'https://nope/': Could not resolve host: nope", ErrNetwork},
+		{"ssh: connect to host example.com port 22: Connection refused", ErrNetwork},
+		{"fatal: couldn't find remote ref release", nil},
+	}
+
+	for _, tt := range tests {
+		if got := classifyGitOutput(tt.output); got != tt.want {
+			t.Errorf("classifyGitOutput(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+// newHTTPRemote serves a test remote over smart HTTP with basic auth
+func newHTTPRemote(t *testing.T, remote *testRemote, username, password string) string {
+	t.Helper()
+
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skip("git exec path not available")
+	}
+	backend := filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend")
+	if _, err := os.Stat(backend); err != nil {
+		t.Skip("git-http-backend not available")
+	}
+
+	handler := &cgi.Handler{
+		Path: backend,
+		Env: []string{
+			"GIT_PROJECT_ROOT=" + filepath.Dir(remote.path),
+			"GIT_HTTP_EXPORT_ALL=1",
+		},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != username || pass != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv.URL + "/" + filepath.Base(remote.path)
+}
+
+func TestCloneWithHTTPSToken(t *testing.T) {
+	remote := newTestRemote(t)
+	url := newHTTPRemote(t, remote, "deploy", "s3cret-token")
+
+	tests := []struct {
+		name    string
+		auth    config.Auth
+		wantErr error
+	}{
+		{"valid token", config.Auth{Type: "https", Username: "deploy", Password: "s3cret-token"}, nil},
+		{"wrong token", config.Auth{Type: "https", Username: "deploy", Password: "wrong"}, ErrAuthentication},
+		{"no credentials", config.Auth{Type: "https"}, ErrAuthentication},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			helper := NewGitHelper(filepath.Join(t.TempDir(), "cache"), logger.NewLogger("info", &bytes.Buffer{}))
+			repo := &config.Repository{Name: "app", URL: url, Branch: "main", Auth: tt.auth}
+
+			err := helper.EnsureRepository(repo)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("EnsureRepository() failed: %v", err)
+				}
+				if err := helper.Fetch(repo); err != nil {
+					t.Fatalf("Fetch() failed: %v", err)
+				}
+				return
+			}
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EnsureRepository() error = %v, want %v", err, tt.wantErr)
+			}
+			if strings.Contains(err.Error(), "s3cret-token") {
+				t.Errorf("error leaks token: %v", err)
+			}
+		})
+	}
+}
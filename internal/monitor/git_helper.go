@@ -1,13 +1,20 @@
 package monitor
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/omnorm/cd-gun/internal/config"
 	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/metrics"
+	"github.com/omnorm/cd-gun/internal/state"
 )
 
 // GitHelper provides git operations
@@ -24,62 +31,234 @@ func NewGitHelper(repoPath string, log *logger.Logger) *GitHelper {
 	}
 }
 
-// EnsureRepository ensures the repository is initialized locally
+// EnsureRepository ensures the repository is initialized locally. An existing
+// cache that fails verification is quarantined and cloned again.
 func (g *GitHelper) EnsureRepository(repo *config.Repository) error {
-	// Check if repo already exists
-	if _, err := os.Stat(g.repoPath); err == nil {
-		// Repository exists, verify it
-		return g.verifyRepository(repo)
+	if _, err := os.Stat(g.repoPath); err != nil {
+		return g.clone(repo)
 	}
 
-	// Clone the repository
+	if err := g.verifyRepository(repo); err != nil {
+		return g.reclone(repo, err)
+	}
+
+	// Watch paths or the sparse option may have changed since the clone
+	return g.applySparseCheckout(repo)
+}
+
+// Repair checks the integrity of the cache after a git operation failed for a
+// reason other than the remote. A corrupt cache is quarantined and cloned
+// again. It reports whether the cache was replaced.
+func (g *GitHelper) Repair(repo *config.Repository) (bool, error) {
+	output, err := exec.Command("git", "-C", g.repoPath, "fsck", "--connectivity-only", "--no-progress").CombinedOutput()
+	if err == nil {
+		return false, nil
+	}
+
+	reason := strings.TrimSpace(string(output))
+	if line, _, ok := strings.Cut(reason, "\n"); ok {
+		reason = line
+	}
+	return true, g.reclone(repo, fmt.Errorf("git fsck failed: %s", reason))
+}
+
+// reclone quarantines the cache for the reason given and clones the repository again
+func (g *GitHelper) reclone(repo *config.Repository, reason error) error {
+	dest, err := quarantine(g.repoPath)
+	if err != nil {
+		return fmt.Errorf("repository cache is unusable (%v) and cannot be quarantined: %w", reason, err)
+	}
+
+	g.logger.Warnf("Repository cache of '%s' is unusable (%v), moved it to '%s' and cloning again",
+		repo.Name, reason, dest)
+
 	return g.clone(repo)
 }
 
-// clone clones a repository
+// clone clones a repository. It is cloned next to the cache and moved into
+// place once complete, so an interrupted clone never leaves a partial cache.
 func (g *GitHelper) clone(repo *config.Repository) error {
-	// Create parent directory
-	parentDir := strings.TrimSuffix(g.repoPath, "/"+strings.Split(g.repoPath, "/")[len(strings.Split(g.repoPath, "/"))-1])
-	if err := os.MkdirAll(parentDir, 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(g.repoPath), 0755); err != nil {
 		return fmt.Errorf("failed to create directory: %w", err)
 	}
 
+	tmp := &GitHelper{repoPath: clonePath(g.repoPath), logger: g.logger}
+
+	// Left over by a clone that was interrupted
+	if err := os.RemoveAll(tmp.repoPath); err != nil {
+		return fmt.Errorf("failed to remove incomplete clone: %w", err)
+	}
+
+	if err := tmp.cloneInPlace(repo); err != nil {
+		_ = os.RemoveAll(tmp.repoPath)
+		return err
+	}
+
+	if err := os.Rename(tmp.repoPath, g.repoPath); err != nil {
+		_ = os.RemoveAll(tmp.repoPath)
+		return fmt.Errorf("failed to move clone into place: %w", err)
+	}
+
+	g.logger.Debugf("Cloned repository '%s' to '%s'", repo.URL, g.repoPath)
+	return nil
+}
+
+// cloneInPlace clones a repository into the helper's path and marks it as
+// the cache of the repository
+func (g *GitHelper) cloneInPlace(repo *config.Repository) error {
 	args := []string{"clone"}
 	if repo.Branch != "" {
 		args = append(args, "--branch", repo.Branch)
 	}
+	args = append(args, cloneArgs(&repo.Clone)...)
 	args = append(args, repo.URL, g.repoPath)
 
-	cmd := exec.Command("git", args...)
+	cmd, err := g.remoteCommand(repo, args...)
+	if err != nil {
+		return fmt.Errorf("git clone failed: %w", err)
+	}
 	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git clone failed: %w, output: %s", err, string(output))
+		return remoteError("git clone", err, output)
 	}
 
-	g.logger.Debugf("Cloned repository '%s' to '%s'", repo.URL, g.repoPath)
+	if err := markCache(g.repoPath, repo.Name); err != nil {
+		return err
+	}
+
+	if repo.Clone.Sparse {
+		return g.applySparseCheckout(repo)
+	}
 	return nil
 }
 
-// verifyRepository verifies that the repository exists and is valid
+// cloneArgs returns the git clone options for the clone options of a repository
+func cloneArgs(opts *config.CloneOptions) []string {
+	var args []string
+	if opts.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(opts.Depth))
+	}
+	if opts.SingleBranch {
+		args = append(args, "--single-branch")
+	}
+	if opts.Filter != "" {
+		args = append(args, "--filter="+opts.Filter)
+	}
+	if opts.Sparse {
+		// Only files in the root until the sparse checkout is set up
+		args = append(args, "--sparse")
+	}
+	return args
+}
+
+// verifyRepository checks that the cache is a repository of its own, cloned
+// from the configured URL, whose checked out commit can be read
 func (g *GitHelper) verifyRepository(repo *config.Repository) error {
-	// Check if it's a valid git repository
-	cmd := exec.Command("git", "-C", g.repoPath, "rev-parse", "--git-dir")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("invalid git repository at %s: %w", g.repoPath, err)
+	gitDir, err := exec.Command("git", "-C", g.repoPath, "rev-parse", "--absolute-git-dir").Output()
+	if err != nil {
+		return errors.New("not a git repository")
+	}
+	if !samePath(strings.TrimSpace(string(gitDir)), filepath.Join(g.repoPath, ".git")) {
+		return fmt.Errorf("not a git repository, it is inside the repository of '%s'", strings.TrimSpace(string(gitDir)))
+	}
+
+	url, _ := exec.Command("git", "-C", g.repoPath, "config", "--get", "remote.origin.url").Output()
+	if current := strings.TrimSpace(string(url)); current != repo.URL {
+		return fmt.Errorf("cloned from '%s', but the configured URL is '%s'", current, repo.URL)
 	}
 
+	// HEAD is unborn in clones of an empty repository
+	head, err := exec.Command("git", "-C", g.repoPath, "rev-parse", "--verify", "--quiet", "HEAD").Output()
+	if err == nil {
+		hash := strings.TrimSpace(string(head))
+		if err := exec.Command("git", "-C", g.repoPath, "cat-file", "-e", hash+"^{commit}").Run(); err != nil {
+			return fmt.Errorf("the checked out commit %s cannot be read", state.ShortHash(hash))
+		}
+	}
+
+	// Caches cloned by earlier versions are not marked yet
+	return markCache(g.repoPath, repo.Name)
+}
+
+// applySparseCheckout limits the working tree to the sparse directories of a
+// repository, or restores the full working tree if it is no longer sparse.
+// Nothing is done if the working tree is already set up this way.
+func (g *GitHelper) applySparseCheckout(repo *config.Repository) error {
+	enabled, _ := exec.Command("git", "-C", g.repoPath, "config", "--bool", "core.sparseCheckout").Output()
+	sparse := strings.TrimSpace(string(enabled)) == "true"
+
+	var args []string
+	switch {
+	case !repo.Clone.Sparse && !sparse:
+		return nil
+	case !repo.Clone.Sparse:
+		args = []string{"sparse-checkout", "disable"}
+	default:
+		dirs := repo.SparseDirs()
+		if sparse {
+			current, err := exec.Command("git", "-C", g.repoPath, "sparse-checkout", "list").Output()
+			if err == nil && strings.Join(strings.Fields(string(current)), "\n") == strings.Join(dirs, "\n") {
+				return nil
+			}
+		}
+		// Paths naming a file are checked out with the other files of their directory
+		args = append([]string{"sparse-checkout", "set", "--cone", "--skip-checks", "--"}, dirs...)
+	}
+
+	// Checking out files of a partial clone fetches them from the remote
+	cmd, err := g.remoteCommand(repo, append([]string{"-C", g.repoPath}, args...)...)
+	if err != nil {
+		return fmt.Errorf("git sparse-checkout failed: %w", err)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return remoteError("git sparse-checkout", err, output)
+	}
+
+	g.logger.Debugf("Sparse checkout of '%s': %v", repo.Name, repo.SparseDirs())
 	return nil
 }
 
 // Fetch fetches from remote repository
 func (g *GitHelper) Fetch(repo *config.Repository) error {
-	cmd := exec.Command("git", "-C", g.repoPath, "fetch", "origin", repo.Branch)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("git fetch failed: %w, output: %s", err, string(output))
+	args := []string{"-C", g.repoPath, "fetch"}
+	if repo.Clone.Depth > 0 {
+		args = append(args, "--depth", strconv.Itoa(repo.Clone.Depth))
 	}
+	if repo.Tags != nil {
+		// Tags deleted on the remote must not be selected any more
+		args = append(args, "--prune")
+	}
+	args = append(args, "origin", fetchRefspec(repo))
+
+	cmd, err := g.remoteCommand(repo, args...)
+	if err != nil {
+		metrics.FetchErrors.Inc(repo.Name, "config")
+		return fmt.Errorf("git fetch failed: %w", err)
+	}
+
+	startTime := time.Now()
+	output, err := cmd.CombinedOutput()
+	metrics.FetchDuration.ObserveDuration(time.Since(startTime), repo.Name)
 
+	if err != nil {
+		err = remoteError("git fetch", err, output)
+		metrics.FetchErrors.Inc(repo.Name, fetchErrorReason(err))
+		return err
+	}
+
+	metrics.LastFetchSuccess.SetToCurrentTime(repo.Name)
 	return nil
 }
 
+// fetchRefspec returns the refspec fetching what a repository deploys from: all
+// tags in tag mode, otherwise its branch. An explicit refspec also updates
+// origin/<branch> in single-branch clones of another branch.
+func fetchRefspec(repo *config.Repository) string {
+	if repo.Tags != nil {
+		return "+refs/tags/*:refs/tags/*"
+	}
+	return fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", repo.Branch, repo.Branch)
+}
+
 // GetHash gets the commit hash for a branch
 func (g *GitHelper) GetHash(branch string) (string, error) {
 	cmd := exec.Command("git", "-C", g.repoPath, "rev-parse", fmt.Sprintf("origin/%s", branch))
@@ -91,6 +270,186 @@ func (g *GitHelper) GetHash(branch string) (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
+// ResolveCommit resolves a revision (hash, abbreviated hash, tag) to a full
+// commit hash present in the local repository
+func (g *GitHelper) ResolveCommit(rev string) (string, error) {
+	if strings.HasPrefix(rev, "-") {
+		return "", fmt.Errorf("invalid revision '%s'", rev)
+	}
+
+	cmd := exec.Command("git", "-C", g.repoPath, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unknown commit '%s'", rev)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// ErrCommitNotFound is returned by EnsureCommit for a commit that is neither
+// in the local repository nor in the history of the branch or tags
+var ErrCommitNotFound = errors.New("commit not found")
+
+// EnsureCommit makes sure a commit is present in the local repository. A
+// shallow clone is deepened until the commit is found, finally fetching the
+// whole history of the branch.
+func (g *GitHelper) EnsureCommit(repo *config.Repository, hash string) error {
+	if strings.HasPrefix(hash, "-") {
+		return fmt.Errorf("invalid revision '%s'", hash)
+	}
+
+	found, err := g.deepenUntil(repo, func() bool { return g.hasCommit(repo, hash) })
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s is not in the history of %s", ErrCommitNotFound, state.ShortHash(hash), tracked(repo))
+	}
+
+	return nil
+}
+
+// IsAncestor reports whether ancestor is in the history of commit, i.e. the
+// branch moved from ancestor to commit without a rewrite. A shallow clone is
+// deepened as far as needed to tell. Both commits must be present.
+func (g *GitHelper) IsAncestor(repo *config.Repository, ancestor, commit string) (bool, error) {
+	var cmdErr error
+	found, err := g.deepenUntil(repo, func() bool {
+		err := exec.Command("git", "-C", g.repoPath, "merge-base", "--is-ancestor", ancestor, commit).Run()
+		var exitErr *exec.ExitError
+		if err != nil && (!errors.As(err, &exitErr) || exitErr.ExitCode() != 1) {
+			cmdErr = err
+			return true // not a question of history depth
+		}
+		return err == nil
+	})
+	switch {
+	case err != nil:
+		return false, err
+	case cmdErr != nil:
+		return false, fmt.Errorf("git merge-base failed: %w", cmdErr)
+	}
+
+	return found, nil
+}
+
+// MergeBase returns the last common commit of two commits, or "" if their
+// histories are unrelated. It needs the whole history of both, see IsAncestor.
+func (g *GitHelper) MergeBase(a, b string) (string, error) {
+	output, err := exec.Command("git", "-C", g.repoPath, "merge-base", a, b).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("git merge-base failed: %w", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// deepenUntil deepens a shallow clone until found reports true, doubling the
+// depth each time and finally fetching the whole history. It reports whether
+// found became true; a clone with the whole history is not fetched from.
+func (g *GitHelper) deepenUntil(repo *config.Repository, found func() bool) (bool, error) {
+	if found() {
+		return true, nil
+	}
+
+	refspec := fetchRefspec(repo)
+	deepen := max(repo.Clone.Depth, 1)
+
+	for i := 0; i <= maxDeepen; i++ {
+		shallow, _ := exec.Command("git", "-C", g.repoPath, "rev-parse", "--is-shallow-repository").Output()
+		if strings.TrimSpace(string(shallow)) != "true" {
+			return false, nil
+		}
+
+		arg := "--deepen=" + strconv.Itoa(deepen)
+		if i == maxDeepen {
+			arg = "--unshallow"
+		}
+
+		cmd, err := g.remoteCommand(repo, "-C", g.repoPath, "fetch", arg, "origin", refspec)
+		if err != nil {
+			return false, fmt.Errorf("git fetch failed: %w", err)
+		}
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return false, remoteError("git fetch "+arg, err, output)
+		}
+		g.logger.Debugf("Deepened the clone of '%s' with %s", repo.Name, arg)
+
+		if found() {
+			return true, nil
+		}
+		deepen *= 2
+	}
+
+	return false, nil
+}
+
+// maxDeepen is how often deepenUntil deepens a shallow clone, doubling the
+// depth each time, before it fetches the whole history
+const maxDeepen = 3
+
+// hasCommit reports whether a commit is present in the local repository
+func (g *GitHelper) hasCommit(repo *config.Repository, hash string) bool {
+	// A partial clone may fetch a missing object from the remote
+	cmd, err := g.remoteCommand(repo, "-C", g.repoPath, "cat-file", "-e", hash+"^{commit}")
+	return err == nil && cmd.Run() == nil
+}
+
+// Checkout checks out a commit as detached HEAD and removes untracked files,
+// so the working tree matches the commit. Ignored files are kept. Local changes
+// are discarded; use LocalChanges to find them first.
+func (g *GitHelper) Checkout(repo *config.Repository, hash string) error {
+	// Files missing from a partial clone are fetched from the remote
+	cmd, err := g.remoteCommand(repo, "-C", g.repoPath, "checkout", "--force", "--detach", hash)
+	if err != nil {
+		return fmt.Errorf("git checkout failed: %w", err)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git checkout failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	cmd = exec.Command("git", "-C", g.repoPath, "clean", "-f", "-d")
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git clean failed: %w, output: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// LocalChanges returns the paths of modified, deleted and untracked files in
+// the working tree. Ignored files are not reported, renamed files are reported
+// under both names.
+func (g *GitHelper) LocalChanges() ([]string, error) {
+	cmd := exec.Command("git", "-C", g.repoPath, "status", "--porcelain", "-z", "--untracked-files=all")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git status failed: %w", err)
+	}
+
+	// "XY path", unquoted and NUL-terminated; renames and copies are followed
+	// by the original path as a field of its own
+	var paths []string
+	fields := strings.Split(string(output), "\x00")
+	for i := 0; i < len(fields); i++ {
+		entry := fields[i]
+		if len(entry) < 4 {
+			continue
+		}
+		paths = append(paths, entry[3:])
+
+		if status := entry[:2]; strings.ContainsAny(status, "RC") && i+1 < len(fields) {
+			i++
+			paths = append(paths, fields[i])
+		}
+	}
+
+	return paths, nil
+}
+
 // GetChangedFiles returns files that changed between two commits
 func (g *GitHelper) GetChangedFiles(oldHash, newHash string, watchPaths []string) ([]string, error) {
 	if oldHash == "" {
@@ -98,52 +457,142 @@ func (g *GitHelper) GetChangedFiles(oldHash, newHash string, watchPaths []string
 		return watchPaths, nil
 	}
 
-	// Get list of changed files
-	cmd := exec.Command("git", "-C", g.repoPath, "diff", "--name-only",
+	changedFiles, err := g.GetDiff(oldHash, newHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterPaths(changedFiles, watchPaths), nil
+}
+
+// GetDiff returns all files that changed between two commits
+func (g *GitHelper) GetDiff(oldHash, newHash string) ([]string, error) {
+	// Without rename detection, which would need the contents of files, both
+	// the old and the new path of a moved file are listed
+	cmd := exec.Command("git", "-C", g.repoPath, "diff", "--name-only", "--no-renames",
 		fmt.Sprintf("%s..%s", oldHash, newHash))
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get diff: %w", err)
 	}
 
-	changedFiles := strings.Split(strings.TrimSpace(string(output)), "\n")
+	trimmed := strings.TrimSpace(string(output))
+	if trimmed == "" {
+		return nil, nil
+	}
+
+	return strings.Split(trimmed, "\n"), nil
+}
+
+// ReadFile returns the contents of a file at the given commit
+func (g *GitHelper) ReadFile(repo *config.Repository, hash, filePath string) ([]byte, error) {
+	// The file is fetched from the remote if it is missing from a partial clone
+	cmd, err := g.remoteCommand(repo, "-C", g.repoPath, "show", fmt.Sprintf("%s:%s", hash, filePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s' at %s: %w", filePath, hash, err)
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s' at %s: %w", filePath, hash, err)
+	}
+
+	return output, nil
+}
 
-	// Filter by watch paths
+// filterPaths returns the files matching the watch paths
+func filterPaths(files []string, watchPaths []string) []string {
 	var filtered []string
-	for _, changed := range changedFiles {
-		for _, watch := range watchPaths {
-			if matchesPath(changed, watch) {
-				filtered = append(filtered, changed)
-				break
-			}
+	for _, changed := range files {
+		if matchPatterns(changed, watchPaths) {
+			filtered = append(filtered, changed)
 		}
 	}
 
-	return filtered, nil
+	return filtered
 }
 
-// matchesPath checks if a file path matches a watch pattern
-func matchesPath(filePath, pattern string) bool {
-	// Remove trailing slash from pattern
-	pattern = strings.TrimSuffix(pattern, "/")
-
-	// Exact match
-	if filePath == pattern {
-		return true
+// matchPatterns evaluates patterns in order and reports whether the file is
+// included. Patterns prefixed with "!" exclude matching files; the last
+// matching pattern wins, so later patterns override earlier ones.
+func matchPatterns(filePath string, patterns []string) bool {
+	included := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if matchesPath(filePath, strings.TrimPrefix(pattern, "!")) {
+			included = !negated
+		}
 	}
 
-	// Pattern is a directory
-	if strings.HasPrefix(filePath, pattern+"/") {
+	return included
+}
+
+// matchesPath checks if a file path matches a watch pattern.
+//
+// Patterns are anchored at the repository root and matched per path segment:
+// "*", "?" and "[...]" match within a segment and "**" matches any number of
+// segments. A pattern that matches a directory also matches everything below
+// it, so "src/", "k8s/*" and "charts/*/values.yaml" behave as expected.
+// "." matches every file.
+func matchesPath(filePath, pattern string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" || pattern == "." {
 		return true
 	}
 
-	// Simple wildcard support
-	if strings.HasSuffix(pattern, "/*") {
-		dir := strings.TrimSuffix(pattern, "/*")
-		if strings.HasPrefix(filePath, dir+"/") {
+	patternSegs := strings.Split(pattern, "/")
+	pathSegs := strings.Split(strings.Trim(filePath, "/"), "/")
+
+	// The file itself or one of its parent directories must match
+	for i := len(pathSegs); i > 0; i-- {
+		if matchSegments(patternSegs, pathSegs[:i]) {
 			return true
 		}
 	}
 
 	return false
 }
+
+// matchSegments matches path segments against pattern segments, where a "**"
+// pattern segment matches zero or more path segments
+func matchSegments(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(segs) == 0 {
+			return false
+		}
+
+		if ok, err := path.Match(pattern[0], segs[0]); err != nil || !ok {
+			return false
+		}
+
+		pattern, segs = pattern[1:], segs[1:]
+	}
+
+	return len(segs) == 0
+}
+
+// parseIgnoreFile parses a .cdgunignore-style file: one pattern per line,
+// blank lines and lines starting with "#" are skipped
+func parseIgnoreFile(data []byte) []string {
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns
+}
@@ -2,6 +2,11 @@ package monitor
 
 import (
 	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 
 	"github.com/omnorm/cd-gun/internal/config"
@@ -61,3 +66,452 @@ func TestGitHelperRepository(t *testing.T) {
 		t.Error("Git helper should be created")
 	}
 }
+
+func TestMatchesPath(t *testing.T) {
+	tests := []struct {
+		file    string
+		pattern string
+		want    bool
+	}{
+		// Exact paths and directories
+		{"package.json", "package.json", true},
+		{"src/package.json", "package.json", false},
+		{"src/main.go", "src/", true},
+		{"src/main.go", "src", true},
+		{"srcfoo/main.go", "src/", false},
+		{"src/app/main.go", ".", true},
+
+		// Single-segment wildcards
+		{"k8s/deploy.yaml", "k8s/*", true},
+		{"k8s/base/deploy.yaml", "k8s/*", true},
+		{"config.yaml", "*.yaml", true},
+		{"config/app.yaml", "*.yaml", false},
+		{"charts/api/values.yaml", "charts/*/values.yaml", true},
+		{"charts/api/templates/values.yaml", "charts/*/values.yaml", false},
+		{"charts/api/Chart.yaml", "charts/*/values.yaml", false},
+		{"v1.txt", "v?.txt", true},
+		{"v10.txt", "v?.txt", false},
+		{"env/prod.env", "env/[ps]*.env", true},
+		{"env/dev.env", "env/[ps]*.env", false},
+
+		// Recursive wildcards
+		{"app.yaml", "**/*.yaml", true},
+		{"deploy/k8s/app.yaml", "**/*.yaml", true},
+		{"deploy/k8s/app.json", "**/*.yaml", false},
+		{"docs/a/b/c.md", "docs/**", true},
+		{"services/api/config/prod.yaml", "services/**/prod.yaml", true},
+		{"services/prod.yaml", "services/**/prod.yaml", true},
+		{"other/prod.yaml", "services/**/prod.yaml", false},
+
+		// Malformed patterns never match
+		{"src/main.go", "src/[", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+"~"+tt.file, func(t *testing.T) {
+			if got := matchesPath(tt.file, tt.pattern); got != tt.want {
+				t.Errorf("matchesPath(%q, %q) = %v, want %v", tt.file, tt.pattern, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchPatternsExclusions(t *testing.T) {
+	patterns := []string{"**/*.yaml", "!docs/**", "docs/deploy.yaml", "!**/*.tmp.yaml"}
+
+	tests := []struct {
+		file string
+		want bool
+	}{
+		{"k8s/app.yaml", true},
+		{"docs/example.yaml", false},
+		{"docs/deploy.yaml", true},
+		{"k8s/scratch.tmp.yaml", false},
+		{"README.md", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			if got := matchPatterns(tt.file, patterns); got != tt.want {
+				t.Errorf("matchPatterns(%q) = %v, want %v", tt.file, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseIgnoreFile(t *testing.T) {
+	data := []byte("# generated files\n\n*.lock\n  docs/**  \n!docs/deploy.md\n")
+
+	got := parseIgnoreFile(data)
+	want := []string{"*.lock", "docs/**", "!docs/deploy.md"}
+
+	if len(got) != len(want) {
+		t.Fatalf("parseIgnoreFile() = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("parseIgnoreFile()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+
+	if matchPatterns("docs/deploy.md", got) {
+		t.Error("docs/deploy.md should be re-included by the ignore file")
+	}
+	if !matchPatterns("docs/other.md", got) {
+		t.Error("docs/other.md should be ignored")
+	}
+}
+
+func TestGitHelperLocalRemote(t *testing.T) {
+	remote := newTestRemote(t)
+	oldHash := remote.git("rev-parse", "HEAD")
+
+	var buf bytes.Buffer
+	helper := NewGitHelper(t.TempDir()+"/cache", logger.NewLogger("debug", &buf))
+	repo := &config.Repository{Name: "local", URL: remote.path, Branch: "main", Auth: config.Auth{Type: "none"}}
+
+	if err := helper.EnsureRepository(repo); err != nil {
+		t.Fatalf("EnsureRepository() failed: %v", err)
+	}
+
+	newHash := remote.commit(map[string]string{
+		"src/main.go":  "package main\n",
+		".cdgunignore": "docs/**\n",
+	})
+
+	if err := helper.Fetch(repo); err != nil {
+		t.Fatalf("Fetch() failed: %v", err)
+	}
+
+	hash, err := helper.GetHash("main")
+	if err != nil {
+		t.Fatalf("GetHash() failed: %v", err)
+	}
+	if hash != newHash {
+		t.Errorf("GetHash() = %s, want %s", hash, newHash)
+	}
+
+	files, err := helper.GetChangedFiles(oldHash, newHash, []string{"src/"})
+	if err != nil {
+		t.Fatalf("GetChangedFiles() failed: %v", err)
+	}
+	if len(files) != 1 || files[0] != "src/main.go" {
+		t.Errorf("GetChangedFiles() = %v, want [src/main.go]", files)
+	}
+
+	data, err := helper.ReadFile(repo, newHash, ".cdgunignore")
+	if err != nil {
+		t.Fatalf("ReadFile() failed: %v", err)
+	}
+	if string(data) != "docs/**\n" {
+		t.Errorf("ReadFile() = %q", data)
+	}
+}
+
+func TestGitHelperCheckout(t *testing.T) {
+	remote := newTestRemote(t)
+	oldHash := remote.commit(map[string]string{".gitignore": "build/\n", "docs/guide.md": "guide\n"})
+	remote.git("rm", "-q", "README.md")
+	newHash := remote.commit(map[string]string{"src/main.go": "package main\n"})
+
+	cache := t.TempDir() + "/cache"
+	helper := NewGitHelper(cache, logger.NewLogger("debug", &bytes.Buffer{}))
+	repo := &config.Repository{Name: "local", URL: remote.path, Branch: "main", Auth: config.Auth{Type: "none"}}
+	if err := helper.EnsureRepository(repo); err != nil {
+		t.Fatalf("EnsureRepository() failed: %v", err)
+	}
+
+	// Start from the old commit with local changes on top
+	if err := helper.Checkout(repo, oldHash); err != nil {
+		t.Fatalf("Checkout() failed: %v", err)
+	}
+	for name, content := range map[string]string{
+		"README.md":             "changed\n",
+		"notes/todo":            "untracked\n",
+		"notes/to do \"later\"": "untracked, quoted by plain --porcelain\n",
+		"build/output":          "ignored\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(cache, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(cache, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if out, err := exec.Command("git", "-C", cache, "mv", "docs/guide.md", "docs/manual.md").CombinedOutput(); err != nil {
+		t.Fatalf("git mv failed: %v\n%s", err, out)
+	}
+
+	changes, err := helper.LocalChanges()
+	if err != nil {
+		t.Fatalf("LocalChanges() failed: %v", err)
+	}
+	sort.Strings(changes)
+	want := []string{"README.md", "docs/guide.md", "docs/manual.md", "notes/to do \"later\"", "notes/todo"}
+	if strings.Join(changes, ",") != strings.Join(want, ",") {
+		t.Errorf("LocalChanges() = %q, want %q", changes, want)
+	}
+
+	if err := helper.Checkout(repo, newHash); err != nil {
+		t.Fatalf("Checkout() failed: %v", err)
+	}
+
+	if head, _ := helper.ResolveCommit("HEAD"); head != newHash {
+		t.Errorf("HEAD = %s, want %s", head, newHash)
+	}
+	if changes, _ := helper.LocalChanges(); len(changes) != 0 {
+		t.Errorf("LocalChanges() after Checkout() = %v, want none", changes)
+	}
+	for name, want := range map[string]bool{"src/main.go": true, "README.md": false, "notes": false, "build/output": true} {
+		if _, err := os.Stat(filepath.Join(cache, name)); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+func TestGitHelperShallowSparseClone(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+	}{
+		{"shallow", ""},
+		{"shallow partial", "blob:none"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testShallowSparseClone(t, tt.filter)
+		})
+	}
+}
+
+// testShallowSparseClone clones a repository with depth 1 and a sparse
+// checkout, and checks that older commits and other files are fetched on demand
+func testShallowSparseClone(t *testing.T, filter string) {
+	remote := newTestRemote(t)
+	remote.git("config", "uploadpack.allowFilter", "true")
+	first := remote.commit(map[string]string{
+		"services/api/main.go": "package main\n",
+		"services/web/app.js":  "app\n",
+		"deploy/api.sh":        "deploy\n",
+	})
+	for i := 0; i < 5; i++ {
+		remote.commit(map[string]string{"services/web/app.js": strings.Repeat("x", i+1)})
+	}
+
+	cache := t.TempDir() + "/cache"
+	helper := NewGitHelper(cache, logger.NewLogger("debug", &bytes.Buffer{}))
+	repo := &config.Repository{
+		Name:       "local",
+		URL:        "file://" + remote.path,
+		Branch:     "main",
+		Auth:       config.Auth{Type: "none"},
+		WatchPaths: []string{"services/api/", "deploy/*.sh"},
+		Clone:      config.CloneOptions{Depth: 1, Filter: filter, Sparse: true},
+	}
+
+	if err := helper.EnsureRepository(repo); err != nil {
+		t.Fatalf("EnsureRepository() failed: %v", err)
+	}
+
+	for name, want := range map[string]bool{"README.md": true, "services/api/main.go": true, "deploy/api.sh": true, "services/web": false} {
+		if _, err := os.Stat(filepath.Join(cache, name)); (err == nil) != want {
+			t.Errorf("%s checked out = %v, want %v", name, err == nil, want)
+		}
+	}
+
+	// A partial clone fetches the missing commit by itself, a plain one is deepened
+	if filter == "" {
+		if _, err := helper.ResolveCommit(first); err == nil {
+			t.Fatal("first commit is present in a clone of depth 1")
+		}
+	}
+	if err := helper.EnsureCommit(repo, first); err != nil {
+		t.Fatalf("EnsureCommit() failed: %v", err)
+	}
+
+	newHash := remote.commit(map[string]string{"services/api/main.go": "package api\n"})
+	if err := helper.Fetch(repo); err != nil {
+		t.Fatalf("Fetch() failed: %v", err)
+	}
+	// The fetch made the history shallow again, so telling a fast-forward needs deepening
+	if ok, err := helper.IsAncestor(repo, first, newHash); err != nil || !ok {
+		t.Errorf("IsAncestor() = %v, %v, want true", ok, err)
+	}
+
+	files, err := helper.GetDiff(first, newHash)
+	if err != nil {
+		t.Fatalf("GetDiff() failed: %v", err)
+	}
+	if strings.Join(files, ",") != "services/api/main.go,services/web/app.js" {
+		t.Errorf("GetDiff() = %v", files)
+	}
+
+	// Files of the new commit are fetched on checkout
+	if err := helper.Checkout(repo, newHash); err != nil {
+		t.Fatalf("Checkout() failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(cache, "services/api/main.go")); string(data) != "package api\n" {
+		t.Errorf("services/api/main.go = %q after checkout", data)
+	}
+
+	// Dropping the sparse option restores the full working tree
+	repo.Clone.Sparse = false
+	if err := helper.EnsureRepository(repo); err != nil {
+		t.Fatalf("EnsureRepository() failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(cache, "services/web/app.js")); err != nil {
+		t.Errorf("full working tree not restored: %v", err)
+	}
+}
+
+// removeObjects deletes all objects of a repository, leaving its refs dangling
+func removeObjects(t *testing.T, repoPath string) {
+	t.Helper()
+
+	objects := filepath.Join(repoPath, ".git", "objects")
+	entries, err := os.ReadDir(objects)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == "info" {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(objects, entry.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGitHelperRecoversCache(t *testing.T) {
+	remote := newTestRemote(t)
+	other := newTestRemote(t)
+	other.commit(map[string]string{"other.txt": "other\n"})
+
+	tests := []struct {
+		name   string
+		url    string
+		damage func(t *testing.T, cache string)
+		reason string // logged reason, empty if the cache is not quarantined
+	}{
+		{
+			name: "interrupted clone",
+			url:  remote.path,
+			damage: func(t *testing.T, cache string) {
+				if err := os.RemoveAll(cache); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(filepath.Join(clonePath(cache), ".git"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "not a repository",
+			url:  remote.path,
+			damage: func(t *testing.T, cache string) {
+				if err := os.RemoveAll(filepath.Join(cache, ".git")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			reason: "not a git repository",
+		},
+		{
+			name:   "missing objects",
+			url:    remote.path,
+			damage: removeObjects,
+			reason: "cannot be read",
+		},
+		{
+			name:   "URL changed",
+			url:    other.path,
+			damage: func(t *testing.T, cache string) {},
+			reason: "but the configured URL is",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			cache := filepath.Join(t.TempDir(), "app")
+			helper := NewGitHelper(cache, logger.NewLogger("debug", &logs))
+			repo := &config.Repository{Name: "app", URL: remote.path, Branch: "main", Auth: config.Auth{Type: "none"}}
+			if err := helper.EnsureRepository(repo); err != nil {
+				t.Fatalf("EnsureRepository() failed: %v", err)
+			}
+
+			tt.damage(t, cache)
+			repo.URL = tt.url
+			if err := helper.EnsureRepository(repo); err != nil {
+				t.Fatalf("EnsureRepository() of damaged cache failed: %v", err)
+			}
+
+			if err := helper.verifyRepository(repo); err != nil {
+				t.Errorf("cache is still unusable: %v", err)
+			}
+			if owner := cacheOwner(cache); owner != "app" {
+				t.Errorf("cache owner = %q, want %q", owner, "app")
+			}
+			if _, err := os.Stat(clonePath(cache)); !os.IsNotExist(err) {
+				t.Errorf("incomplete clone was not removed: %v", err)
+			}
+
+			quarantined, _ := os.ReadDir(filepath.Join(filepath.Dir(cache), quarantineDir, "app"))
+			if tt.reason == "" {
+				if len(quarantined) != 0 {
+					t.Errorf("cache was quarantined, want it cloned in place")
+				}
+				return
+			}
+			if len(quarantined) != 1 {
+				t.Errorf("quarantined caches = %d, want 1", len(quarantined))
+			}
+			if !strings.Contains(logs.String(), tt.reason) {
+				t.Errorf("log does not give the reason %q:\n%s", tt.reason, logs.String())
+			}
+		})
+	}
+}
+
+func TestGitHelperRepair(t *testing.T) {
+	remote := newTestRemote(t)
+
+	cache := filepath.Join(t.TempDir(), "app")
+	helper := NewGitHelper(cache, logger.NewLogger("debug", &bytes.Buffer{}))
+	repo := &config.Repository{Name: "app", URL: remote.path, Branch: "main", Auth: config.Auth{Type: "none"}}
+	if err := helper.EnsureRepository(repo); err != nil {
+		t.Fatalf("EnsureRepository() failed: %v", err)
+	}
+
+	if replaced, err := helper.Repair(repo); err != nil || replaced {
+		t.Fatalf("Repair() of intact cache = %v, %v, want false, nil", replaced, err)
+	}
+
+	removeObjects(t, cache)
+	if replaced, err := helper.Repair(repo); err != nil || !replaced {
+		t.Fatalf("Repair() of corrupt cache = %v, %v, want true, nil", replaced, err)
+	}
+	if err := helper.Fetch(repo); err != nil {
+		t.Fatalf("Fetch() after Repair() failed: %v", err)
+	}
+	if _, err := helper.GetHash("main"); err != nil {
+		t.Errorf("GetHash() after Repair() failed: %v", err)
+	}
+}
+
+func TestGitHelperFailedClone(t *testing.T) {
+	cache := filepath.Join(t.TempDir(), "app")
+	helper := NewGitHelper(cache, logger.NewLogger("debug", &bytes.Buffer{}))
+	repo := &config.Repository{Name: "app", URL: filepath.Join(t.TempDir(), "missing"), Branch: "main", Auth: config.Auth{Type: "none"}}
+
+	if err := helper.EnsureRepository(repo); err == nil {
+		t.Fatal("EnsureRepository() of a missing remote succeeded")
+	}
+	for _, path := range []string{cache, clonePath(cache)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("failed clone left '%s' behind", path)
+		}
+	}
+}
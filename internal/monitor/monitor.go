@@ -1,14 +1,31 @@
 package monitor
 
 import (
+	"errors"
 	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/omnorm/cd-gun/internal/config"
 	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/metrics"
 	"github.com/omnorm/cd-gun/internal/state"
 )
 
+// Sources of a repository check, reported as ChangeEvent.Trigger
+const (
+	TriggerPoll         = "poll"          // initial check or poll interval
+	TriggerSignal       = "signal"        // SIGUSR1
+	TriggerAPI          = "api"           // control API
+	TriggerPushHook     = "push_hook"     // push webhook from a Git forge
+	TriggerRetry        = "retry"         // retry of a failed deploy (retry policy)
+	TriggerRollback     = "rollback"      // rollback requested through the control API
+	TriggerAutoRollback = "auto_rollback" // rollback after a failed deploy (on_failure: rollback)
+	TriggerApproval     = "approval"      // approval of a force-push (on_force_push: require_approval)
+)
+
 // ChangeEvent represents a change detected in a repository
 type ChangeEvent struct {
 	RepositoryName string
@@ -16,6 +33,11 @@ type ChangeEvent struct {
 	OldHash        string
 	NewHash        string
 	DetectedAt     time.Time
+	Routes         []RouteChange // changed files per route; empty means all files go to the top-level actions
+	Trigger        string        // what started the check that detected the change
+	Rollback       bool          // NewHash is an earlier commit being redeployed
+	ForcePush      bool          // the branch was rewritten: OldHash is not in the history of NewHash
+	Tag            string        // tag selected for NewHash, in tag mode
 }
 
 // Monitor monitors a git repository for changes
@@ -25,8 +47,18 @@ type Monitor struct {
 	logger     *logger.Logger
 	stateStore *state.Store
 	eventChan  chan ChangeEvent
-	forceChan  chan struct{}
+	forceChan  chan string // trigger of a pending forced check
+	stopChan   chan struct{}
+	doneChan   chan struct{}
+	stopOnce   sync.Once
+	paused     atomic.Bool
 	ticker     *time.Ticker
+
+	pendingMu   sync.Mutex
+	pendingHash string // commit of the last emitted event not acknowledged yet
+	recheck     string // trigger of a check that found a change while an event was handled
+
+	cacheChecked bool // the cache passed an integrity check since the last successful fetch
 }
 
 // NewMonitor creates a new repository monitor
@@ -39,12 +71,16 @@ func NewMonitor(repo *config.Repository, configMgr *config.Manager,
 		logger:     log,
 		stateStore: stateStore,
 		eventChan:  make(chan ChangeEvent, 1),
-		forceChan:  make(chan struct{}, 1),
+		forceChan:  make(chan string, 1),
+		stopChan:   make(chan struct{}),
+		doneChan:   make(chan struct{}),
 	}, nil
 }
 
-// Start begins monitoring the repository
+// Start begins monitoring the repository until stopChan is closed or Stop is called
 func (m *Monitor) Start(stopChan chan struct{}) error {
+	defer close(m.doneChan)
+
 	interval := m.configMgr.GetRepositoryPollInterval(m.repo)
 	m.ticker = time.NewTicker(interval)
 	defer m.ticker.Stop()
@@ -53,8 +89,10 @@ func (m *Monitor) Start(stopChan chan struct{}) error {
 		m.repo.Name, interval)
 
 	// Perform initial check
-	if err := m.checkRepository(); err != nil {
-		m.logger.Warnf("Initial check for '%s' failed: %v", m.repo.Name, err)
+	if !m.paused.Load() {
+		if err := m.checkRepository(TriggerPoll); err != nil {
+			m.logger.Warnf("Initial check for '%s' failed: %v", m.repo.Name, err)
+		}
 	}
 
 	for {
@@ -63,36 +101,123 @@ func (m *Monitor) Start(stopChan chan struct{}) error {
 			m.logger.Infof("Stopping monitor for repository '%s'", m.repo.Name)
 			return nil
 
-		case <-m.forceChan:
-			m.logger.Infof("Force check triggered for '%s'", m.repo.Name)
-			if err := m.checkRepository(); err != nil {
+		case <-m.stopChan:
+			m.logger.Infof("Stopping monitor for repository '%s'", m.repo.Name)
+			return nil
+
+		case trigger := <-m.forceChan:
+			m.logger.Infof("Force check triggered for '%s' (%s)", m.repo.Name, trigger)
+			if err := m.checkRepository(trigger); err != nil {
 				m.logger.Errorf("Force check failed for '%s': %v", m.repo.Name, err)
 			}
 
 		case <-m.ticker.C:
-			if err := m.checkRepository(); err != nil {
+			if m.paused.Load() {
+				m.logger.Debugf("Monitor for '%s' is paused, skipping check", m.repo.Name)
+				continue
+			}
+			if err := m.checkRepository(TriggerPoll); err != nil {
 				m.logger.Warnf("Check failed for '%s': %v", m.repo.Name, err)
 			}
 		}
 	}
 }
 
-// ForceCheck triggers an immediate check of the repository
-func (m *Monitor) ForceCheck() {
+// Stop stops this monitor and waits for its Start loop to return.
+// It must only be called on a monitor that has been started.
+func (m *Monitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stopChan)
+	})
+	<-m.doneChan
+}
+
+// Done returns a channel that is closed once Start has returned
+func (m *Monitor) Done() <-chan struct{} {
+	return m.doneChan
+}
+
+// Pause suspends periodic checks. Forced checks still run.
+func (m *Monitor) Pause() {
+	m.paused.Store(true)
+}
+
+// Resume re-enables periodic checks
+func (m *Monitor) Resume() {
+	m.paused.Store(false)
+}
+
+// IsPaused reports whether periodic checks are suspended
+func (m *Monitor) IsPaused() bool {
+	return m.paused.Load()
+}
+
+// ForceCheck triggers an immediate check of the repository. The trigger is
+// reported in the resulting change event.
+func (m *Monitor) ForceCheck(trigger string) {
 	select {
-	case m.forceChan <- struct{}{}:
+	case m.forceChan <- trigger:
 	default:
 		// Channel full, skip
 	}
 }
 
+// Acknowledge tells the monitor that the event for a commit has been handled,
+// so the commit is compared against the state again from the next check on.
+// A change found while the event was handled is checked for right away.
+func (m *Monitor) Acknowledge(hash string) {
+	m.pendingMu.Lock()
+	if m.pendingHash != hash {
+		m.pendingMu.Unlock()
+		return
+	}
+	m.pendingHash = ""
+	recheck := m.recheck
+	m.recheck = ""
+	m.pendingMu.Unlock()
+
+	if recheck == "" || ((recheck == TriggerPoll || recheck == TriggerRetry) && m.IsPaused()) {
+		return
+	}
+	m.ForceCheck(recheck)
+}
+
+// Inherit takes over the paused state, the pending event and a pending forced
+// check of a stopped monitor of the same repository, e.g. after a configuration
+// reload
+func (m *Monitor) Inherit(prev *Monitor) {
+	m.paused.Store(prev.paused.Load())
+
+	select {
+	case trigger := <-prev.forceChan:
+		m.ForceCheck(trigger)
+	default:
+	}
+
+	prev.pendingMu.Lock()
+	defer prev.pendingMu.Unlock()
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+
+	m.pendingHash = prev.pendingHash
+	m.recheck = prev.recheck
+}
+
+// isPending reports whether an event for a commit is waiting to be handled
+func (m *Monitor) isPending(hash string) bool {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+
+	return m.pendingHash == hash
+}
+
 // GetEventChan returns the event channel for this monitor
 func (m *Monitor) GetEventChan() <-chan ChangeEvent {
 	return m.eventChan
 }
 
 // checkRepository checks for changes in the repository
-func (m *Monitor) checkRepository() error {
+func (m *Monitor) checkRepository(trigger string) error {
 	m.logger.Debugf("Checking repository '%s'", m.repo.Name)
 
 	localPath := m.configMgr.GetRepositoryLocalPath(m.repo.Name)
@@ -105,62 +230,313 @@ func (m *Monitor) checkRepository() error {
 		return fmt.Errorf("failed to initialize repository: %w", err)
 	}
 
-	// Fetch from remote
+	currentHash, currentTag, err := m.fetchHead(helper)
+	if err != nil && localFailure(err) && !m.cacheChecked {
+		// A damaged cache would fail the same way on every check until it is replaced
+		m.cacheChecked = true
+		replaced, repairErr := helper.Repair(m.repo)
+		if repairErr != nil {
+			return fmt.Errorf("%w; repairing the repository cache failed: %w", err, repairErr)
+		}
+		if replaced {
+			currentHash, currentTag, err = m.fetchHead(helper)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	m.cacheChecked = false
+
+	repoState := m.stateStore.ModifyRepository(m.repo.Name, func(rs *state.RepositoryState) {
+		rs.LastFetch = time.Now()
+		rs.CurrentHash = currentHash
+		rs.CurrentTag = currentTag
+	})
+
+	// The deployed commit is only advanced once the event has been handled, so
+	// nothing is lost if the event loop is busy or the actions fail
+	deployed := repoState.DeployedHash
+	switch {
+	case currentHash == deployed:
+		return nil
+	case m.isPending(currentHash):
+		m.logger.Debugf("Change to %s in '%s' is still pending", state.ShortHash(currentHash), m.repo.Name)
+		return nil
+	case currentHash == repoState.FailedHash:
+		if repoState.NextRetry.IsZero() || time.Now().Before(repoState.NextRetry) {
+			return nil
+		}
+		trigger = TriggerRetry
+	default:
+		if trigger == TriggerRetry {
+			trigger = TriggerPoll // a newer commit replaced the failed one
+		}
+	}
+
+	// Check which routes have changed files
+	var (
+		routes    []RouteChange
+		forcePush *state.ForcePush
+	)
+
+	if deployed != "" {
+		files, rewrite, err := m.changedFiles(helper, deployed, currentHash)
+		forcePush = rewrite
+		switch {
+		case err != nil:
+			m.logger.Warnf("Failed to get changed files for '%s': %v", m.repo.Name, err)
+			routes = AllRoutes(m.repo) // Assume all watched paths changed
+		case files == nil && rewrite != nil:
+			routes = AllRoutes(m.repo) // No common history with the deployed commit
+		default:
+			routes = MatchRoutes(m.repo, m.applyIgnoreFile(helper, currentHash, files))
+		}
+	} else {
+		routes = AllRoutes(m.repo) // Nothing deployed yet, assume all paths changed
+	}
+
+	if len(routes) == 0 {
+		// No watched path changed, there is nothing to deploy for this commit
+		m.stateStore.ModifyRepository(m.repo.Name, func(rs *state.RepositoryState) {
+			if rs.DeployedHash == deployed {
+				rs.DeployedHash, rs.DeployedTag = currentHash, currentTag
+			}
+		})
+		return nil
+	}
+
+	if forcePush != nil {
+		if !m.allowForcePush(repoState, forcePush) {
+			return nil
+		}
+		if forcePush.Status == state.ForcePushApproved && trigger == TriggerAPI {
+			trigger = TriggerApproval
+		}
+	}
+
+	changedFiles := routeFiles(routes)
+
+	event := ChangeEvent{
+		RepositoryName: m.repo.Name,
+		Files:          changedFiles,
+		OldHash:        deployed,
+		NewHash:        currentHash,
+		DetectedAt:     time.Now(),
+		Routes:         routes,
+		Trigger:        trigger,
+		ForcePush:      forcePush != nil,
+		Tag:            currentTag,
+	}
+
+	if m.emit(event) {
+		m.logger.Infof("Change detected in '%s': %v", m.repo.Name, changedFiles)
+	}
+
+	return nil
+}
+
+// fetchHead fetches the branch or the tags from the remote and returns the
+// commit to deploy: the head of the branch, or in tag mode the commit of the
+// selected tag together with the tag
+func (m *Monitor) fetchHead(helper *GitHelper) (string, string, error) {
 	if err := helper.Fetch(m.repo); err != nil {
-		return fmt.Errorf("failed to fetch: %w", err)
+		return "", "", fmt.Errorf("failed to fetch: %w", err)
+	}
+
+	if m.repo.Tags == nil {
+		hash, err := helper.GetHash(m.repo.Branch)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get current hash: %w", err)
+		}
+		return hash, "", nil
 	}
 
-	// Get current hash
-	currentHash, err := helper.GetHash(m.repo.Branch)
+	tags, err := helper.ListTags()
 	if err != nil {
-		return fmt.Errorf("failed to get current hash: %w", err)
+		return "", "", fmt.Errorf("failed to list tags: %w", err)
 	}
 
-	// Load previous state
-	repoState, ok := m.stateStore.GetRepository(m.repo.Name)
+	tag := SelectTag(tags, m.repo.Tags)
+	if tag == nil {
+		err := fmt.Errorf("%w pattern '%s'", ErrNoMatchingTag, m.repo.Tags.Pattern)
+		if m.repo.Tags.SemVer != "" {
+			err = fmt.Errorf("%w and version range '%s'", err, m.repo.Tags.SemVer)
+		}
+		return "", "", err
+	}
+	return tag.Hash, tag.Name, nil
+}
 
-	// Check if there's a change
-	if !ok || repoState.CurrentHash != currentHash {
-		// Check if any watched files changed
-		var changedFiles []string
+// changedFiles returns the files changed from the deployed commit to the new
+// head. If the branch was rewritten, the rewrite is returned as well and the
+// files are those changed on either side since the merge base: by the commits
+// that were dropped and by those that replaced them. Without a merge base the
+// files are nil.
+func (m *Monitor) changedFiles(helper *GitHelper, deployed, head string) ([]string, *state.ForcePush, error) {
+	// A shallow clone may not reach back to the deployed commit yet
+	err := helper.EnsureCommit(m.repo, deployed)
+	if errors.Is(err, ErrCommitNotFound) {
+		// Gone from the branch, and from the cache, e.g. after it was cloned again
+		return nil, &state.ForcePush{OldHash: deployed, NewHash: head, DetectedAt: time.Now()}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 
-		if ok && repoState.CurrentHash != "" {
-			files, err := helper.GetChangedFiles(repoState.CurrentHash, currentHash, m.repo.WatchPaths)
-			if err != nil {
-				m.logger.Warnf("Failed to get changed files for '%s': %v", m.repo.Name, err)
-				changedFiles = m.repo.WatchPaths // Assume all watched paths changed
-			} else {
-				changedFiles = files
-			}
-		} else {
-			changedFiles = m.repo.WatchPaths // No previous state, assume all paths changed
+	fastForward, err := helper.IsAncestor(m.repo, deployed, head)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fastForward {
+		files, err := helper.GetDiff(deployed, head)
+		return files, nil, err
+	}
+
+	rewrite := &state.ForcePush{OldHash: deployed, NewHash: head, DetectedAt: time.Now()}
+
+	base, err := helper.MergeBase(deployed, head)
+	if err != nil || base == "" {
+		return nil, rewrite, err
+	}
+	rewrite.MergeBase = base
+
+	dropped, err := helper.GetDiff(base, deployed)
+	if err != nil {
+		return nil, rewrite, err
+	}
+	added, err := helper.GetDiff(base, head)
+	if err != nil {
+		return nil, rewrite, err
+	}
+
+	return mergeFiles(dropped, added), rewrite, nil
+}
+
+// mergeFiles returns the sorted union of two file lists
+func mergeFiles(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	files := make([]string, 0, len(a)+len(b))
+	for _, file := range append(append([]string(nil), a...), b...) {
+		if !seen[file] {
+			seen[file] = true
+			files = append(files, file)
 		}
+	}
+	sort.Strings(files)
+	return files
+}
 
-		if len(changedFiles) > 0 {
-			// Update state
-			newState := state.RepositoryState{
-				LastFetch:   time.Now(),
-				CurrentHash: currentHash,
-			}
-			m.stateStore.UpdateRepository(m.repo.Name, newState)
-
-			// Emit change event
-			event := ChangeEvent{
-				RepositoryName: m.repo.Name,
-				Files:          changedFiles,
-				OldHash:        repoState.CurrentHash,
-				NewHash:        currentHash,
-				DetectedAt:     time.Now(),
-			}
+// allowForcePush applies the force-push policy of the repository to a rewrite
+// of its branch, records it in state and reports whether the new head is
+// deployed. A rewrite already recorded for the same head is not reported again.
+func (m *Monitor) allowForcePush(repoState state.RepositoryState, rewrite *state.ForcePush) bool {
+	known := repoState.ForcePush
+	if known != nil && known.OldHash == rewrite.OldHash && known.NewHash == rewrite.NewHash {
+		switch known.Status {
+		case state.ForcePushAllowed, state.ForcePushApproved:
+			*rewrite = *known
+			return true
+		case state.ForcePushPendingApproval:
+			m.logger.Debugf("Force-push to %s in '%s' is still waiting for approval", state.ShortHash(rewrite.NewHash), m.repo.Name)
+			return false
+		}
+	}
 
-			select {
-			case m.eventChan <- event:
-				m.logger.Infof("Change detected in '%s': %v", m.repo.Name, changedFiles)
-			default:
-				m.logger.Warnf("Event channel full for '%s'", m.repo.Name)
+	metrics.ForcePushes.Inc(m.repo.Name, m.repo.OnForcePush)
+
+	switch m.repo.OnForcePush {
+	case config.ForcePushSkip:
+		// The new head becomes the deployed commit, so later commits deploy as usual
+		m.logger.Warnf("%s, skipping its deploy", m.rewriteMessage(rewrite))
+		rewrite.Status = state.ForcePushSkipped
+		m.stateStore.ModifyRepository(m.repo.Name, func(rs *state.RepositoryState) {
+			rs.ForcePush = rewrite
+			if rs.DeployedHash == rewrite.OldHash {
+				// The rewrite was found by this check, so the current tag is the one of the new head
+				rs.DeployedHash, rs.DeployedTag = rewrite.NewHash, rs.CurrentTag
 			}
+		})
+		return false
+
+	case config.ForcePushRequireApproval:
+		m.logger.Warnf("%s, waiting for approval", m.rewriteMessage(rewrite))
+		rewrite.Status = state.ForcePushPendingApproval
+		m.stateStore.ModifyRepository(m.repo.Name, func(rs *state.RepositoryState) {
+			rs.ForcePush = rewrite
+		})
+		return false
+	}
+
+	m.logger.Warnf("%s", m.rewriteMessage(rewrite))
+	rewrite.Status = state.ForcePushAllowed
+	m.stateStore.ModifyRepository(m.repo.Name, func(rs *state.RepositoryState) {
+		rs.ForcePush = rewrite
+	})
+	return true
+}
+
+// rewriteMessage describes a rewrite for the log
+func (m *Monitor) rewriteMessage(rewrite *state.ForcePush) string {
+	if m.repo.Tags != nil {
+		return fmt.Sprintf("Selected tag of '%s' is not a descendant of the deployed commit (%s -> %s)",
+			m.repo.Name, state.ShortHash(rewrite.OldHash), state.ShortHash(rewrite.NewHash))
+	}
+	return fmt.Sprintf("Branch '%s' of '%s' was force-pushed (%s -> %s)",
+		m.repo.Branch, m.repo.Name, state.ShortHash(rewrite.OldHash), state.ShortHash(rewrite.NewHash))
+}
+
+// emit delivers an event to the event loop, so that at most one event per
+// repository is pending. An older event that has not been received yet is
+// replaced: both start at the deployed commit, so the newer one covers all
+// changes of the older one. While an event is being handled, nothing is emitted
+// and the repository is checked again once the event is acknowledged.
+func (m *Monitor) emit(event ChangeEvent) bool {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+
+	if m.pendingHash != "" {
+		select {
+		case old := <-m.eventChan:
+			metrics.ChangeEventsDropped.Inc(m.repo.Name)
+			m.logger.Infof("Replacing pending change event for '%s' (%s -> %s)",
+				m.repo.Name, state.ShortHash(old.NewHash), state.ShortHash(event.NewHash))
+		default:
+			m.logger.Infof("Change to %s in '%s' waits for the running deploy of %s",
+				state.ShortHash(event.NewHash), m.repo.Name, state.ShortHash(m.pendingHash))
+			m.recheck = event.Trigger
+			return false
 		}
 	}
 
-	return nil
+	// Nothing is pending, so the channel is empty and the send cannot block
+	m.pendingHash = event.NewHash
+	m.eventChan <- event
+	metrics.ChangeEvents.Inc(m.repo.Name)
+
+	return true
+}
+
+// applyIgnoreFile drops files matched by the repository's ignore file as it
+// exists at the given commit. A missing ignore file ignores nothing.
+func (m *Monitor) applyIgnoreFile(helper *GitHelper, hash string, files []string) []string {
+	if m.repo.IgnoreFile == "" {
+		return files
+	}
+
+	data, err := helper.ReadFile(m.repo, hash, m.repo.IgnoreFile)
+	if err != nil {
+		m.logger.Debugf("No ignore file for '%s': %v", m.repo.Name, err)
+		return files
+	}
+
+	patterns := parseIgnoreFile(data)
+
+	var kept []string
+	for _, file := range files {
+		if !matchPatterns(file, patterns) {
+			kept = append(kept, file)
+		}
+	}
+
+	return kept
 }
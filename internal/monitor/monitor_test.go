@@ -0,0 +1,313 @@
+package monitor
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/logger"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// newTestMonitor creates a monitor for a repository "app" cloned from remote
+func newTestMonitor(t *testing.T, remote *testRemote) *Monitor {
+	t.Helper()
+	return newTestMonitorWith(t, remote, "")
+}
+
+// newTestMonitorWith creates a monitor for a repository "app" cloned from
+// remote, with further settings of the repository
+func newTestMonitorWith(t *testing.T, remote *testRemote, settings string) *Monitor {
+	t.Helper()
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(configPath, []byte(`agent:
+  state_dir: "`+filepath.Join(dir, "state")+`"
+  cache_dir: "`+filepath.Join(dir, "repos")+`"
+repositories:
+  - name: "app"
+    url: "`+remote.path+`"
+    watch_paths:
+      - "src/"
+`+settings+`    action:
+      type: "shell"
+      script: "true"
+`), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	configMgr, err := config.NewManager(configPath)
+	if err != nil {
+		t.Fatalf("NewManager() failed: %v", err)
+	}
+
+	store, err := state.NewStore(filepath.Join(dir, "state"))
+	if err != nil {
+		t.Fatalf("NewStore() failed: %v", err)
+	}
+
+	mon, err := NewMonitor(&configMgr.GetConfig().Repositories[0], configMgr,
+		logger.NewLogger("error", io.Discard), store)
+	if err != nil {
+		t.Fatalf("NewMonitor() failed: %v", err)
+	}
+
+	return mon
+}
+
+// pendingEvent returns the event waiting in the monitor's channel, if any
+func pendingEvent(m *Monitor) *ChangeEvent {
+	select {
+	case event := <-m.eventChan:
+		return &event
+	default:
+		return nil
+	}
+}
+
+// handled records an event as deployed and acknowledges it
+func handled(m *Monitor, event *ChangeEvent) {
+	m.stateStore.ModifyRepository(event.RepositoryName, func(rs *state.RepositoryState) {
+		rs.DeployedHash = event.NewHash
+	})
+	m.Acknowledge(event.NewHash)
+}
+
+func TestCheckRepositoryCoalesces(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.commit(map[string]string{"src/a.txt": "1"})
+	mon := newTestMonitor(t, remote)
+
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+
+	// The event loop is busy: a second commit replaces the first event
+	second := remote.commit(map[string]string{"src/b.txt": "2"})
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+
+	event := pendingEvent(mon)
+	if event == nil || event.NewHash != second || event.OldHash != "" {
+		t.Fatalf("expected one event for %s, got %+v", second, event)
+	}
+	if extra := pendingEvent(mon); extra != nil {
+		t.Fatalf("unexpected second event: %+v", extra)
+	}
+
+	// While the event is handled, the same commit is not emitted again
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	if dup := pendingEvent(mon); dup != nil {
+		t.Fatalf("pending commit emitted again: %+v", dup)
+	}
+
+	handled(mon, event)
+
+	third := remote.commit(map[string]string{"src/a.txt": "3"})
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	event = pendingEvent(mon)
+	if event == nil || event.OldHash != second || event.NewHash != third {
+		t.Fatalf("expected event %s..%s, got %+v", second, third, event)
+	}
+	if len(event.Files) != 1 || event.Files[0] != "src/a.txt" {
+		t.Errorf("files = %v, want [src/a.txt]", event.Files)
+	}
+
+	repoState, _ := mon.stateStore.GetRepository("app")
+	if repoState.CurrentHash != third || repoState.DeployedHash != second {
+		t.Errorf("unexpected state: current %s, deployed %s", repoState.CurrentHash, repoState.DeployedHash)
+	}
+}
+
+func TestCheckRepositoryUnwatchedCommit(t *testing.T) {
+	remote := newTestRemote(t)
+	deployed := remote.commit(map[string]string{"src/a.txt": "1"})
+	mon := newTestMonitor(t, remote)
+	mon.stateStore.UpdateRepository("app", state.RepositoryState{DeployedHash: deployed})
+
+	docs := remote.commit(map[string]string{"docs/readme.md": "x"})
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+
+	if event := pendingEvent(mon); event != nil {
+		t.Fatalf("unexpected event: %+v", event)
+	}
+	if repoState, _ := mon.stateStore.GetRepository("app"); repoState.DeployedHash != docs {
+		t.Errorf("DeployedHash = %s, want %s", repoState.DeployedHash, docs)
+	}
+}
+
+func TestCheckRepositoryRetry(t *testing.T) {
+	remote := newTestRemote(t)
+	deployed := remote.commit(map[string]string{"src/a.txt": "1"})
+	failed := remote.commit(map[string]string{"src/a.txt": "2"})
+	mon := newTestMonitor(t, remote)
+
+	tests := []struct {
+		name      string
+		nextRetry time.Time
+		wantEvent bool
+	}{
+		{"no retry", time.Time{}, false},
+		{"retry not due", time.Now().Add(time.Hour), false},
+		{"retry due", time.Now().Add(-time.Second), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mon.stateStore.UpdateRepository("app", state.RepositoryState{
+				DeployedHash:   deployed,
+				FailedHash:     failed,
+				FailedAttempts: 1,
+				NextRetry:      tt.nextRetry,
+			})
+
+			if err := mon.checkRepository(TriggerPoll); err != nil {
+				t.Fatalf("checkRepository() failed: %v", err)
+			}
+
+			event := pendingEvent(mon)
+			if (event != nil) != tt.wantEvent {
+				t.Fatalf("event = %+v, want event %v", event, tt.wantEvent)
+			}
+			if event != nil {
+				if event.Trigger != TriggerRetry || event.OldHash != deployed || event.NewHash != failed {
+					t.Errorf("unexpected retry event: %+v", event)
+				}
+				mon.Acknowledge(event.NewHash)
+			}
+		})
+	}
+}
+
+func TestCheckRepositoryWhileHandling(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.commit(map[string]string{"src/a.txt": "1"})
+	mon := newTestMonitor(t, remote)
+
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	running := pendingEvent(mon) // received by the event loop, now being handled
+	if running == nil {
+		t.Fatal("expected an event")
+	}
+
+	// A newer commit waits until the running event is acknowledged
+	next := remote.commit(map[string]string{"src/a.txt": "2"})
+	if err := mon.checkRepository(TriggerPushHook); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	if event := pendingEvent(mon); event != nil {
+		t.Fatalf("event emitted while another is handled: %+v", event)
+	}
+
+	handled(mon, running)
+
+	select {
+	case trigger := <-mon.forceChan:
+		if trigger != TriggerPushHook {
+			t.Errorf("recheck trigger = %s, want %s", trigger, TriggerPushHook)
+		}
+	default:
+		t.Fatal("no recheck after acknowledge")
+	}
+
+	if err := mon.checkRepository(TriggerPushHook); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	event := pendingEvent(mon)
+	if event == nil || event.OldHash != running.NewHash || event.NewHash != next {
+		t.Fatalf("expected event %s..%s, got %+v", running.NewHash, next, event)
+	}
+}
+
+func TestCheckRepositoryForcePush(t *testing.T) {
+	tests := []struct {
+		policy     string
+		wantEvent  bool
+		wantStatus string
+	}{
+		{config.ForcePushDeploy, true, state.ForcePushAllowed},
+		{config.ForcePushSkip, false, state.ForcePushSkipped},
+		{config.ForcePushRequireApproval, false, state.ForcePushPendingApproval},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			remote := newTestRemote(t)
+			base := remote.commit(map[string]string{"src/a.txt": "1"})
+			deployed := remote.commit(map[string]string{"src/b.txt": "2"})
+			mon := newTestMonitor(t, remote)
+			mon.repo.OnForcePush = tt.policy
+			mon.stateStore.UpdateRepository("app", state.RepositoryState{DeployedHash: deployed})
+
+			if err := mon.checkRepository(TriggerPoll); err != nil {
+				t.Fatalf("checkRepository() failed: %v", err)
+			}
+
+			// The deployed commit is replaced by another one
+			remote.git("reset", "-q", "--hard", base)
+			head := remote.commit(map[string]string{"src/c.txt": "3"})
+
+			if err := mon.checkRepository(TriggerPoll); err != nil {
+				t.Fatalf("checkRepository() failed: %v", err)
+			}
+
+			event := pendingEvent(mon)
+			if (event != nil) != tt.wantEvent {
+				t.Fatalf("event = %+v, want event %v", event, tt.wantEvent)
+			}
+			if event != nil {
+				if !event.ForcePush || event.OldHash != deployed || event.NewHash != head {
+					t.Errorf("unexpected event: %+v", event)
+				}
+				// Files of the dropped commit and of its replacement
+				if len(event.Files) != 2 || event.Files[0] != "src/b.txt" || event.Files[1] != "src/c.txt" {
+					t.Errorf("files = %v, want [src/b.txt src/c.txt]", event.Files)
+				}
+			}
+
+			repoState, _ := mon.stateStore.GetRepository("app")
+			forcePush := repoState.ForcePush
+			if forcePush == nil || forcePush.Status != tt.wantStatus || forcePush.MergeBase != base || forcePush.NewHash != head {
+				t.Fatalf("ForcePush = %+v, want status %s with merge base %s", forcePush, tt.wantStatus, base)
+			}
+			if tt.policy == config.ForcePushSkip && repoState.DeployedHash != head {
+				t.Errorf("DeployedHash = %s, want the skipped head %s", repoState.DeployedHash, head)
+			}
+			if tt.policy != config.ForcePushRequireApproval {
+				return
+			}
+
+			// Still held on the next check, then deployed once approved
+			if err := mon.checkRepository(TriggerPoll); err != nil {
+				t.Fatalf("checkRepository() failed: %v", err)
+			}
+			if event := pendingEvent(mon); event != nil {
+				t.Fatalf("unapproved force-push emitted: %+v", event)
+			}
+
+			mon.stateStore.ModifyRepository("app", func(rs *state.RepositoryState) {
+				rs.ForcePush.Status = state.ForcePushApproved
+			})
+			if err := mon.checkRepository(TriggerAPI); err != nil {
+				t.Fatalf("checkRepository() failed: %v", err)
+			}
+			event = pendingEvent(mon)
+			if event == nil || !event.ForcePush || event.NewHash != head || event.Trigger != TriggerApproval {
+				t.Errorf("expected approved force-push event, got %+v", event)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package monitor
+
+import "github.com/omnorm/cd-gun/internal/config"
+
+// DefaultRoute is the route name of a repository's top-level watch_paths and actions
+const DefaultRoute = ""
+
+// RouteChange lists the changed files matched by one route of a repository
+type RouteChange struct {
+	Name  string // route name, DefaultRoute for top-level watch_paths
+	Files []string
+}
+
+// MatchRoutes distributes changed files to the routes of a repository.
+// Only routes with at least one matching file are returned.
+func MatchRoutes(repo *config.Repository, files []string) []RouteChange {
+	var changes []RouteChange
+
+	if len(repo.Actions) > 0 {
+		if matched := filterPaths(files, repo.WatchPaths); len(matched) > 0 {
+			changes = append(changes, RouteChange{Name: DefaultRoute, Files: matched})
+		}
+	}
+
+	for _, route := range repo.Routes {
+		if matched := filterPaths(files, route.WatchPaths); len(matched) > 0 {
+			changes = append(changes, RouteChange{Name: route.Name, Files: matched})
+		}
+	}
+
+	return changes
+}
+
+// AllRoutes returns every route of a repository with its watch paths as files.
+// It is used when the actual changes are unknown, e.g. on the first check.
+func AllRoutes(repo *config.Repository) []RouteChange {
+	var changes []RouteChange
+
+	if len(repo.Actions) > 0 {
+		changes = append(changes, RouteChange{Name: DefaultRoute, Files: repo.WatchPaths})
+	}
+
+	for _, route := range repo.Routes {
+		changes = append(changes, RouteChange{Name: route.Name, Files: route.WatchPaths})
+	}
+
+	return changes
+}
+
+// routeFiles returns the union of files over all route changes, in order
+func routeFiles(changes []RouteChange) []string {
+	var files []string
+	seen := make(map[string]bool)
+
+	for _, change := range changes {
+		for _, file := range change.Files {
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+
+	return files
+}
@@ -0,0 +1,66 @@
+package monitor
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/omnorm/cd-gun/internal/config"
+)
+
+func TestMatchRoutes(t *testing.T) {
+	repo := &config.Repository{
+		WatchPaths: []string{"shared/"},
+		Actions:    []config.Action{{Type: "shell"}},
+		Routes: []config.Route{
+			{Name: "api", WatchPaths: []string{"services/api/"}},
+			{Name: "web", WatchPaths: []string{"services/web/", "shared/"}},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		files []string
+		want  []RouteChange
+	}{
+		{
+			name:  "single route",
+			files: []string{"services/api/main.go", "README.md"},
+			want:  []RouteChange{{Name: "api", Files: []string{"services/api/main.go"}}},
+		},
+		{
+			name:  "file shared by default route and web",
+			files: []string{"shared/lib.go", "services/web/index.html"},
+			want: []RouteChange{
+				{Name: DefaultRoute, Files: []string{"shared/lib.go"}},
+				{Name: "web", Files: []string{"shared/lib.go", "services/web/index.html"}},
+			},
+		},
+		{
+			name:  "nothing watched",
+			files: []string{"docs/index.md"},
+			want:  nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MatchRoutes(repo, tt.files)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("MatchRoutes() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllRoutesWithoutTopLevelActions(t *testing.T) {
+	repo := &config.Repository{
+		Routes: []config.Route{
+			{Name: "api", WatchPaths: []string{"services/api/"}},
+		},
+	}
+
+	want := []RouteChange{{Name: "api", Files: []string{"services/api/"}}}
+	if got := AllRoutes(repo); !reflect.DeepEqual(got, want) {
+		t.Errorf("AllRoutes() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,128 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/semver"
+)
+
+// ErrNoMatchingTag is returned for a repository in tag mode none of whose tags
+// matches its pattern and version range
+var ErrNoMatchingTag = errors.New("no tag matches")
+
+// Tag is a tag of a repository and the commit it points to
+type Tag struct {
+	Name string
+	Hash string
+}
+
+// ListTags returns the tags of the local repository that point to commits,
+// directly or through an annotated tag
+func (g *GitHelper) ListTags() ([]Tag, error) {
+	cmd := exec.Command("git", "-C", g.repoPath, "for-each-ref",
+		"--format=%(refname:strip=2) %(objecttype) %(objectname) %(*objecttype) %(*objectname)", "refs/tags")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git for-each-ref failed: %w", err)
+	}
+
+	var tags []Tag
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		// Lightweight tags have no peeled fields
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 3 && fields[1] == "commit":
+			tags = append(tags, Tag{Name: fields[0], Hash: fields[2]})
+		case len(fields) == 5 && fields[1] == "tag" && fields[3] == "commit":
+			tags = append(tags, Tag{Name: fields[0], Hash: fields[4]})
+		}
+	}
+
+	return tags, nil
+}
+
+// SelectTag returns the tag with the highest version among the tags matching
+// the pattern and the version range, nil if none does. Pre-releases are only
+// selected if allowed, tags without a version never. Of two tags with the same
+// version, the one whose name sorts last is selected.
+func SelectTag(tags []Tag, tracking *config.TagTracking) *Tag {
+	var (
+		best        *Tag
+		bestVersion semver.Version
+	)
+
+	for i, tag := range tags {
+		if ok, _ := path.Match(tracking.Pattern, tag.Name); !ok {
+			continue
+		}
+
+		version, ok := tagVersion(tag.Name)
+		switch {
+		case !ok:
+			continue
+		case version.IsPrerelease() && !tracking.Prerelease:
+			continue
+		case tracking.Constraint() != nil && !tracking.Constraint().Check(version):
+			continue
+		}
+
+		if best != nil {
+			if c := version.Compare(bestVersion); c < 0 || c == 0 && tag.Name < best.Name {
+				continue
+			}
+		}
+		best, bestVersion = &tags[i], version
+	}
+
+	return best
+}
+
+// TagAt returns the tag SelectTag chooses among the tags pointing to a
+// commit, or "" if the repository does not track tags or none matches
+func (g *GitHelper) TagAt(repo *config.Repository, hash string) string {
+	if repo.Tags == nil {
+		return ""
+	}
+
+	tags, err := g.ListTags()
+	if err != nil {
+		return ""
+	}
+
+	var at []Tag
+	for _, tag := range tags {
+		if tag.Hash == hash {
+			at = append(at, tag)
+		}
+	}
+
+	if tag := SelectTag(at, repo.Tags); tag != nil {
+		return tag.Name
+	}
+	return ""
+}
+
+// tagVersion parses the version in a tag name, which starts at its first
+// digit: "v1.4.2", "release-1.4.2" and "api/1.4.2" all have version 1.4.2
+func tagVersion(name string) (semver.Version, bool) {
+	i := strings.IndexAny(name, "0123456789")
+	if i < 0 {
+		return semver.Version{}, false
+	}
+
+	version, err := semver.Parse(name[i:])
+	return version, err == nil
+}
+
+// tracked describes what a repository deploys from, for messages
+func tracked(repo *config.Repository) string {
+	if repo.Tags != nil {
+		return fmt.Sprintf("tags matching '%s'", repo.Tags.Pattern)
+	}
+	return fmt.Sprintf("branch '%s'", repo.Branch)
+}
@@ -0,0 +1,146 @@
+package monitor
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/omnorm/cd-gun/internal/config"
+	"github.com/omnorm/cd-gun/internal/state"
+)
+
+// testTagTracking loads the tag tracking settings of a repository
+func testTagTracking(t *testing.T, tags string) *config.TagTracking {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(`repositories:
+  - name: "app"
+    url: "https://github.com/test/app.git"
+    watch_paths: ["."]
+    tags:
+`+tags+`
+    action:
+      type: "shell"
+      script: "true"
+`), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	mgr, err := config.NewManager(path)
+	if err != nil {
+		t.Fatalf("NewManager() failed: %v", err)
+	}
+	return mgr.GetConfig().Repositories[0].Tags
+}
+
+func TestSelectTag(t *testing.T) {
+	tags := []Tag{
+		{"v1.0.0", "a"}, {"v1.4.2", "b"}, {"v1.10.0", "c"}, {"v2.0.0-rc.1", "d"},
+		{"release-1.12.0", "e"}, {"nightly", "f"}, {"api/v3.0.0", "g"}, {"1.10.0", "h"},
+	}
+
+	tests := []struct {
+		name string
+		tags string
+		want string
+	}{
+		{"highest version", `      pattern: "*"`, "release-1.12.0"},
+		{"pattern", `      pattern: "v*"`, "v1.10.0"},
+		{"range", `      pattern: "v*"` + "\n" + `      semver: "<1.5.0"`, "v1.4.2"},
+		{"pre-release", `      pattern: "v*"` + "\n      prerelease: true", "v2.0.0-rc.1"},
+		{"path pattern", `      pattern: "api/*"`, "api/v3.0.0"},
+		{"same version", `      semver: "~1.10"`, "v1.10.0"},
+		{"no match", `      semver: ">=4.0.0"`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if tag := SelectTag(tags, testTagTracking(t, tt.tags)); tag != nil {
+				got = tag.Name
+			}
+			if got != tt.want {
+				t.Errorf("SelectTag() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRepositoryTags(t *testing.T) {
+	remote := newTestRemote(t)
+	v1 := remote.commit(map[string]string{"src/a.txt": "1"})
+	remote.git("tag", "v1.0.0")
+	v11 := remote.commit(map[string]string{"src/b.txt": "2"})
+	remote.git("tag", "-a", "-m", "release", "v1.1.0")
+	remote.commit(map[string]string{"src/c.txt": "3"})
+	remote.git("tag", "v2.0.0")
+
+	mon := newTestMonitorWith(t, remote, "    tags:\n      pattern: \"v*\"\n      semver: \"^1.0.0\"\n")
+
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	event := pendingEvent(mon)
+	if event == nil || event.NewHash != v11 || event.Tag != "v1.1.0" {
+		t.Fatalf("event = %+v, want v1.1.0 at %s", event, state.ShortHash(v11))
+	}
+	handled(mon, event)
+
+	// Commits without a new tag are not deployed
+	remote.commit(map[string]string{"src/d.txt": "4"})
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	if event := pendingEvent(mon); event != nil {
+		t.Fatalf("unexpected event without a new tag: %+v", event)
+	}
+
+	remote.git("checkout", "-q", "-b", "release-1", v11)
+	v12 := remote.commit(map[string]string{"src/e.txt": "5"})
+	remote.git("tag", "v1.2.0")
+
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	event = pendingEvent(mon)
+	if event == nil || event.OldHash != v11 || event.NewHash != v12 || event.Tag != "v1.2.0" || event.ForcePush {
+		t.Fatalf("event = %+v, want v1.2.0 following v1.1.0", event)
+	}
+	if len(event.Files) != 1 || event.Files[0] != "src/e.txt" {
+		t.Errorf("files = %v, want [src/e.txt]", event.Files)
+	}
+	handled(mon, event)
+
+	// A deleted tag is no longer selected, the earlier release is deployed again
+	remote.git("tag", "-d", "v1.2.0")
+	remote.git("tag", "-f", "v1.1.0", v1)
+
+	if err := mon.checkRepository(TriggerPoll); err != nil {
+		t.Fatalf("checkRepository() failed: %v", err)
+	}
+	event = pendingEvent(mon)
+	if event == nil || event.NewHash != v1 || event.Tag != "v1.1.0" || !event.ForcePush {
+		t.Fatalf("event = %+v, want v1.1.0 moved to %s as a rewrite", event, state.ShortHash(v1))
+	}
+
+	rs, _ := mon.stateStore.GetRepository("app")
+	if rs.CurrentTag != "v1.1.0" {
+		t.Errorf("current tag = %q, want v1.1.0", rs.CurrentTag)
+	}
+}
+
+func TestCheckRepositoryNoMatchingTag(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.git("tag", "v0.1.0")
+
+	mon := newTestMonitorWith(t, remote, "    tags:\n      semver: \">=1.0.0\"\n")
+
+	err := mon.checkRepository(TriggerPoll)
+	if err == nil || localFailure(err) {
+		t.Fatalf("checkRepository() error = %v, want no matching tag", err)
+	}
+	if event := pendingEvent(mon); event != nil {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
@@ -0,0 +1,67 @@
+package monitor
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testRemote is a local git repository used as a clone/fetch remote in tests
+type testRemote struct {
+	t    *testing.T
+	path string
+}
+
+// newTestRemote creates a repository on branch main with an initial commit
+func newTestRemote(t *testing.T) *testRemote {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	r := &testRemote{t: t, path: filepath.Join(t.TempDir(), "remote")}
+	r.git("init", "-q", "-b", "main", r.path)
+	r.commit(map[string]string{"README.md": "hello\n"})
+
+	return r
+}
+
+// git runs a git command in the remote repository and returns its output
+func (r *testRemote) git(args ...string) string {
+	r.t.Helper()
+
+	if args[0] != "init" {
+		args = append([]string{"-C", r.path}, args...)
+	}
+	args = append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)
+
+	output, err := exec.Command("git", args...).CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %v failed: %v\n%s", args, err, output)
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// commit writes files and commits them, returning the new commit hash
+func (r *testRemote) commit(files map[string]string) string {
+	r.t.Helper()
+
+	for name, content := range files {
+		fullPath := filepath.Join(r.path, name)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			r.t.Fatalf("mkdir failed: %v", err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			r.t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	r.git("add", "-A")
+	r.git("commit", "-q", "-m", "update")
+
+	return r.git("rev-parse", "HEAD")
+}
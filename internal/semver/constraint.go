@@ -0,0 +1,134 @@
+package semver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Constraint is a version range such as ">=1.0.0 <2.0.0". Comparisons
+// separated by spaces or commas must all hold; alternatives are separated by "||".
+type Constraint struct {
+	alternatives [][]comparison
+}
+
+// comparison compares a version with a bound
+type comparison struct {
+	op    string // one of =, !=, >, >=, <, <=
+	bound Version
+}
+
+// operators in the order they are matched, longest first
+var operators = []string{">=", "<=", "!=", ">", "<", "=", "^", "~"}
+
+// ParseConstraint parses a version range. Each comparison is an operator
+// followed by a version:
+//
+//	=1.2.3, !=1.2.3, >1.2.3, >=1.2.3, <1.2.3, <=1.2.3
+//	^1.2.3  compatible: >=1.2.3 <2.0.0 (^0.2.3 is <0.3.0, ^0.0.3 is <0.0.4)
+//	~1.2.3  patch releases: >=1.2.3 <1.3.0 (~1 is <2.0.0)
+//
+// A version without an operator is compared with "=".
+func ParseConstraint(s string) (*Constraint, error) {
+	c := &Constraint{}
+
+	for _, alternative := range strings.Split(s, "||") {
+		tokens := strings.Fields(strings.ReplaceAll(alternative, ",", " "))
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("invalid version range '%s': empty alternative", s)
+		}
+
+		var comparisons []comparison
+		for i := 0; i < len(tokens); i++ {
+			token := tokens[i]
+
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(token, candidate) {
+					op = candidate
+					break
+				}
+			}
+			token = strings.TrimPrefix(token, op)
+
+			// The version may follow the operator after a space: ">= 1.0.0"
+			if token == "" && op != "" && i+1 < len(tokens) {
+				i++
+				token = tokens[i]
+			}
+			if op == "" {
+				op = "="
+			}
+
+			bound, err := Parse(token)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version range '%s': %w", s, err)
+			}
+			comparisons = append(comparisons, expand(op, bound)...)
+		}
+
+		c.alternatives = append(c.alternatives, comparisons)
+	}
+
+	return c, nil
+}
+
+// expand turns a caret or tilde range into a lower and an upper bound
+func expand(op string, v Version) []comparison {
+	var upper Version
+
+	switch {
+	case op == "^" && (v.Major > 0 || v.parts == 1):
+		upper = Version{Major: v.Major + 1}
+	case op == "^" && (v.Minor > 0 || v.parts == 2):
+		upper = Version{Minor: v.Minor + 1}
+	case op == "^":
+		upper = Version{Patch: v.Patch + 1}
+	case op == "~" && v.parts == 1:
+		upper = Version{Major: v.Major + 1}
+	case op == "~":
+		upper = Version{Major: v.Major, Minor: v.Minor + 1}
+	default:
+		return []comparison{{op: op, bound: v}}
+	}
+
+	// Pre-releases of the upper bound are not part of the range
+	upper.Prerelease = []string{"0"}
+	return []comparison{{op: ">=", bound: v}, {op: "<", bound: upper}}
+}
+
+// Check reports whether a version is in the range
+func (c *Constraint) Check(v Version) bool {
+	for _, comparisons := range c.alternatives {
+		if allHold(comparisons, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// allHold reports whether all comparisons hold for a version
+func allHold(comparisons []comparison, v Version) bool {
+	for _, cmp := range comparisons {
+		c := v.Compare(cmp.bound)
+
+		var ok bool
+		switch cmp.op {
+		case "=":
+			ok = c == 0
+		case "!=":
+			ok = c != 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
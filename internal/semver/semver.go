@@ -0,0 +1,146 @@
+// Package semver parses semantic versions and version ranges, see https://semver.org
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a semantic version. Build metadata is kept but ignored in comparisons.
+type Version struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	Prerelease []string // dot-separated identifiers after "-", nil for a release
+	Build      string   // after "+"
+
+	parts int // number of the major, minor and patch numbers given
+}
+
+// Parse parses a version such as "1.4.2", "v2.0.0-rc.1" or "1.4.2+build.5". A
+// leading "v" is allowed. Missing minor and patch numbers are 0, so "1.4" is 1.4.0.
+func Parse(s string) (Version, error) {
+	var v Version
+
+	rest := strings.TrimPrefix(s, "v")
+	rest, v.Build, _ = strings.Cut(rest, "+")
+	rest, pre, hasPre := strings.Cut(rest, "-")
+
+	numbers := strings.Split(rest, ".")
+	if len(numbers) > 3 {
+		return Version{}, fmt.Errorf("invalid version '%s'", s)
+	}
+	fields := []*uint64{&v.Major, &v.Minor, &v.Patch}
+	for i, n := range numbers {
+		value, err := parseNumber(n)
+		if err != nil {
+			return Version{}, fmt.Errorf("invalid version '%s'", s)
+		}
+		*fields[i] = value
+	}
+	v.parts = len(numbers)
+
+	if hasPre {
+		v.Prerelease = strings.Split(pre, ".")
+		for _, id := range v.Prerelease {
+			if !validIdentifier(id) {
+				return Version{}, fmt.Errorf("invalid pre-release '%s' in version '%s'", pre, s)
+			}
+		}
+	}
+
+	return v, nil
+}
+
+// parseNumber parses a version number; only digits are allowed
+func parseNumber(s string) (uint64, error) {
+	if s == "" || strings.Trim(s, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid number '%s'", s)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// validIdentifier reports whether s is a pre-release identifier: [0-9A-Za-z-]+
+func validIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// IsPrerelease reports whether v is a pre-release version
+func (v Version) IsPrerelease() bool {
+	return len(v.Prerelease) > 0
+}
+
+// String returns the version in its canonical form, without a "v" prefix
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.IsPrerelease() {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v is lower than, equal to or higher than o,
+// in the precedence of semantic versioning
+func (v Version) Compare(o Version) int {
+	for _, c := range [][2]uint64{{v.Major, o.Major}, {v.Minor, o.Minor}, {v.Patch, o.Patch}} {
+		if c[0] != c[1] {
+			return cmpInt(c[0], c[1])
+		}
+	}
+
+	// A release is higher than its pre-releases
+	switch {
+	case !v.IsPrerelease() && !o.IsPrerelease():
+		return 0
+	case !v.IsPrerelease():
+		return 1
+	case !o.IsPrerelease():
+		return -1
+	}
+
+	for i := 0; i < len(v.Prerelease) && i < len(o.Prerelease); i++ {
+		if c := compareIdentifier(v.Prerelease[i], o.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return cmpInt(uint64(len(v.Prerelease)), uint64(len(o.Prerelease)))
+}
+
+// compareIdentifier compares pre-release identifiers: numeric ones numerically
+// and lower than alphanumeric ones, which are compared in ASCII order
+func compareIdentifier(a, b string) int {
+	na, errA := parseNumber(a)
+	nb, errB := parseNumber(b)
+
+	switch {
+	case errA == nil && errB == nil:
+		return cmpInt(na, nb)
+	case errA == nil:
+		return -1
+	case errB == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func cmpInt(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
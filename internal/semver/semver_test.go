@@ -0,0 +1,110 @@
+package semver
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"1.4.2", "1.4.2", false},
+		{"v2.0.0-rc.1", "2.0.0-rc.1", false},
+		{"1.4.2+build.5", "1.4.2+build.5", false},
+		{"1.0.0-alpha-1.2+sha.abc", "1.0.0-alpha-1.2+sha.abc", false},
+		{"1.4", "1.4.0", false},
+		{"3", "3.0.0", false},
+		{"", "", true},
+		{"1.2.3.4", "", true},
+		{"1.x", "", true},
+		{"1.2.-3", "", true},
+		{"1.2.3-", "", true},
+		{"1.2.3-rc..1", "", true},
+		{"1.2.3-rc_1", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			v, err := Parse(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && v.String() != tt.want {
+				t.Errorf("Parse() = %s, want %s", v, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	// In ascending order, from the semver specification
+	ordered := []string{
+		"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta", "1.0.0-beta.2",
+		"1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.2.0", "1.10.0", "2.0.0",
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			a, _ := Parse(ordered[i])
+			b, _ := Parse(ordered[j])
+
+			want := cmpInt(uint64(i), uint64(j))
+			if got := a.Compare(b); got != want {
+				t.Errorf("Compare(%s, %s) = %d, want %d", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	a, _ := Parse("1.0.0+build.1")
+	b, _ := Parse("1.0.0+build.2")
+	if a.Compare(b) != 0 {
+		t.Error("build metadata must not affect precedence")
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		in         []string
+		out        []string
+	}{
+		{">=1.0.0 <2.0.0", []string{"1.0.0", "1.9.9", "1.5.0-rc.1"}, []string{"0.9.0", "2.0.0", "1.0.0-rc.1"}},
+		{">= 1.0.0, < 2.0.0", []string{"1.2.0"}, []string{"2.0.0"}},
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"1.2.2", "2.0.0", "2.0.0-rc.1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"1.4.2", []string{"1.4.2", "v1.4.2+build"}, []string{"1.4.3"}},
+		{"!=1.4.2 >1.4.0", []string{"1.4.1", "1.4.3"}, []string{"1.4.2", "1.4.0"}},
+		{"<1.0.0 || >=3.0.0", []string{"0.5.0", "3.1.0"}, []string{"1.0.0", "2.5.0"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			c, err := ParseConstraint(tt.constraint)
+			if err != nil {
+				t.Fatalf("ParseConstraint() failed: %v", err)
+			}
+
+			for _, s := range tt.in {
+				if v, _ := Parse(s); !c.Check(v) {
+					t.Errorf("Check(%s) = false, want true", s)
+				}
+			}
+			for _, s := range tt.out {
+				if v, _ := Parse(s); c.Check(v) {
+					t.Errorf("Check(%s) = true, want false", s)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConstraintErrors(t *testing.T) {
+	for _, s := range []string{"", ">=", ">=1.0.0 ||", "=>1.0.0", "1.x", "<1.0.0 & >0.5.0"} {
+		if _, err := ParseConstraint(s); err == nil {
+			t.Errorf("ParseConstraint(%q) succeeded, want an error", s)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ErrRunNotFound is returned when a history run does not exist
+var ErrRunNotFound = errors.New("run not found")
+
+// HistoryOptions configures retention of the deployment history
+type HistoryOptions struct {
+	MaxRuns   int           // runs kept per repository, 0 keeps all
+	MaxAge    time.Duration // runs older than this are removed, 0 keeps all
+	MaxOutput int           // bytes of output kept per step, 0 keeps all
+}
+
+// maxRunLine bounds the size of a single history record when reading
+const maxRunLine = 64 << 20
+
+// SetHistoryOptions sets the retention applied when runs are appended
+func (s *Store) SetHistoryOptions(opts HistoryOptions) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	s.historyOpts = opts
+}
+
+// AppendRun appends a run to the history of its repository and applies
+// retention. An empty run ID is filled in.
+func (s *Store) AppendRun(run *Run) error {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	if run.ID == "" {
+		run.ID = NewRunID(run.StartedAt)
+	}
+
+	record := *run
+	record.Steps = make([]StepState, len(run.Steps))
+	for i, step := range run.Steps {
+		step.Output = TruncateOutput(step.Output, s.historyOpts.MaxOutput)
+		record.Steps[i] = step
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal run: %w", err)
+	}
+
+	if err := os.MkdirAll(s.historyDir, 0755); err != nil {
+		return fmt.Errorf("failed to create history directory: %w", err)
+	}
+
+	path := s.historyPath(run.Repository)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open history file: %w", err)
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+
+	return s.pruneHistory(path)
+}
+
+// ListRuns returns up to limit runs of a repository, newest first. A limit of
+// 0 returns all runs.
+func (s *Store) ListRuns(repository string, limit int) ([]Run, error) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	runs, err := readRuns(s.historyPath(repository))
+	if err != nil {
+		return nil, err
+	}
+
+	// Reverse to newest first
+	for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+		runs[i], runs[j] = runs[j], runs[i]
+	}
+
+	if limit > 0 && len(runs) > limit {
+		runs = runs[:limit]
+	}
+
+	return runs, nil
+}
+
+// GetRun returns a single run of a repository
+func (s *Store) GetRun(repository, id string) (*Run, error) {
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+
+	runs, err := readRuns(s.historyPath(repository))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range runs {
+		if runs[i].ID == id {
+			return &runs[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrRunNotFound, id)
+}
+
+// RunLogDir returns the directory holding the per-run output logs
+func (s *Store) RunLogDir() string {
+	return s.runLogDir
+}
+
+// RunLogPath returns the output log file of a run below a run log directory
+func RunLogPath(dir, repository, id string) string {
+	return filepath.Join(dir, url.PathEscape(repository), id+".log")
+}
+
+// RunLogFile returns the output log file of a run, or of the newest run of a
+// repository if id is "latest", which may still be running
+func (s *Store) RunLogFile(repository, id string) (string, error) {
+	if id == "latest" {
+		entries, err := os.ReadDir(filepath.Join(s.runLogDir, url.PathEscape(repository)))
+		latest := ""
+		for _, entry := range entries {
+			// Run IDs start with the start time, so the names sort by age
+			if strings.HasSuffix(entry.Name(), ".log") && entry.Name() > latest {
+				latest = entry.Name()
+			}
+		}
+		if err != nil || latest == "" {
+			return "", fmt.Errorf("%w: no run log for '%s'", ErrRunNotFound, repository)
+		}
+		return filepath.Join(s.runLogDir, url.PathEscape(repository), latest), nil
+	}
+
+	if id == "" || strings.HasPrefix(id, ".") || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("%w: %s", ErrRunNotFound, id)
+	}
+
+	path := RunLogPath(s.runLogDir, repository, id)
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%w: no run log for %s", ErrRunNotFound, id)
+	}
+	return path, nil
+}
+
+// historyPath returns the history file of a repository
+func (s *Store) historyPath(repository string) string {
+	return filepath.Join(s.historyDir, url.PathEscape(repository)+".jsonl")
+}
+
+// pruneHistory rewrites a history file without runs outside the retention
+func (s *Store) pruneHistory(path string) error {
+	opts := s.historyOpts
+	if opts.MaxRuns <= 0 && opts.MaxAge <= 0 {
+		return nil
+	}
+
+	runs, err := readRuns(path)
+	if err != nil {
+		return err
+	}
+
+	keep := runs
+	if opts.MaxAge > 0 {
+		cutoff := time.Now().Add(-opts.MaxAge)
+		for len(keep) > 0 && keep[0].StartedAt.Before(cutoff) {
+			keep = keep[1:]
+		}
+	}
+	if opts.MaxRuns > 0 && len(keep) > opts.MaxRuns {
+		keep = keep[len(keep)-opts.MaxRuns:]
+	}
+
+	if len(keep) == len(runs) {
+		return nil
+	}
+
+	// Output logs go together with their runs
+	for _, run := range runs[:len(runs)-len(keep)] {
+		_ = os.Remove(RunLogPath(s.runLogDir, run.Repository, run.ID))
+	}
+
+	var buf bytes.Buffer
+	for _, run := range keep {
+		data, err := json.Marshal(run)
+		if err != nil {
+			return fmt.Errorf("failed to marshal run: %w", err)
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	// Replace atomically so a crash never leaves a truncated history
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write history file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace history file: %w", err)
+	}
+
+	return nil
+}
+
+// readRuns reads all runs of a history file, oldest first. A missing file is
+// an empty history; malformed lines are skipped.
+func readRuns(path string) ([]Run, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open history file: %w", err)
+	}
+	defer f.Close()
+
+	var runs []Run
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), maxRunLine)
+	for scanner.Scan() {
+		var run Run
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read history file: %w", err)
+	}
+
+	return runs, nil
+}
+
+// NewRunID returns a sortable unique run ID based on the start time
+func NewRunID(t time.Time) string {
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	suffix := make([]byte, 3)
+	_, _ = rand.Read(suffix)
+
+	return t.UTC().Format("20060102T150405.000Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// TruncateOutput keeps the last limit bytes of output, where the cause of a
+// failure usually is
+func TruncateOutput(output string, limit int) string {
+	if limit <= 0 || len(output) <= limit {
+		return output
+	}
+
+	// Not inside a UTF-8 character
+	dropped := len(output) - limit
+	for dropped < len(output) && !utf8.RuneStart(output[dropped]) {
+		dropped++
+	}
+	return fmt.Sprintf("[... %d bytes truncated ...]\n%s", dropped, output[dropped:])
+}
@@ -0,0 +1,129 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryAppendAndQuery(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore() failed: %v", err)
+	}
+
+	start := time.Now()
+	for i, hash := range []string{"aaa", "bbb", "ccc"} {
+		run := &Run{
+			Repository: "my/repo",
+			NewHash:    hash,
+			Trigger:    "poll",
+			StartedAt:  start.Add(time.Duration(i) * time.Second),
+			Status:     "success",
+		}
+		if err := store.AppendRun(run); err != nil {
+			t.Fatalf("AppendRun() failed: %v", err)
+		}
+		if run.ID == "" {
+			t.Fatal("AppendRun() did not assign an ID")
+		}
+	}
+
+	runs, err := store.ListRuns("my/repo", 2)
+	if err != nil {
+		t.Fatalf("ListRuns() failed: %v", err)
+	}
+	if len(runs) != 2 || runs[0].NewHash != "ccc" || runs[1].NewHash != "bbb" {
+		t.Fatalf("ListRuns() = %+v, want newest two runs first", runs)
+	}
+
+	run, err := store.GetRun("my/repo", runs[1].ID)
+	if err != nil {
+		t.Fatalf("GetRun() failed: %v", err)
+	}
+	if run.NewHash != "bbb" {
+		t.Errorf("GetRun() hash = %s, want bbb", run.NewHash)
+	}
+
+	if _, err := store.GetRun("my/repo", "nope"); !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("GetRun() error = %v, want ErrRunNotFound", err)
+	}
+
+	if runs, err := store.ListRuns("other", 0); err != nil || len(runs) != 0 {
+		t.Errorf("ListRuns() for empty history = %v, %v", runs, err)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore() failed: %v", err)
+	}
+	store.SetHistoryOptions(HistoryOptions{MaxRuns: 3, MaxAge: time.Hour, MaxOutput: 10})
+
+	// Run logs are written before the run is recorded
+	writeLog := func(id string) string {
+		path := RunLogPath(store.RunLogDir(), "repo", id)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("output\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	old := &Run{ID: "old", Repository: "repo", NewHash: "old", StartedAt: time.Now().Add(-2 * time.Hour)}
+	oldLog := writeLog(old.ID)
+	if err := store.AppendRun(old); err != nil {
+		t.Fatalf("AppendRun() failed: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		run := &Run{
+			ID:         string(rune('a' + i)),
+			Repository: "repo",
+			NewHash:    string(rune('a' + i)),
+			StartedAt:  time.Now(),
+			Steps:      []StepState{{Name: "deploy", Output: strings.Repeat("x", 20) + "tail"}},
+		}
+		writeLog(run.ID)
+		if err := store.AppendRun(run); err != nil {
+			t.Fatalf("AppendRun() failed: %v", err)
+		}
+	}
+
+	runs, err := store.ListRuns("repo", 0)
+	if err != nil {
+		t.Fatalf("ListRuns() failed: %v", err)
+	}
+	if len(runs) != 3 {
+		t.Fatalf("got %d runs, want 3", len(runs))
+	}
+	for _, run := range runs {
+		if run.NewHash == "old" || run.NewHash == "a" {
+			t.Errorf("run %s should have been pruned", run.NewHash)
+		}
+	}
+
+	if _, err := os.Stat(oldLog); !os.IsNotExist(err) {
+		t.Errorf("log of pruned run still exists: %v", err)
+	}
+	if _, err := store.RunLogFile("repo", "latest"); err != nil {
+		t.Errorf("RunLogFile(latest) failed: %v", err)
+	}
+	if path, err := store.RunLogFile("repo", "d"); err != nil || filepath.Base(path) != "d.log" {
+		t.Errorf("RunLogFile(d) = %q, %v, want d.log", path, err)
+	}
+	if _, err := store.RunLogFile("repo", "../d"); !errors.Is(err, ErrRunNotFound) {
+		t.Errorf("RunLogFile(../d) error = %v, want ErrRunNotFound", err)
+	}
+
+	output := runs[0].Steps[0].Output
+	if !strings.HasSuffix(output, "xxxxxxtail") || !strings.Contains(output, "14 bytes truncated") {
+		t.Errorf("unexpected truncated output %q", output)
+	}
+}
@@ -16,6 +16,11 @@ type Store struct {
 	filePath  string
 	autoSave  bool
 	saveTimer *time.Timer
+
+	historyMu   sync.Mutex // guards history files
+	historyDir  string
+	historyOpts HistoryOptions
+	runLogDir   string
 }
 
 // NewStore creates a new state store
@@ -28,8 +33,10 @@ func NewStore(stateDir string) (*Store, error) {
 	}
 
 	store := &Store{
-		filePath: statePath,
-		autoSave: true,
+		filePath:   statePath,
+		autoSave:   true,
+		historyDir: filepath.Join(stateDir, "history"),
+		runLogDir:  filepath.Join(stateDir, "logs"),
 	}
 
 	// Try to load existing state
@@ -56,6 +63,7 @@ func (s *Store) Load() error {
 		return fmt.Errorf("failed to parse state file: %w", err)
 	}
 
+	state.migrate()
 	s.state = &state
 	return nil
 }
@@ -107,6 +115,21 @@ func (s *Store) UpdateRepository(name string, state RepositoryState) {
 	s.SaveAsync()
 }
 
+// ModifyRepository applies fn to a repository state under the store lock, so
+// concurrent updates of different fields are not lost. A missing state starts
+// out empty.
+func (s *Store) ModifyRepository(name string, fn func(rs *RepositoryState)) RepositoryState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rs, _ := s.state.GetRepository(name)
+	fn(&rs)
+	s.state.UpdateRepository(name, rs)
+	s.SaveAsync()
+
+	return s.state.Repositories[name]
+}
+
 // GetRepository gets a repository state
 func (s *Store) GetRepository(name string) (RepositoryState, bool) {
 	s.mu.RLock()
@@ -0,0 +1,47 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMigratesDeployedHash(t *testing.T) {
+	dir := t.TempDir()
+	old := `{
+  "version": "1.0",
+  "repositories": {
+    "app": {"name": "app", "current_hash": "abc123", "last_action_status": "success"}
+  }
+}`
+	if err := os.WriteFile(filepath.Join(dir, "state.json"), []byte(old), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	store, err := NewStore(dir)
+	if err != nil {
+		t.Fatalf("NewStore() failed: %v", err)
+	}
+
+	rs, ok := store.GetRepository("app")
+	if !ok || rs.DeployedHash != "abc123" {
+		t.Errorf("DeployedHash = %q, want abc123", rs.DeployedHash)
+	}
+	if v := store.GetState().Version; v != Version {
+		t.Errorf("Version = %q, want %q", v, Version)
+	}
+}
+
+func TestModifyRepository(t *testing.T) {
+	store, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewStore() failed: %v", err)
+	}
+
+	store.ModifyRepository("app", func(rs *RepositoryState) { rs.CurrentHash = "bbb" })
+	got := store.ModifyRepository("app", func(rs *RepositoryState) { rs.DeployedHash = "aaa" })
+
+	if got.Name != "app" || got.CurrentHash != "bbb" || got.DeployedHash != "aaa" {
+		t.Errorf("ModifyRepository() = %+v, want both fields kept", got)
+	}
+}
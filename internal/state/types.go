@@ -4,14 +4,99 @@ import "time"
 
 // RepositoryState represents the state of a monitored repository
 type RepositoryState struct {
-	Name               string    `json:"name"`
-	LastFetch          time.Time `json:"last_fetch"`
-	CurrentHash        string    `json:"current_hash"`
-	LastActionExecuted time.Time `json:"last_action_executed"`
-	LastActionStatus   string    `json:"last_action_status"` // success, failure, running
-	LastError          string    `json:"last_error"`
+	Name               string        `json:"name"`
+	LastFetch          time.Time     `json:"last_fetch"`
+	CurrentHash        string        `json:"current_hash"`           // head of the branch at the last fetch
+	DeployedHash       string        `json:"deployed_hash"`          // last commit of the branch whose actions succeeded or that needed none
+	CurrentTag         string        `json:"current_tag,omitempty"`  // tag selected at the last fetch, in tag mode
+	DeployedTag        string        `json:"deployed_tag,omitempty"` // tag of DeployedHash, in tag mode
+	LastActionExecuted time.Time     `json:"last_action_executed"`
+	LastActionStatus   string        `json:"last_action_status"` // success, failure, rolled_back, running, cancelled
+	LastError          string        `json:"last_error"`
+	LastSteps          []StepState   `json:"last_steps,omitempty"`           // per-step results of the last pipeline run
+	LastSuccessfulHash string        `json:"last_successful_hash,omitempty"` // commit of the last successful run
+	RolledBackTo       string        `json:"rolled_back_to,omitempty"`       // commit redeployed by the last rollback, until the next deploy
+	AutoRollback       *AutoRollback `json:"auto_rollback,omitempty"`        // last automatic rollback, until the next deploy
+	FailedHash         string        `json:"failed_hash,omitempty"`          // commit whose deploy failed, until a deploy succeeds
+	FailedAttempts     int           `json:"failed_attempts,omitempty"`      // failed runs of FailedHash
+	NextRetry          time.Time     `json:"next_retry,omitempty"`           // when FailedHash is retried; zero if it is not
+	ForcePush          *ForcePush    `json:"force_push,omitempty"`           // last rewrite of the branch history
 }
 
+// ForcePush records a non-fast-forward update of a repository's branch: the
+// deployed commit is no longer in the history of the new head
+type ForcePush struct {
+	OldHash    string     `json:"old_hash"`             // deployed commit
+	NewHash    string     `json:"new_hash"`             // head of the rewritten branch
+	MergeBase  string     `json:"merge_base,omitempty"` // last common commit, empty if unknown
+	DetectedAt time.Time  `json:"detected_at"`
+	Status     string     `json:"status"` // allowed, skipped, pending_approval, approved
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+}
+
+// Statuses of a ForcePush
+const (
+	ForcePushAllowed         = "allowed"
+	ForcePushSkipped         = "skipped"
+	ForcePushPendingApproval = "pending_approval"
+	ForcePushApproved        = "approved"
+)
+
+// AutoRollback records a failed deploy and the rollback that followed it
+type AutoRollback struct {
+	FailedHash     string    `json:"failed_hash"`
+	FailedRunID    string    `json:"failed_run_id"`
+	FailedError    string    `json:"failed_error"`
+	RollbackHash   string    `json:"rollback_hash"`
+	RollbackRunID  string    `json:"rollback_run_id,omitempty"`
+	RollbackStatus string    `json:"rollback_status"` // success, failure
+	RollbackError  string    `json:"rollback_error,omitempty"`
+	At             time.Time `json:"at"`
+}
+
+// StepState represents the recorded result of a single pipeline step
+type StepState struct {
+	Route    string        `json:"route,omitempty"`
+	Name     string        `json:"name"`
+	Type     string        `json:"type"`
+	Status   string        `json:"status"` // success, failure, skipped, cancelled
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Output   string        `json:"output,omitempty"` // captured output, only kept in history
+	Checks   []CheckState  `json:"checks,omitempty"` // pre_check and verify results
+}
+
+// CheckState represents the recorded result of a pre_check or verify
+type CheckState struct {
+	Stage    string        `json:"stage"`  // pre_check, verify
+	Status   string        `json:"status"` // success, failure
+	Attempts int           `json:"attempts"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Run is a deployment history record of one handled change event
+type Run struct {
+	ID         string      `json:"id"`
+	Repository string      `json:"repository"`
+	OldHash    string      `json:"old_hash"`
+	NewHash    string      `json:"new_hash"`
+	Files      []string    `json:"files"`
+	Trigger    string      `json:"trigger"`              // poll, signal, api, push_hook, retry, rollback, auto_rollback, approval
+	ForcePush  bool        `json:"force_push,omitempty"` // the branch was rewritten since OldHash
+	Tag        string      `json:"tag,omitempty"`        // tag of NewHash, in tag mode
+	StartedAt  time.Time   `json:"started_at"`
+	FinishedAt time.Time   `json:"finished_at"`
+	Status     string      `json:"status"` // success, failure, cancelled
+	Error      string      `json:"error,omitempty"`
+	Steps      []StepState `json:"steps,omitempty"`
+	LogFile    string      `json:"log_file,omitempty"` // full output of the run, see RunLogPath
+}
+
+// Version is the current state file format. Version 1.0 had no DeployedHash
+// and used CurrentHash for both the fetched and the deployed commit.
+const Version = "1.1"
+
 // State represents the overall state of the cd-gun agent
 type State struct {
 	Version      string                     `json:"version"`
@@ -22,7 +107,7 @@ type State struct {
 // NewState creates a new empty state
 func NewState() *State {
 	return &State{
-		Version:      "1.0",
+		Version:      Version,
 		LastUpdated:  time.Now(),
 		Repositories: make(map[string]RepositoryState),
 	}
@@ -35,12 +120,38 @@ func (s *State) UpdateRepository(name string, state RepositoryState) {
 	s.LastUpdated = time.Now()
 }
 
+// migrate upgrades a state loaded from an older state file
+func (s *State) migrate() {
+	if s.Repositories == nil {
+		s.Repositories = make(map[string]RepositoryState)
+	}
+
+	if s.Version == "" || s.Version == "1.0" {
+		for name, rs := range s.Repositories {
+			if rs.DeployedHash == "" {
+				rs.DeployedHash = rs.CurrentHash
+				s.Repositories[name] = rs
+			}
+		}
+	}
+
+	s.Version = Version
+}
+
 // GetRepository gets the state for a repository
 func (s *State) GetRepository(name string) (RepositoryState, bool) {
 	rs, ok := s.Repositories[name]
 	return rs, ok
 }
 
+// ShortHash abbreviates a commit hash for log and error messages
+func ShortHash(hash string) string {
+	if len(hash) > 8 {
+		return hash[:8]
+	}
+	return hash
+}
+
 // ActionResult represents the result of executing an action
 type ActionResult struct {
 	RepositoryName string